@@ -21,11 +21,18 @@ package approle
 
 import (
 	"fmt"
-	"os"
 
+	"github.com/gbevan/gostint/config"
 	"github.com/hashicorp/vault/api"
 )
 
+var cfg *config.Config
+
+// Init the approle module with gostint's configuration
+func Init(c *config.Config) {
+	cfg = c
+}
+
 // Authenticate using our AppRoleID and given wrapped SecretID with Vault
 func Authenticate(appRoleID string, wrapSecretID string) (string, *api.Client, error) {
 	/////////////////////////////////////
@@ -36,7 +43,7 @@ func Authenticate(appRoleID string, wrapSecretID string) (string, *api.Client, e
 	}
 
 	client, err := api.NewClient(&api.Config{
-		Address: os.Getenv("VAULT_ADDR"),
+		Address: cfg.VaultAddr,
 	})
 	if err != nil {
 		return "", &api.Client{}, fmt.Errorf("Failed create vault client api: %s", err)
@@ -59,12 +66,26 @@ func AuthenticatePushMode(appRoleID string, secretID string) (string, *api.Clien
 	return auth(appRoleID, secretID)
 }
 
+// LoginPushMode is AuthenticatePushMode returning the login's auth, with the
+// token's ttl and renewability, rather than just its token
+func LoginPushMode(appRoleID string, secretID string) (*api.SecretAuth, *api.Client, error) {
+	return login(appRoleID, secretID)
+}
+
 func auth(appRoleID string, secretID string) (string, *api.Client, error) {
+	secretAuth, client, err := login(appRoleID, secretID)
+	if err != nil {
+		return "", client, err
+	}
+	return secretAuth.ClientToken, client, nil
+}
+
+func login(appRoleID string, secretID string) (*api.SecretAuth, *api.Client, error) {
 	client, err := api.NewClient(&api.Config{
-		Address: os.Getenv("VAULT_ADDR"),
+		Address: cfg.VaultAddr,
 	})
 	if err != nil {
-		return "", &api.Client{}, fmt.Errorf("Failed create vault client api: %s", err)
+		return nil, &api.Client{}, fmt.Errorf("Failed create vault client api: %s", err)
 	}
 
 	// Authenticate this request using AppRole RoleID and SecretID
@@ -74,11 +95,10 @@ func auth(appRoleID string, secretID string) (string, *api.Client, error) {
 	}
 	resp, err := client.Logical().Write("auth/approle/login", data)
 	if err != nil {
-		return "", &api.Client{}, fmt.Errorf("Request failed AppRole authentication with vault: %s", err)
+		return nil, &api.Client{}, fmt.Errorf("Request failed AppRole authentication with vault: %s", err)
 	}
 	if resp.Auth == nil {
-		return "", &api.Client{}, fmt.Errorf("Request's Vault AppRole authentication returned no Auth token")
+		return nil, &api.Client{}, fmt.Errorf("Request's Vault AppRole authentication returned no Auth token")
 	}
-	token := (*resp.Auth).ClientToken
-	return token, client, nil
+	return resp.Auth, client, nil
 }
@@ -24,10 +24,10 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"strings"
 
 	"github.com/gbevan/gostint/apierrors"
+	"github.com/gbevan/gostint/config"
 	"github.com/gbevan/gostint/logmsg"
 	"github.com/go-chi/render"
 	"github.com/hashicorp/vault/api"
@@ -36,16 +36,28 @@ import (
 
 var debug = Debug("authenticate")
 
+var cfg *config.Config
+
+// Init the authenticate module with gostint's configuration
+func Init(c *config.Config) {
+	cfg = c
+}
+
 // AuthStruct holds authenticated state and policy map from vault for the token
 // placed in context
 type AuthStruct struct {
 	Authenticated bool
 	PolicyMap     map[string]bool
+	Identity      string // the token's vault entity, or its accessor if none
 }
 
 // AuthCtxKey context key for authentication state & policy map
 type AuthCtxKey string
 
+// AdminPolicy is the vault policy a caller's token must hold to use the
+// gostint administrative api endpoints.
+const AdminPolicy = "gostint-admin"
+
 // Authenticate caller's token with vault
 func Authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -65,7 +77,7 @@ func Authenticate(next http.Handler) http.Handler {
 		// log.Printf("X-Auth-Token: %v", token)
 
 		client, err := api.NewClient(&api.Config{
-			Address: os.Getenv("VAULT_ADDR"),
+			Address: cfg.VaultAddr,
 		})
 		if err != nil {
 			errmsg := fmt.Sprintf("Failed create vault client api: %s", err)
@@ -99,8 +111,55 @@ func Authenticate(next http.Handler) http.Handler {
 		for _, p := range tokDetails.Data["policies"].([]interface{}) {
 			authStruct.PolicyMap[p.(string)] = true
 		}
+		if entityID, _ := tokDetails.Data["entity_id"].(string); entityID != "" {
+			authStruct.Identity = "entity:" + entityID
+		} else if accessor, _ := tokDetails.Data["accessor"].(string); accessor != "" {
+			authStruct.Identity = "accessor:" + accessor
+		}
 
 		ctx := context.WithValue(r.Context(), AuthCtxKey("auth"), authStruct)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// RequirePolicy only allows callers whose token holds the given vault policy
+// (or root), must be used after Authenticate.
+func RequirePolicy(policy string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authStruct, ok := r.Context().Value(AuthCtxKey("auth")).(AuthStruct)
+			if !ok || !authStruct.Authenticated {
+				render.Render(w, r, apierrors.ErrPermissionDenied(errors.New("Not authenticated")))
+				return
+			}
+			if !authStruct.hasPolicy(policy) {
+				logmsg.Warn("Token lacks required policy %s for %s %s", policy, r.Method, r.URL.Path)
+				render.Render(w, r, apierrors.ErrPermissionDenied(fmt.Errorf("Token does not have the %s policy", policy)))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (a AuthStruct) hasPolicy(policy string) bool {
+	return a.PolicyMap[policy] || a.PolicyMap["root"]
+}
+
+// Identity returns the authenticated caller's identity, "entity:<id>" for
+// tokens with a vault entity (e.g. from an auth method login), else
+// "accessor:<accessor>" for the token alone. It is "" if not authenticated.
+func Identity(r *http.Request) string {
+	authStruct, ok := r.Context().Value(AuthCtxKey("auth")).(AuthStruct)
+	if !ok || !authStruct.Authenticated {
+		return ""
+	}
+	return authStruct.Identity
+}
+
+// IsAdmin reports whether the authenticated caller's token holds AdminPolicy
+// (or root)
+func IsAdmin(r *http.Request) bool {
+	authStruct, ok := r.Context().Value(AuthCtxKey("auth")).(AuthStruct)
+	return ok && authStruct.Authenticated && authStruct.hasPolicy(AdminPolicy)
+}
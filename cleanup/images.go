@@ -26,6 +26,7 @@ import (
 
 	client "docker.io/go-docker"
 	"docker.io/go-docker/api/types"
+	"github.com/gbevan/gostint/config"
 	"github.com/gbevan/gostint/logmsg"
 )
 
@@ -38,7 +39,7 @@ func ImageUsed(id string, when time.Time) {
 }
 
 // Images cleans up unused docker images
-func Images() {
+func Images(cfg *config.Config) {
 	ctx := context.Background()
 	for {
 		cli, err := client.NewEnvClient()
@@ -54,7 +55,7 @@ func Images() {
 		}
 		for _, img := range imgList {
 			age := time.Since(imageMap[img.ID])
-			if age.Hours() > 24 {
+			if age > cfg.ImageCleanupAge.D() {
 				logmsg.Info("Removing unused image %s: %s", img.ID, img.RepoTags)
 				imagesDeleted, err := cli.ImageRemove(ctx, img.ID, types.ImageRemoveOptions{})
 				if err != nil {
@@ -64,9 +65,10 @@ func Images() {
 			}
 		}
 
-		// wait 1 min + random upto another 1 min (splay)
-		r := rand.Intn(int(time.Minute))
-		time.Sleep(time.Duration(r)*time.Nanosecond + time.Minute)
+		// wait interval + random upto another interval (splay)
+		interval := cfg.ImageCleanupInterval.D()
+		r := rand.Int63n(int64(interval))
+		time.Sleep(time.Duration(r) + interval)
 	} // for
 }
 
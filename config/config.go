@@ -0,0 +1,475 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const redacted = "********"
+
+// Duration is a time.Duration that (un)marshals as a string, e.g. "90s"
+type Duration time.Duration
+
+// D returns the value as a time.Duration
+func (d Duration) D() time.Duration {
+	return time.Duration(d)
+}
+
+// UnmarshalYAML parses a duration string from yaml
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON renders the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// DefaultMaxAttempts is the number of times a job on a queue without an
+// explicit max_attempts may be run when recovering it from a failed node.
+const DefaultMaxAttempts = 3
+
+// QueuePolicy holds settings for jobs on queues whose names match the Qname
+// regular expression, the first matching policy in the config applies.
+type QueuePolicy struct {
+	Qname string `yaml:"qname" json:"qname"`
+
+	// Recovery of jobs orphaned by a failed node: jobs that had not yet
+	// authenticated are re-queued until they have been attempted max_attempts
+	// times, idempotent is recorded in the reason others are not re-queued.
+	Idempotent  bool `yaml:"idempotent"   json:"idempotent"`
+	MaxAttempts int  `yaml:"max_attempts" json:"max_attempts"`
+
+	// Default and maximum time jobs may run for, 0 for no limit.
+	Timeout Duration `yaml:"timeout" json:"timeout"`
+
+	// The vault token given to jobs: policies (jobs may request a subset of
+	// them via vault_policies, if empty the AppRole's) and num_uses (0 for
+	// unlimited).
+	VaultPolicies     []string `yaml:"vault_policies"       json:"vault_policies"`
+	VaultTokenNumUses int      `yaml:"vault_token_num_uses" json:"vault_token_num_uses"`
+
+	// Default and maximum resources, and required security settings, of the
+	// containers of jobs on the queue.
+	Limits Limits `yaml:"limits" json:"limits"`
+
+	// Network modes and docker networks jobs on the queue may choose for
+	// their limits.network_mode, if empty jobs may only choose modes at least
+	// as restrictive as the queue's default.
+	Networks []string `yaml:"networks" json:"networks"`
+
+	// Registries jobs on the queue pull images from, overriding the node's
+	// for the same host.
+	Registries []Registry `yaml:"registries" json:"registries"`
+
+	// Images jobs on the queue may run
+	Images ImagePolicy `yaml:"images" json:"images"`
+
+	// Backends, and paths within them, jobs on the queue may read secret refs
+	// from, if empty only the vault's
+	SecretBackends []SecretBackend `yaml:"secret_backends" json:"secret_backends"`
+
+	qnameRe *regexp.Regexp
+}
+
+// Config holds the gostint node's configuration, loaded from an optional yaml
+// (or toml, by the .toml extension) file with environment variable overrides
+// (named in the env tags).
+// Fields tagged secret are redacted when the config is exposed by the api.
+type Config struct {
+	Port     int    `yaml:"port"      json:"port"      env:"GOSTINT_PORT"`
+	SSLCert  string `yaml:"ssl_cert"  json:"ssl_cert"  env:"GOSTINT_SSL_CERT"`
+	SSLKey   string `yaml:"ssl_key"   json:"ssl_key"   env:"GOSTINT_SSL_KEY"`
+	DbURL    string `yaml:"db_url"    json:"db_url"    env:"GOSTINT_DBURL"`
+	UI       bool   `yaml:"ui"        json:"ui"        env:"GOSTINT_UI"`
+	LogDebug bool   `yaml:"debug"     json:"debug"     env:"GOSTINT_DEBUG" envflag:"true"`
+
+	VaultAddr         string `yaml:"vault_addr"          json:"vault_addr"          env:"VAULT_ADDR"`
+	VaultExternalAddr string `yaml:"vault_external_addr" json:"vault_external_addr" env:"VAULT_EXTERNAL_ADDR"`
+	VaultCACert       string `yaml:"vault_cacert"        json:"vault_cacert"        env:"VAULT_CACERT"`
+
+	RoleID      string `yaml:"role_id"       json:"role_id"       env:"GOSTINT_ROLEID"`
+	RoleName    string `yaml:"role_name"     json:"role_name"     env:"GOSTINT_ROLENAME"`
+	RunRoleID   string `yaml:"run_role_id"   json:"run_role_id"   env:"GOSTINT_RUN_ROLEID"`
+	RunSecretID string `yaml:"run_secret_id" json:"run_secret_id" env:"GOSTINT_RUN_SECRETID" secret:"true"`
+
+	RetentionPolicy string `yaml:"retention_policy" json:"retention_policy" env:"GOSTINT_RETENTION_POLICY"`
+	SecretsDir      string `yaml:"secrets_dir"      json:"secrets_dir"      env:"GOSTINT_SECRETS_DIR"`
+
+	// Secrets given to jobs are written under SecretsTmpfsDir, a tmpfs at the
+	// same path on the docker host, and bind mounted into the job's container.
+	// Without one secrets are copied into the container's filesystem, on the
+	// docker host's disk, with a warning unless SecretsInContainer accepts that.
+	// SecretsLegacyPaths (deprecated) also links them at their original paths.
+	SecretsTmpfsDir    string `yaml:"secrets_tmpfs_dir"    json:"secrets_tmpfs_dir"    env:"GOSTINT_SECRETS_TMPFS_DIR"`
+	SecretsInContainer bool   `yaml:"secrets_in_container" json:"secrets_in_container" env:"GOSTINT_SECRETS_IN_CONTAINER"`
+	SecretsMaxSize     int    `yaml:"secrets_max_size"     json:"secrets_max_size"     env:"GOSTINT_SECRETS_MAX_SIZE"`
+	SecretsLegacyPaths bool   `yaml:"secrets_legacy_paths" json:"secrets_legacy_paths" env:"GOSTINT_SECRETS_LEGACY_PATHS"`
+
+	// Job content fetched from git repositories and urls is cached in
+	// ContentCacheDir (default under the system temp dir).
+	ContentCacheDir string `yaml:"content_cache_dir" json:"content_cache_dir" env:"GOSTINT_CONTENT_CACHE_DIR"`
+
+	// Maximum size of content uploaded to the content store, and the total
+	// size and number of files extracted from any job's content
+	ContentMaxUploadSize int `yaml:"content_max_upload_size" json:"content_max_upload_size" env:"GOSTINT_CONTENT_MAX_UPLOAD_SIZE"`
+	ContentMaxSize       int `yaml:"content_max_size"        json:"content_max_size"        env:"GOSTINT_CONTENT_MAX_SIZE"`
+	ContentMaxFiles      int `yaml:"content_max_files"       json:"content_max_files"       env:"GOSTINT_CONTENT_MAX_FILES"`
+
+	PollInterval         Duration `yaml:"poll_interval"          json:"poll_interval"          env:"GOSTINT_POLL_INTERVAL"`
+	KillPollInterval     Duration `yaml:"kill_poll_interval"     json:"kill_poll_interval"     env:"GOSTINT_KILL_POLL_INTERVAL"`
+	PingInterval         Duration `yaml:"ping_interval"          json:"ping_interval"          env:"GOSTINT_PING_INTERVAL"`
+	NodePollInterval     Duration `yaml:"node_poll_interval"     json:"node_poll_interval"     env:"GOSTINT_NODE_POLL_INTERVAL"`
+	StaleNodeThreshold   Duration `yaml:"stale_node_threshold"   json:"stale_node_threshold"   env:"GOSTINT_STALE_NODE_THRESHOLD"`
+	LeaseDuration        Duration `yaml:"lease_duration"         json:"lease_duration"         env:"GOSTINT_LEASE_DURATION"`
+	LeaderTTL            Duration `yaml:"leader_ttl"             json:"leader_ttl"             env:"GOSTINT_LEADER_TTL"`
+	PurgeAge             Duration `yaml:"purge_age"              json:"purge_age"              env:"GOSTINT_PURGE_AGE"`
+	ImageCleanupAge      Duration `yaml:"image_cleanup_age"      json:"image_cleanup_age"      env:"GOSTINT_IMAGE_CLEANUP_AGE"`
+	ImageCleanupInterval Duration `yaml:"image_cleanup_interval" json:"image_cleanup_interval" env:"GOSTINT_IMAGE_CLEANUP_INTERVAL"`
+	ShutdownTimeout      Duration `yaml:"shutdown_timeout"       json:"shutdown_timeout"       env:"GOSTINT_SHUTDOWN_TIMEOUT"`
+	JobTokenTTL          Duration `yaml:"job_token_ttl"          json:"job_token_ttl"          env:"GOSTINT_JOB_TOKEN_TTL"`
+	ContentCacheAge      Duration `yaml:"content_cache_age"      json:"content_cache_age"      env:"GOSTINT_CONTENT_CACHE_AGE"`
+	ContentFetchTimeout  Duration `yaml:"content_fetch_timeout"  json:"content_fetch_timeout"  env:"GOSTINT_CONTENT_FETCH_TIMEOUT"`
+	ContentUploadGrace   Duration `yaml:"content_upload_grace"   json:"content_upload_grace"   env:"GOSTINT_CONTENT_UPLOAD_GRACE"`
+
+	// Mint jobs' vault tokens as orphans, rather than children of the AppRole
+	// token, needs update on auth/token/create-orphan.
+	JobTokenOrphan bool `yaml:"job_token_orphan" json:"job_token_orphan" env:"GOSTINT_JOB_TOKEN_ORPHAN"`
+
+	// Maximum resources, and required security settings, of all job
+	// containers run by the node, which queues' limits may not exceed.
+	// Seccomp profiles are read from SeccompProfileDir as <name>.json.
+	ContainerLimits   Limits `yaml:"container_limits"    json:"container_limits"`
+	SeccompProfileDir string `yaml:"seccomp_profile_dir" json:"seccomp_profile_dir" env:"GOSTINT_SECCOMP_PROFILE_DIR"`
+
+	// Registries jobs pull images from, with their credentials and mirrors
+	Registries []Registry `yaml:"registries" json:"registries"`
+
+	Queues []QueuePolicy `yaml:"queues" json:"queues"`
+}
+
+// defaults returns the configuration values used when not otherwise set
+func defaults() Config {
+	return Config{
+		Port:                 3232,
+		SecretsMaxSize:       1024 * 1024,
+		PollInterval:         Duration(time.Second),
+		KillPollInterval:     Duration(5 * time.Second),
+		PingInterval:         Duration(time.Minute),
+		NodePollInterval:     Duration(5 * time.Second),
+		StaleNodeThreshold:   Duration(5 * time.Minute),
+		LeaseDuration:        Duration(time.Minute),
+		LeaderTTL:            Duration(30 * time.Second),
+		PurgeAge:             Duration(6 * time.Hour),
+		ImageCleanupAge:      Duration(24 * time.Hour),
+		ImageCleanupInterval: Duration(time.Minute),
+		ShutdownTimeout:      Duration(5 * time.Minute),
+		JobTokenTTL:          Duration(time.Hour),
+		ContentCacheAge:      Duration(24 * time.Hour),
+		ContentFetchTimeout:  Duration(5 * time.Minute),
+		ContentUploadGrace:   Duration(time.Hour),
+		ContentMaxUploadSize: 64 * 1024 * 1024,
+		ContentMaxSize:       256 * 1024 * 1024,
+		ContentMaxFiles:      10000,
+		SecretsLegacyPaths:   true,
+	}
+}
+
+// Load reads the configuration from the yaml file (if not empty), applies
+// any environment variable overrides and validates the result.
+func Load(file string) (*Config, error) {
+	cfg := defaults()
+
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read config file %s: %s", file, err)
+		}
+		if strings.ToLower(filepath.Ext(file)) == ".toml" {
+			if data, err = tomlToYaml(data); err != nil {
+				return nil, fmt.Errorf("Failed parsing toml in config file %s: %s", file, err)
+			}
+		}
+		if err = yaml.UnmarshalStrict(data, &cfg); err != nil {
+			return nil, fmt.Errorf("Failed parsing config file %s: %s", file, err)
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	if cfg.VaultExternalAddr == "" {
+		cfg.VaultExternalAddr = cfg.VaultAddr
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// tomlToYaml converts a toml document to yaml, so both formats share the yaml
+// field names and strict parsing of the config.
+func tomlToYaml(data []byte) ([]byte, error) {
+	doc := map[string]interface{}{}
+	if err := toml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(doc)
+}
+
+// applyEnv overrides fields from their env tagged environment variables
+func (c *Config) applyEnv() error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("env")
+		val, ok := os.LookupEnv(name)
+		if name == "" || !ok || val == "" {
+			continue
+		}
+		f := v.Field(i)
+		switch f.Interface().(type) {
+		case string:
+			f.SetString(val)
+		case int:
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("Invalid integer in %s: %s", name, err)
+			}
+			f.SetInt(int64(n))
+		case bool:
+			if t.Field(i).Tag.Get("envflag") == "true" {
+				// set by any non-empty value, as before the config file
+				f.SetBool(true)
+				continue
+			}
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("Invalid boolean in %s: %s", name, err)
+			}
+			f.SetBool(b)
+		case Duration:
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return fmt.Errorf("Invalid duration in %s: %s", name, err)
+			}
+			f.SetInt(int64(d))
+		default:
+			return fmt.Errorf("Unsupported config type for %s", name)
+		}
+	}
+	return nil
+}
+
+// Validate checks the configuration, returning all problems found in a
+// single error.
+func (c *Config) Validate() error {
+	errs := []string{}
+
+	if c.Port < 1 || c.Port > 65535 {
+		errs = append(errs, fmt.Sprintf("port must be between 1 and 65535, got %d", c.Port))
+	}
+	required := map[string]string{
+		"ssl_cert (GOSTINT_SSL_CERT)":          c.SSLCert,
+		"ssl_key (GOSTINT_SSL_KEY)":            c.SSLKey,
+		"db_url (GOSTINT_DBURL)":               c.DbURL,
+		"vault_addr (VAULT_ADDR)":              c.VaultAddr,
+		"role_id (GOSTINT_ROLEID)":             c.RoleID,
+		"run_role_id (GOSTINT_RUN_ROLEID)":     c.RunRoleID,
+		"run_secret_id (GOSTINT_RUN_SECRETID)": c.RunSecretID,
+	}
+	for name, val := range required {
+		if val == "" {
+			errs = append(errs, fmt.Sprintf("%s is required", name))
+		}
+	}
+	files := map[string]string{
+		"ssl_cert":            c.SSLCert,
+		"ssl_key":             c.SSLKey,
+		"vault_cacert":        c.VaultCACert,
+		"retention_policy":    c.RetentionPolicy,
+		"secrets_dir":         c.SecretsDir,
+		"secrets_tmpfs_dir":   c.SecretsTmpfsDir,
+		"seccomp_profile_dir": c.SeccompProfileDir,
+	}
+	for name, path := range files {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+	if c.SecretsTmpfsDir != "" {
+		if ok, err := isTmpfs(c.SecretsTmpfsDir); err == nil && !ok {
+			errs = append(errs, fmt.Sprintf("secrets_tmpfs_dir %s is not on a tmpfs", c.SecretsTmpfsDir))
+		}
+	}
+	durations := map[string]Duration{
+		"poll_interval":          c.PollInterval,
+		"kill_poll_interval":     c.KillPollInterval,
+		"ping_interval":          c.PingInterval,
+		"node_poll_interval":     c.NodePollInterval,
+		"stale_node_threshold":   c.StaleNodeThreshold,
+		"lease_duration":         c.LeaseDuration,
+		"leader_ttl":             c.LeaderTTL,
+		"purge_age":              c.PurgeAge,
+		"image_cleanup_age":      c.ImageCleanupAge,
+		"image_cleanup_interval": c.ImageCleanupInterval,
+		"shutdown_timeout":       c.ShutdownTimeout,
+		"job_token_ttl":          c.JobTokenTTL,
+		"content_cache_age":      c.ContentCacheAge,
+		"content_fetch_timeout":  c.ContentFetchTimeout,
+		"content_upload_grace":   c.ContentUploadGrace,
+	}
+	for name, d := range durations {
+		if d <= 0 {
+			errs = append(errs, fmt.Sprintf("%s must be a positive duration", name))
+		}
+	}
+	if c.SecretsMaxSize <= 0 {
+		errs = append(errs, "secrets_max_size must be positive")
+	}
+	if c.ContentMaxUploadSize <= 0 {
+		errs = append(errs, "content_max_upload_size must be positive")
+	}
+	if c.ContentMaxSize <= 0 {
+		errs = append(errs, "content_max_size must be positive")
+	}
+	if c.ContentMaxFiles <= 0 {
+		errs = append(errs, "content_max_files must be positive")
+	}
+	if c.StaleNodeThreshold > 0 && c.StaleNodeThreshold < 2*c.PingInterval {
+		errs = append(errs, "stale_node_threshold must be at least twice ping_interval")
+	}
+	errs = append(errs, c.validateLimits("container_limits", &c.ContainerLimits)...)
+	errs = append(errs, validateRegistries("registries", c.Registries)...)
+
+	for i := range c.Queues {
+		q := &c.Queues[i]
+		re, err := regexp.Compile(q.Qname)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("queues[%d].qname is not a valid regular expression: %s", i, err))
+		}
+		q.qnameRe = re
+		if q.MaxAttempts < 0 {
+			errs = append(errs, fmt.Sprintf("queues[%d].max_attempts must not be negative", i))
+		}
+		if q.MaxAttempts == 0 {
+			q.MaxAttempts = DefaultMaxAttempts
+		}
+		if q.Timeout < 0 {
+			errs = append(errs, fmt.Sprintf("queues[%d].timeout must not be negative", i))
+		}
+		if q.VaultTokenNumUses < 0 {
+			errs = append(errs, fmt.Sprintf("queues[%d].vault_token_num_uses must not be negative", i))
+		}
+		errs = append(errs, c.validateLimits(fmt.Sprintf("queues[%d].limits", i), &q.Limits)...)
+		errs = append(errs, validateRegistries(fmt.Sprintf("queues[%d].registries", i), q.Registries)...)
+		errs = append(errs, q.Images.validate(fmt.Sprintf("queues[%d].images", i))...)
+		errs = append(errs, validateSecretBackends(fmt.Sprintf("queues[%d].secret_backends", i), q.SecretBackends)...)
+		for _, n := range q.Networks {
+			if err := ValidateNetwork(n); err != nil {
+				errs = append(errs, fmt.Sprintf("queues[%d].networks: %s", i, err))
+			} else if c.ContainerLimits.NetworkMode == NetworkNone && n != NetworkNone {
+				errs = append(errs, fmt.Sprintf("queues[%d].networks: %s conflicts with container_limits.network_mode", i, n))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		// sorted so validation output is stable between runs
+		sort.Strings(errs)
+		return fmt.Errorf("Invalid configuration:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// Warnings returns the problems with the configuration that gostint still
+// starts with, e.g. deprecated settings, to be logged.
+func (c *Config) Warnings() []string {
+	warns := []string{}
+	if c.SecretsTmpfsDir == "" && !c.SecretsInContainer {
+		warns = append(warns, "secrets_tmpfs_dir is not set, so job secrets are copied into their containers, on the docker host's disk; set secrets_in_container to accept this")
+	}
+	if c.SecretsTmpfsDir != "" && c.SecretsLegacyPaths {
+		warns = append(warns, "secrets_legacy_paths is deprecated, jobs should read their secrets from GOSTINT_SECRETS_FILE and their vault token from GOSTINT_TOKEN_FILE, then set it false")
+	}
+	return warns
+}
+
+// QueuePolicyFor returns the policy for the named queue, or the default policy
+// if none match.
+func (c *Config) QueuePolicyFor(qname string) QueuePolicy {
+	for _, q := range c.Queues {
+		if q.qnameRe != nil && q.qnameRe.MatchString(qname) {
+			return q
+		}
+	}
+	return QueuePolicy{
+		MaxAttempts: DefaultMaxAttempts,
+	}
+}
+
+// Redacted returns a copy of the config safe to expose, with secret fields
+// and any credentials in the db url masked.
+func (c *Config) Redacted() Config {
+	r := *c
+	v := reflect.ValueOf(&r).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("secret") == "true" && v.Field(i).String() != "" {
+			v.Field(i).SetString(redacted)
+		}
+	}
+	if at := strings.LastIndex(r.DbURL, "@"); at != -1 {
+		scheme := ""
+		if i := strings.Index(r.DbURL, "://"); i != -1 && i < at {
+			scheme = r.DbURL[:i+3]
+		}
+		r.DbURL = scheme + redacted + r.DbURL[at:]
+	}
+	return r
+}
@@ -0,0 +1,329 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFiles returns a temp dir holding the files the config must reference
+func testFiles(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "gostint-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for _, f := range []string{"cert.pem", "key.pem"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, f), []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func writeFile(t *testing.T, dir, name, data string) string {
+	t.Helper()
+	f := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(f, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// clearEnv unsets all the config's environment variables for the test
+func clearEnv(t *testing.T) {
+	for _, name := range []string{
+		"GOSTINT_PORT", "GOSTINT_SSL_CERT", "GOSTINT_SSL_KEY", "GOSTINT_DBURL",
+		"GOSTINT_UI", "GOSTINT_DEBUG", "VAULT_ADDR", "VAULT_EXTERNAL_ADDR",
+		"VAULT_CACERT", "GOSTINT_ROLEID", "GOSTINT_RUN_ROLEID",
+		"GOSTINT_RUN_SECRETID", "GOSTINT_POLL_INTERVAL",
+		"GOSTINT_SECRETS_TMPFS_DIR", "GOSTINT_SECRETS_IN_CONTAINER",
+	} {
+		t.Setenv(name, "")
+	}
+}
+
+const yamlConfig = `
+port: 4000
+ssl_cert: %DIR%/cert.pem
+ssl_key: %DIR%/key.pem
+db_url: mongodb://user:pass@db:27017/gostint
+vault_addr: http://vault:8200
+role_id: role
+run_role_id: run-role
+run_secret_id: run-secret
+secrets_in_container: true
+poll_interval: 2s
+container_limits:
+  memory: 1g
+queues:
+  - qname: ^prod-
+    idempotent: true
+    timeout: 1h
+    limits:
+      memory: 512m
+`
+
+const tomlConfig = `
+port = 4000
+ssl_cert = "%DIR%/cert.pem"
+ssl_key = "%DIR%/key.pem"
+db_url = "mongodb://user:pass@db:27017/gostint"
+vault_addr = "http://vault:8200"
+role_id = "role"
+run_role_id = "run-role"
+run_secret_id = "run-secret"
+secrets_in_container = true
+poll_interval = "2s"
+
+[container_limits]
+memory = "1g"
+
+[[queues]]
+qname = "^prod-"
+idempotent = true
+timeout = "1h"
+
+[queues.limits]
+memory = 536870912
+`
+
+func TestLoadFormats(t *testing.T) {
+	for _, tt := range []struct{ name, data string }{
+		{"config.yml", yamlConfig},
+		{"config.toml", tomlConfig},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			dir := testFiles(t)
+			f := writeFile(t, dir, tt.name, strings.Replace(tt.data, "%DIR%", dir, -1))
+
+			cfg, err := Load(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Port != 4000 {
+				t.Errorf("Port = %d, want 4000", cfg.Port)
+			}
+			if cfg.PollInterval.D() != 2*time.Second {
+				t.Errorf("PollInterval = %s, want 2s", cfg.PollInterval.D())
+			}
+			if cfg.PingInterval.D() != time.Minute {
+				t.Errorf("PingInterval = %s, want the default 1m", cfg.PingInterval.D())
+			}
+			if cfg.VaultExternalAddr != cfg.VaultAddr {
+				t.Errorf("VaultExternalAddr = %q, want vault_addr", cfg.VaultExternalAddr)
+			}
+			if cfg.ContainerLimits.Memory != 1024*1024*1024 {
+				t.Errorf("ContainerLimits.Memory = %d", cfg.ContainerLimits.Memory)
+			}
+			qp := cfg.QueuePolicyFor("prod-web")
+			if !qp.Idempotent || qp.Timeout.D() != time.Hour || qp.MaxAttempts != DefaultMaxAttempts {
+				t.Errorf("QueuePolicyFor(prod-web) = %+v", qp)
+			}
+			if qp.Limits.Memory != 512*1024*1024 {
+				t.Errorf("queue Limits.Memory = %d", qp.Limits.Memory)
+			}
+			if qp := cfg.QueuePolicyFor("dev"); qp.Qname != "" || qp.MaxAttempts != DefaultMaxAttempts {
+				t.Errorf("QueuePolicyFor(dev) = %+v, want the default", qp)
+			}
+		})
+	}
+}
+
+func TestLoadRejectsUnknownKeys(t *testing.T) {
+	for _, tt := range []struct{ name, data string }{
+		{"config.yml", "prot: 4000\n"},
+		{"config.toml", "prot = 4000\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			f := writeFile(t, testFiles(t), tt.name, tt.data)
+			if _, err := Load(f); err == nil || !strings.Contains(err.Error(), "prot") {
+				t.Errorf("Load() error = %v, want unknown field prot", err)
+			}
+		})
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	clearEnv(t)
+	dir := testFiles(t)
+	f := writeFile(t, dir, "config.yml", strings.Replace(yamlConfig, "%DIR%", dir, -1))
+
+	t.Setenv("GOSTINT_PORT", "5000")
+	t.Setenv("GOSTINT_POLL_INTERVAL", "3s")
+	t.Setenv("GOSTINT_DEBUG", "yes please")
+	t.Setenv("GOSTINT_UI", "true")
+	cfg, err := Load(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != 5000 || cfg.PollInterval.D() != 3*time.Second {
+		t.Errorf("env did not override the file: port %d, poll_interval %s", cfg.Port, cfg.PollInterval.D())
+	}
+	if !cfg.LogDebug {
+		t.Error("GOSTINT_DEBUG with any non-empty value should enable debug")
+	}
+	if !cfg.UI {
+		t.Error("GOSTINT_UI=true should enable the ui")
+	}
+
+	t.Setenv("GOSTINT_UI", "maybe")
+	if _, err = Load(f); err == nil || !strings.Contains(err.Error(), "GOSTINT_UI") {
+		t.Errorf("Load() error = %v, want invalid boolean in GOSTINT_UI", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	dir := testFiles(t)
+	valid := func() Config {
+		c := defaults()
+		c.SSLCert = filepath.Join(dir, "cert.pem")
+		c.SSLKey = filepath.Join(dir, "key.pem")
+		c.DbURL = "db:27017"
+		c.VaultAddr = "http://vault:8200"
+		c.RoleID = "role"
+		c.RunRoleID = "run-role"
+		c.RunSecretID = "run-secret"
+		c.SecretsInContainer = true
+		return c
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		want   string
+	}{
+		{"valid", func(c *Config) {}, ""},
+		{"port", func(c *Config) { c.Port = 70000 }, "port must be between"},
+		{"secrets on disk", func(c *Config) { c.SecretsInContainer = false }, ""},
+		{"secrets not on tmpfs", func(c *Config) { c.SecretsTmpfsDir = "/proc" }, "secrets_tmpfs_dir /proc is not on a tmpfs"},
+		{"required", func(c *Config) { c.DbURL = "" }, "db_url (GOSTINT_DBURL) is required"},
+		{"missing file", func(c *Config) { c.SSLCert = filepath.Join(dir, "none.pem") }, "ssl_cert:"},
+		{"negative duration", func(c *Config) { c.PurgeAge = Duration(-time.Hour) }, "purge_age must be a positive duration"},
+		{"zero duration", func(c *Config) { c.PollInterval = 0 }, "poll_interval must be a positive duration"},
+		{"stale threshold", func(c *Config) { c.StaleNodeThreshold = c.PingInterval }, "stale_node_threshold must be at least twice"},
+		{"content size", func(c *Config) { c.ContentMaxSize = 0 }, "content_max_size must be positive"},
+		{"queue regexp", func(c *Config) { c.Queues = []QueuePolicy{{Qname: "["}} }, "queues[0].qname is not a valid regular expression"},
+		{"queue attempts", func(c *Config) { c.Queues = []QueuePolicy{{MaxAttempts: -1}} }, "queues[0].max_attempts must not be negative"},
+		{"queue timeout", func(c *Config) { c.Queues = []QueuePolicy{{Timeout: Duration(-1)}} }, "queues[0].timeout must not be negative"},
+		{"queue limits", func(c *Config) {
+			c.ContainerLimits.Memory = 100
+			c.Queues = []QueuePolicy{{Limits: Limits{Memory: 200}}}
+		}, "queues[0].limits.memory exceeds container_limits.memory"},
+		{"queue network", func(c *Config) {
+			c.ContainerLimits.NetworkMode = NetworkNone
+			c.Queues = []QueuePolicy{{Networks: []string{NetworkBridge}}}
+		}, "queues[0].networks: bridge conflicts"},
+		{"host network", func(c *Config) { c.Queues = []QueuePolicy{{Networks: []string{"host"}}} }, "network_mode cannot be host"},
+		{"secret backend", func(c *Config) {
+			c.Queues = []QueuePolicy{{SecretBackends: []SecretBackend{{Scheme: "s3"}}}}
+		}, "queues[0].secret_backends[0].scheme must be one of"},
+		{"secret backend path", func(c *Config) {
+			c.Queues = []QueuePolicy{{SecretBackends: []SecretBackend{{Scheme: "file", Paths: []string{"../etc"}}}}}
+		}, "queues[0].secret_backends[0].paths: invalid path prefix"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.modify(&c)
+			err := c.Validate()
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Validate() = %v, want containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		want   []string
+	}{
+		{"defaults", func(c *Config) {}, []string{"secrets_tmpfs_dir is not set"}},
+		{"secrets in container", func(c *Config) { c.SecretsInContainer = true }, nil},
+		{"legacy paths", func(c *Config) { c.SecretsTmpfsDir = "/dev/shm/gostint" }, []string{"secrets_legacy_paths is deprecated"}},
+		{"no legacy paths", func(c *Config) {
+			c.SecretsTmpfsDir = "/dev/shm/gostint"
+			c.SecretsLegacyPaths = false
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaults()
+			tt.modify(&c)
+			warns := c.Warnings()
+			if len(warns) != len(tt.want) {
+				t.Fatalf("Warnings() = %q, want %d", warns, len(tt.want))
+			}
+			for i, w := range tt.want {
+				if !strings.Contains(warns[i], w) {
+					t.Errorf("Warnings()[%d] = %q, want containing %q", i, warns[i], w)
+				}
+			}
+		})
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	c := Config{
+		RunSecretID: "run-secret",
+		DbURL:       "mongodb://user:pass@db:27017/gostint",
+	}
+	r := c.Redacted()
+	if r.RunSecretID != redacted {
+		t.Errorf("RunSecretID = %q, want redacted", r.RunSecretID)
+	}
+	if r.DbURL != "mongodb://"+redacted+"@db:27017/gostint" {
+		t.Errorf("DbURL = %q", r.DbURL)
+	}
+	if c.RunSecretID != "run-secret" {
+		t.Error("Redacted() modified the config")
+	}
+}
+
+func TestValidateSecretsTmpfsDir(t *testing.T) {
+	if ok, err := isTmpfs("/dev/shm"); err != nil || !ok {
+		t.Skip("no tmpfs at /dev/shm")
+	}
+	c := defaults()
+	c.SecretsTmpfsDir = "/dev/shm"
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("Validate() of an incomplete config succeeded")
+	}
+	if strings.Contains(err.Error(), "secrets_tmpfs_dir") {
+		t.Errorf("Validate() rejected a tmpfs secrets_tmpfs_dir: %s", err)
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package config
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// ImagePolicy restricts the images jobs on a queue may run
+type ImagePolicy struct {
+	// Allowed repositories, as globs of their full names, e.g.
+	// docker.io/library/alpine or registry.example.com/team/*, a trailing
+	// /** matches any depth. Empty allows any.
+	Allowed []string `yaml:"allowed" json:"allowed"`
+
+	// RequireDigest requires images to be referenced by @sha256 digest
+	RequireDigest bool `yaml:"require_digest" json:"require_digest"`
+
+	// SignatureKeys are PEM public key files, if any are given images must
+	// have a cosign signature made by one of them
+	SignatureKeys []string `yaml:"signature_keys" json:"signature_keys"`
+
+	keys []crypto.PublicKey
+}
+
+// Allows returns whether the repository (full name) is allowed
+func (p *ImagePolicy) Allows(repo string) bool {
+	if len(p.Allowed) == 0 {
+		return true
+	}
+	for _, pat := range p.Allowed {
+		if strings.HasSuffix(pat, "/**") && strings.HasPrefix(repo, strings.TrimSuffix(pat, "**")) {
+			return true
+		}
+		if ok, _ := path.Match(pat, repo); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Keys returns the parsed signature keys
+func (p *ImagePolicy) Keys() []crypto.PublicKey {
+	return p.keys
+}
+
+// validate checks the policy and loads its signature keys
+func (p *ImagePolicy) validate(name string) []string {
+	errs := []string{}
+	for _, pat := range p.Allowed {
+		if _, err := path.Match(pat, ""); err != nil {
+			errs = append(errs, fmt.Sprintf("%s.allowed '%s': %s", name, pat, err))
+		}
+	}
+	p.keys = nil
+	for _, file := range p.SignatureKeys {
+		key, err := loadPublicKey(file)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s.signature_keys: %s", name, err))
+			continue
+		}
+		p.keys = append(p.keys, key)
+	}
+	return errs
+}
+
+// loadPublicKey reads a PEM encoded public key (PKIX), as written by cosign
+func loadPublicKey(file string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read public key: %s", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM block in public key file %s", file)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse public key %s: %s", file, err)
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+	default:
+		return nil, fmt.Errorf("Unsupported type of public key %s: %T", file, key)
+	}
+	return key, nil
+}
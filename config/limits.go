@@ -0,0 +1,280 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	units "github.com/docker/go-units"
+)
+
+// Network modes of job containers, any other is the name of a docker network.
+// isolated and internal create a network dedicated to the job, internal
+// without egress.
+const (
+	NetworkBridge   = "bridge"
+	NetworkIsolated = "isolated"
+	NetworkInternal = "internal"
+	NetworkNone     = "none"
+)
+
+// NetworkRank orders the network modes from the least to the most restrictive
+var NetworkRank = map[string]int{
+	NetworkBridge:   0,
+	NetworkIsolated: 1,
+	NetworkInternal: 2,
+	NetworkNone:     3,
+}
+
+// Profile names with special meaning for seccomp_profile and apparmor_profile
+const (
+	ProfileDefault    = "default"
+	ProfileUnconfined = "unconfined"
+)
+
+var (
+	capRe     = regexp.MustCompile(`^[A-Z_]+$`)
+	profileRe = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+	networkRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+)
+
+// Bytes is a size in bytes that unmarshals from a number or a string with a
+// unit, e.g. "512m"
+type Bytes int64
+
+// UnmarshalYAML parses a size from yaml
+func (b *Bytes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v interface{}
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+	return b.set(v)
+}
+
+// UnmarshalJSON parses a size from json
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	return b.set(v)
+}
+
+func (b *Bytes) set(v interface{}) error {
+	switch val := v.(type) {
+	case int:
+		*b = Bytes(val)
+	case float64:
+		*b = Bytes(val)
+	case string:
+		n, err := units.RAMInBytes(val)
+		if err != nil {
+			return fmt.Errorf("Invalid size '%s': %s", val, err)
+		}
+		*b = Bytes(n)
+	default:
+		return fmt.Errorf("Invalid size '%v'", v)
+	}
+	return nil
+}
+
+// Limits constrain and secure a job's container, unset (zero) values leave
+// docker's defaults.
+type Limits struct {
+	Memory          Bytes    `yaml:"memory"            json:"memory,omitempty"            bson:"memory,omitempty"`
+	CPUs            float64  `yaml:"cpus"              json:"cpus,omitempty"              bson:"cpus,omitempty"`
+	PidsLimit       int64    `yaml:"pids_limit"        json:"pids_limit,omitempty"        bson:"pids_limit,omitempty"`
+	ReadOnlyRootfs  bool     `yaml:"read_only_rootfs"  json:"read_only_rootfs,omitempty"  bson:"read_only_rootfs,omitempty"`
+	CapDrop         []string `yaml:"cap_drop"          json:"cap_drop,omitempty"          bson:"cap_drop,omitempty"`
+	NoNewPrivileges bool     `yaml:"no_new_privileges" json:"no_new_privileges,omitempty" bson:"no_new_privileges,omitempty"`
+	SeccompProfile  string   `yaml:"seccomp_profile"   json:"seccomp_profile,omitempty"   bson:"seccomp_profile,omitempty"`
+	AppArmorProfile string   `yaml:"apparmor_profile"  json:"apparmor_profile,omitempty"  bson:"apparmor_profile,omitempty"`
+	NetworkMode     string   `yaml:"network_mode"      json:"network_mode,omitempty"      bson:"network_mode,omitempty"`
+}
+
+// Override returns the limits with those set in o overriding them, booleans
+// can only be set and cap_drop accumulates.
+func (l Limits) Override(o *Limits) Limits {
+	if o == nil {
+		return l
+	}
+	if o.Memory != 0 {
+		l.Memory = o.Memory
+	}
+	if o.CPUs != 0 {
+		l.CPUs = o.CPUs
+	}
+	if o.PidsLimit != 0 {
+		l.PidsLimit = o.PidsLimit
+	}
+	l.ReadOnlyRootfs = l.ReadOnlyRootfs || o.ReadOnlyRootfs
+	l.CapDrop = unionCaps(l.CapDrop, o.CapDrop)
+	l.NoNewPrivileges = l.NoNewPrivileges || o.NoNewPrivileges
+	if o.SeccompProfile != "" {
+		l.SeccompProfile = o.SeccompProfile
+	}
+	if o.AppArmorProfile != "" {
+		l.AppArmorProfile = o.AppArmorProfile
+	}
+	if o.NetworkMode != "" {
+		l.NetworkMode = o.NetworkMode
+	}
+	return l
+}
+
+// Validate checks the limits' values, returning any problems
+func (l *Limits) Validate() []string {
+	errs := []string{}
+	if l.Memory < 0 {
+		errs = append(errs, "memory must not be negative")
+	}
+	if l.CPUs < 0 {
+		errs = append(errs, "cpus must not be negative")
+	}
+	if l.PidsLimit < 0 {
+		errs = append(errs, "pids_limit must not be negative")
+	}
+	for _, c := range l.CapDrop {
+		if !capRe.MatchString(CapName(c)) {
+			errs = append(errs, fmt.Sprintf("invalid capability in cap_drop: '%s'", c))
+		}
+	}
+	profiles := map[string]string{
+		"seccomp_profile":  l.SeccompProfile,
+		"apparmor_profile": l.AppArmorProfile,
+	}
+	for name, p := range profiles {
+		if p != "" && !profileRe.MatchString(p) {
+			errs = append(errs, fmt.Sprintf("invalid %s name: '%s'", name, p))
+		}
+	}
+	if l.NetworkMode != "" {
+		if err := ValidateNetwork(l.NetworkMode); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	return errs
+}
+
+// ValidateNetwork checks a network mode or docker network name
+func ValidateNetwork(n string) error {
+	switch n {
+	case "host", "default":
+		return fmt.Errorf("network_mode cannot be %s", n)
+	}
+	if _, ok := NetworkRank[n]; !ok && !networkRe.MatchString(n) {
+		return fmt.Errorf("invalid network_mode: '%s'", n)
+	}
+	return nil
+}
+
+// CapName normalises a capability name, e.g. net_raw to NET_RAW, dropping any
+// CAP_ prefix
+func CapName(c string) string {
+	return strings.TrimPrefix(strings.ToUpper(c), "CAP_")
+}
+
+// unionCaps returns the normalised capabilities in either list
+func unionCaps(a, b []string) []string {
+	if len(b) == 0 {
+		return a
+	}
+	seen := map[string]bool{}
+	caps := []string{}
+	for _, c := range append(append([]string{}, a...), b...) {
+		c = CapName(c)
+		if !seen[c] {
+			seen[c] = true
+			caps = append(caps, c)
+		}
+	}
+	return caps
+}
+
+// validateLimits checks the node's or a queue's limits, a queue's must be
+// within the node's
+func (c *Config) validateLimits(name string, l *Limits) []string {
+	errs := []string{}
+	for _, e := range l.Validate() {
+		errs = append(errs, fmt.Sprintf("%s: %s", name, e))
+	}
+
+	node := &c.ContainerLimits
+	if l != node {
+		maxima := []struct {
+			field   string
+			v, node float64
+		}{
+			{"memory", float64(l.Memory), float64(node.Memory)},
+			{"cpus", l.CPUs, node.CPUs},
+			{"pids_limit", float64(l.PidsLimit), float64(node.PidsLimit)},
+		}
+		for _, m := range maxima {
+			if m.node > 0 && m.v > m.node {
+				errs = append(errs, fmt.Sprintf("%s.%s exceeds container_limits.%s", name, m.field, m.field))
+			}
+		}
+		profiles := []struct {
+			field   string
+			v, node string
+		}{
+			{"seccomp_profile", l.SeccompProfile, node.SeccompProfile},
+			{"apparmor_profile", l.AppArmorProfile, node.AppArmorProfile},
+		}
+		for _, p := range profiles {
+			if p.v != "" && p.node != "" && p.v != p.node {
+				errs = append(errs, fmt.Sprintf("%s.%s conflicts with container_limits.%s", name, p.field, p.field))
+			}
+		}
+		if node.NetworkMode == NetworkNone && l.NetworkMode != "" && l.NetworkMode != NetworkNone {
+			errs = append(errs, fmt.Sprintf("%s.network_mode conflicts with container_limits.network_mode", name))
+		}
+	}
+
+	if l.ReadOnlyRootfs && c.SecretsTmpfsDir == "" {
+		errs = append(errs, fmt.Sprintf("%s.read_only_rootfs needs secrets_tmpfs_dir, secrets cannot be copied into a read-only root filesystem", name))
+	}
+	if p := l.SeccompProfile; p != "" && p != ProfileDefault && p != ProfileUnconfined {
+		if _, err := c.SeccompProfile(p); err != nil {
+			errs = append(errs, fmt.Sprintf("%s.seccomp_profile: %s", name, err))
+		}
+	}
+	return errs
+}
+
+// SeccompProfile reads the named seccomp profile from the seccomp_profile_dir
+func (c *Config) SeccompProfile(name string) ([]byte, error) {
+	if c.SeccompProfileDir == "" {
+		return nil, fmt.Errorf("seccomp profile '%s' needs seccomp_profile_dir to be configured", name)
+	}
+	if !profileRe.MatchString(name) {
+		return nil, fmt.Errorf("invalid seccomp profile name: '%s'", name)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(c.SeccompProfileDir, name+".json"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read seccomp profile: %s", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Registry configures pulls of job images from a docker registry
+type Registry struct {
+	// Host of the registry as in image names, e.g. registry.example.com:5000,
+	// or docker.io for Docker Hub
+	Host string `yaml:"host" json:"host"`
+
+	// Secret refs of the credentials, read with gostint's own vault token,
+	// whose vars are username, password, identitytoken or registrytoken
+	Auth []string `yaml:"auth" json:"auth"`
+
+	// Mirror host to pull the registry's images from, falling back to the
+	// registry itself
+	Mirror string `yaml:"mirror" json:"mirror"`
+
+	// Insecure allows pulls from the registry (or its mirror) when the
+	// docker daemon treats it as an insecure registry
+	Insecure bool `yaml:"insecure" json:"insecure"`
+}
+
+// RegistryFor returns the configuration of the registry host for jobs on the
+// queue, the queue's overriding the node's, or nil if not configured.
+func (c *Config) RegistryFor(qp QueuePolicy, host string) *Registry {
+	for _, regs := range [][]Registry{qp.Registries, c.Registries} {
+		for i := range regs {
+			if regs[i].Host == host {
+				return &regs[i]
+			}
+		}
+	}
+	return nil
+}
+
+// validateRegistries checks the node's or a queue's registries
+func validateRegistries(name string, regs []Registry) []string {
+	errs := []string{}
+	seen := map[string]bool{}
+	for i, r := range regs {
+		hosts := map[string]string{
+			"host":   r.Host,
+			"mirror": r.Mirror,
+		}
+		for field, h := range hosts {
+			if strings.ContainsAny(h, "/ ") {
+				errs = append(errs, fmt.Sprintf("%s[%d].%s must be a host[:port], got '%s'", name, i, field, h))
+			}
+		}
+		if r.Host == "" {
+			errs = append(errs, fmt.Sprintf("%s[%d].host is required", name, i))
+		}
+		if seen[r.Host] {
+			errs = append(errs, fmt.Sprintf("%s[%d].host %s is repeated", name, i, r.Host))
+		}
+		seen[r.Host] = true
+	}
+	return errs
+}
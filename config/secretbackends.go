@@ -0,0 +1,93 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// SecretSchemes are the secret ref backends, see package secretrefs
+var SecretSchemes = []string{"vault", "vault-dynamic", "file", "env"}
+
+// DefaultSecretBackends are allowed to jobs on queues without secret_backends
+var DefaultSecretBackends = []SecretBackend{
+	{Scheme: "vault"},
+	{Scheme: "vault-dynamic"},
+}
+
+// SecretBackend allows jobs on a queue to read secret refs from the backend
+// of the scheme, limited to the given paths and any below them (if any). Paths of
+// the file backend are relative to the node's secrets_dir, and of the env
+// backend are variable names (without the GOSTINT_SECRET_ prefix).
+type SecretBackend struct {
+	Scheme string   `yaml:"scheme" json:"scheme"`
+	Paths  []string `yaml:"paths"  json:"paths"`
+}
+
+// SecretBackendsFor returns the secret backends jobs on the queue may use
+func (qp QueuePolicy) SecretBackendsFor() []SecretBackend {
+	if len(qp.SecretBackends) == 0 {
+		return DefaultSecretBackends
+	}
+	return qp.SecretBackends
+}
+
+// AllowsSecret returns true if one of the backends allows reading the path of
+// the scheme.
+func AllowsSecret(backends []SecretBackend, scheme, p string) bool {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	for _, b := range backends {
+		if b.Scheme != scheme {
+			continue
+		}
+		if len(b.Paths) == 0 {
+			return true
+		}
+		for _, prefix := range b.Paths {
+			prefix = strings.TrimPrefix(path.Clean("/"+prefix), "/")
+			if prefix == "" || p == prefix || strings.HasPrefix(p, prefix+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateSecretBackends checks a queue's secret backends
+func validateSecretBackends(name string, backends []SecretBackend) []string {
+	errs := []string{}
+	for i, b := range backends {
+		known := false
+		for _, s := range SecretSchemes {
+			known = known || b.Scheme == s
+		}
+		if !known {
+			errs = append(errs, fmt.Sprintf("%s[%d].scheme must be one of %s, got '%s'", name, i, strings.Join(SecretSchemes, ", "), b.Scheme))
+		}
+		for _, p := range b.Paths {
+			if p == "" || strings.Contains(p, "..") {
+				errs = append(errs, fmt.Sprintf("%s[%d].paths: invalid path prefix '%s'", name, i, p))
+			}
+		}
+	}
+	return errs
+}
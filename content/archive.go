@@ -0,0 +1,240 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package content
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content archives of any format are normalised, in a single pass, to the tar
+// stream copied into the job's container, extracting gostint.yml on the way.
+// The total size of the files extracted and their number are limited by
+// content_max_size and content_max_files, against archive bombs.
+
+// MetaFile is the content's meta data file, at the root of the archive
+const MetaFile = "gostint.yml"
+
+// Archive is job content normalised to a tar stream
+type Archive struct {
+	Tar   *os.File // positioned at the start of the stream, already unlinked
+	Meta  []byte   // gostint.yml, nil if not present
+	Size  int64
+	Files int
+}
+
+// Close releases the archive's tar stream
+func (a *Archive) Close() error {
+	return a.Tar.Close()
+}
+
+type normaliser struct {
+	arc      *Archive
+	tw       *tar.Writer
+	maxSize  int64
+	maxFiles int
+}
+
+// Normalise converts a content archive of the given format to a tar stream
+func Normalise(format string, data []byte) (*Archive, error) {
+	f, err := ioutil.TempFile("", "gostint-content-")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create content tar: %s", err)
+	}
+	// unlinked now, the space is released when it is closed
+	os.Remove(f.Name())
+
+	n := normaliser{
+		arc:      &Archive{Tar: f},
+		tw:       tar.NewWriter(f),
+		maxSize:  int64(content.Cfg.ContentMaxSize),
+		maxFiles: content.Cfg.ContentMaxFiles,
+	}
+	err = n.convert(format, data)
+	if err == nil {
+		err = n.tw.Close()
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return n.arc, nil
+}
+
+func (n *normaliser) convert(format string, data []byte) error {
+	switch format {
+	case "targz":
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("Failed to unzip content: %s", err)
+		}
+		defer gz.Close()
+		return n.fromTar(gz)
+	case "tar":
+		return n.fromTar(bytes.NewReader(data))
+	case "tarzst":
+		zr, err := zstd.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("Failed to decompress zstd content: %s", err)
+		}
+		defer zr.Close()
+		return n.fromTar(zr)
+	case "zip":
+		return n.fromZip(data)
+	default:
+		return fmt.Errorf("Failed to extract content, unsupported archive format: %s", format)
+	}
+}
+
+func (n *normaliser) fromTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Failed content tar: %s", err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeDir, tar.TypeSymlink, tar.TypeLink:
+		default:
+			continue // devices, fifos and the like have no place in content
+		}
+		if err = n.add(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func (n *normaliser) fromZip(data []byte) error {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return fmt.Errorf("Failed to read zip content: %s", err)
+	}
+	for _, zf := range zr.File {
+		fi := zf.FileInfo()
+		hdr := &tar.Header{
+			Name:     zf.Name,
+			Mode:     int64(fi.Mode().Perm()),
+			ModTime:  zf.Modified,
+			Typeflag: tar.TypeReg,
+			Size:     int64(zf.UncompressedSize64),
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644 // zips made on windows carry no unix mode
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return fmt.Errorf("Failed to read %s from zip content: %s", zf.Name, err)
+		}
+		switch {
+		case fi.IsDir():
+			hdr.Typeflag = tar.TypeDir
+			hdr.Size = 0
+			if hdr.Mode == 0644 {
+				hdr.Mode = 0755
+			}
+		case fi.Mode()&os.ModeSymlink != 0:
+			// the link target is the file's content
+			target, err2 := ioutil.ReadAll(io.LimitReader(rc, 4096))
+			if err2 != nil {
+				rc.Close()
+				return fmt.Errorf("Failed to read %s from zip content: %s", zf.Name, err2)
+			}
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = string(target)
+			hdr.Size = 0
+		}
+		err = n.add(hdr, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add writes an entry to the tar stream, with its name relative to the root
+// of the container, checking the limits.
+func (n *normaliser) add(hdr *tar.Header, r io.Reader) error {
+	name := rootPath(hdr.Name)
+	if name == "/" {
+		return nil
+	}
+
+	n.arc.Files++
+	if n.arc.Files > n.maxFiles {
+		return fmt.Errorf("Content has more than content_max_files (%d) files", n.maxFiles)
+	}
+	n.arc.Size += hdr.Size
+	if n.arc.Size > n.maxSize {
+		return fmt.Errorf("Content is larger than content_max_size (%d bytes)", n.maxSize)
+	}
+
+	hdr.Name = "." + name
+	if hdr.Typeflag == tar.TypeDir {
+		hdr.Name += "/"
+	}
+	if hdr.Typeflag == tar.TypeLink {
+		hdr.Linkname = "." + rootPath(hdr.Linkname)
+	}
+	hdr.Format = tar.FormatUnknown // let the writer choose
+	if err := n.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("Failed writing content tar: %s", err)
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	w := io.Writer(n.tw)
+	var meta bytes.Buffer
+	if name == "/"+MetaFile {
+		w = io.MultiWriter(n.tw, &meta)
+	}
+	// exactly the declared size, the readers fail entries that are short or
+	// hold more
+	if _, err := io.CopyN(w, r, hdr.Size); err != nil {
+		return fmt.Errorf("Failed copying %s in content: %s", hdr.Name, err)
+	}
+	if name == "/"+MetaFile {
+		n.arc.Meta = meta.Bytes()
+	}
+	return nil
+}
+
+// rootPath returns an entry's name as a clean absolute path, as content is
+// extracted at the root of the container.
+func rootPath(name string) string {
+	return path.Clean("/" + strings.TrimPrefix(name, "./"))
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package content
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/gbevan/gostint/config"
+	"github.com/klauspost/compress/zstd"
+)
+
+type entry struct {
+	name     string
+	typeflag byte
+	body     string
+}
+
+func makeTar(t *testing.T, entries []entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: 0644, Size: int64(len(e.body))}
+		if e.typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil && hdr.Size > 0 {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// encode returns the entries as an archive of format
+func encode(t *testing.T, format string, entries []entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	switch format {
+	case "tar":
+		return makeTar(t, entries)
+	case "targz":
+		gz := gzip.NewWriter(&buf)
+		gz.Write(makeTar(t, entries))
+		gz.Close()
+	case "tarzst":
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zw.Write(makeTar(t, entries))
+		zw.Close()
+	case "zip":
+		zw := zip.NewWriter(&buf)
+		for _, e := range entries {
+			if e.typeflag != tar.TypeReg {
+				continue
+			}
+			w, err := zw.Create(e.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte(e.body))
+		}
+		zw.Close()
+	}
+	return buf.Bytes()
+}
+
+func withLimits(t *testing.T, maxSize, maxFiles int) {
+	t.Helper()
+	old := content.Cfg
+	content.Cfg = &config.Config{ContentMaxSize: maxSize, ContentMaxFiles: maxFiles}
+	t.Cleanup(func() { content.Cfg = old })
+}
+
+func readTar(t *testing.T, arc *Archive) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	tr := tar.NewReader(arc.Tar)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body bytes.Buffer
+		io.Copy(&body, tr)
+		files[hdr.Name] = body.String()
+	}
+}
+
+func TestNormalise(t *testing.T) {
+	withLimits(t, 1024, 10)
+	entries := []entry{
+		{"gostint.yml", tar.TypeReg, "run: [site.yml]\n"},
+		{"./roles/", tar.TypeDir, ""},
+		{"../../roles/main.yml", tar.TypeReg, "- hosts: all\n"},
+	}
+	for _, format := range []string{"tar", "targz", "tarzst", "zip"} {
+		t.Run(format, func(t *testing.T) {
+			arc, err := Normalise(format, encode(t, format, entries))
+			if err != nil {
+				t.Fatalf("Normalise() error = %v", err)
+			}
+			defer arc.Close()
+			if string(arc.Meta) != "run: [site.yml]\n" {
+				t.Errorf("Meta = %q", arc.Meta)
+			}
+			files := readTar(t, arc)
+			if files["./gostint.yml"] != "run: [site.yml]\n" || files["./roles/main.yml"] != "- hosts: all\n" {
+				t.Errorf("entries not normalised to the container root: %v", files)
+			}
+			if arc.Size != int64(len("run: [site.yml]\n- hosts: all\n")) {
+				t.Errorf("Size = %d", arc.Size)
+			}
+		})
+	}
+}
+
+func TestNormaliseLimits(t *testing.T) {
+	big := []entry{
+		{"a", tar.TypeReg, strings.Repeat("a", 600)},
+		{"b", tar.TypeReg, strings.Repeat("b", 600)},
+	}
+	many := []entry{
+		{"a", tar.TypeReg, "a"},
+		{"b", tar.TypeReg, "b"},
+		{"c", tar.TypeReg, "c"},
+	}
+	tests := []struct {
+		name    string
+		entries []entry
+		want    string
+	}{
+		{"size", big, "content_max_size"},
+		{"files", many, "content_max_files"},
+	}
+	withLimits(t, 1024, 2)
+	for _, tt := range tests {
+		for _, format := range []string{"tar", "targz", "tarzst", "zip"} {
+			t.Run(tt.name+"/"+format, func(t *testing.T) {
+				arc, err := Normalise(format, encode(t, format, tt.entries))
+				if err == nil {
+					arc.Close()
+				}
+				if err == nil || !strings.Contains(err.Error(), tt.want) {
+					t.Errorf("Normalise() error = %v, want containing %q", err, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestNormaliseSkipsSpecialFiles(t *testing.T) {
+	withLimits(t, 1024, 10)
+	arc, err := Normalise("tar", makeTar(t, []entry{
+		{"dev/null", tar.TypeChar, ""},
+		{"fifo", tar.TypeFifo, ""},
+		{"site.yml", tar.TypeReg, "x"},
+	}))
+	if err != nil {
+		t.Fatalf("Normalise() error = %v", err)
+	}
+	defer arc.Close()
+	files := readTar(t, arc)
+	if len(files) != 1 || arc.Files != 1 {
+		t.Errorf("special files not skipped: %v", files)
+	}
+}
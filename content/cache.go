@@ -0,0 +1,107 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package content
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gbevan/gostint/logmsg"
+)
+
+// The content cache holds fetched archives in files named by their key,
+// entries not used for content_cache_age (and any partial entries left by a
+// crash) are removed when new content is cached.
+// Caching is best effort, failures are logged and the content used uncached.
+
+func cacheDir() string {
+	if content.Cfg.ContentCacheDir != "" {
+		return content.Cfg.ContentCacheDir
+	}
+	return filepath.Join(os.TempDir(), "gostint-content")
+}
+
+func cachePath(key string) string {
+	return filepath.Join(cacheDir(), key)
+}
+
+// cacheGet returns the cached content for key, or nil if not cached
+func cacheGet(key string) []byte {
+	p := cachePath(key)
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil
+	}
+	now := time.Now()
+	if err = os.Chtimes(p, now, now); err != nil {
+		logmsg.Warn("Failed to touch content cache entry %s: %s", p, err)
+	}
+	logmsg.Debug("Content cache hit: %s", key)
+	return data
+}
+
+// cachePut stores content in the cache, replacing it atomically so
+// concurrent jobs never read a partial entry.
+func cachePut(key string, data []byte) {
+	dir := cacheDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logmsg.Error("Failed to create content cache dir %s: %s", dir, err)
+		return
+	}
+	f, err := ioutil.TempFile(dir, ".fetch-")
+	if err != nil {
+		logmsg.Error("Failed to create content cache entry: %s", err)
+		return
+	}
+	_, err = f.Write(data)
+	if errC := f.Close(); err == nil {
+		err = errC
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), cachePath(key))
+	}
+	if err != nil {
+		logmsg.Error("Failed to write content cache entry %s: %s", key, err)
+		os.Remove(f.Name())
+		return
+	}
+	prune()
+}
+
+// prune removes cache entries unused for content_cache_age
+func prune() {
+	dir := cacheDir()
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logmsg.Error("Failed to read content cache dir %s: %s", dir, err)
+		return
+	}
+	cutoff := time.Now().Add(-content.Cfg.ContentCacheAge.D())
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || fi.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil && !os.IsNotExist(err) {
+			logmsg.Warn("Failed to remove content cache entry %s: %s", fi.Name(), err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package content
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gbevan/gostint/config"
+	"github.com/globalsign/mgo"
+)
+
+// Remote content sources for jobs, fetched by the node running the job (see
+// store.go for uploaded content):
+//   git+https://host/org/repo.git#ref[:subdir]
+//   https://host/path/content.tar.gz#sha256=<hex>
+// A git ref is a branch, tag or commit (HEAD if omitted), optionally with the
+// subdirectory of the repository to use as the content. Downloads must give
+// the sha256 of the archive, which is verified. Fetched content is kept in a
+// node local cache keyed by git repository, commit (and subdir) or sha256, and
+// returned as a targz archive.
+
+// Content holds module state
+type Content struct {
+	Db  func() *mgo.Database
+	Cfg *config.Config
+}
+
+var content Content
+
+// Auth holds credentials for fetching remote content, resolved from the job's
+// content_auth secret refs.
+type Auth struct {
+	Username string
+	Password string
+	Token    string
+}
+
+// Init sets the db of the content store and config for fetching content
+func Init(db func() *mgo.Database, cfg *config.Config) {
+	content.Db = db
+	content.Cfg = cfg
+}
+
+// IsRemote returns true if the job content is a remote source to be fetched,
+// rather than inline.
+func IsRemote(spec string) bool {
+	return strings.HasPrefix(spec, "git+https://") ||
+		strings.HasPrefix(spec, "https://") ||
+		strings.HasPrefix(spec, "http://")
+}
+
+// Fetch returns the archive format and data of remote content, from the cache
+// if present.
+func Fetch(spec string, auth *Auth) (string, []byte, error) {
+	if auth == nil {
+		auth = &Auth{}
+	}
+	switch {
+	case strings.HasPrefix(spec, "git+"):
+		data, err := fetchGit(strings.TrimPrefix(spec, "git+"), auth)
+		return "targz", data, err
+	case IsRemote(spec):
+		return fetchURL(spec, auth)
+	default:
+		return "", nil, fmt.Errorf("Unsupported content source: %s", spec)
+	}
+}
+
+func fetchTimeout() time.Duration {
+	return content.Cfg.ContentFetchTimeout.D()
+}
@@ -0,0 +1,297 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package content
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Repositories are fetched with the git command (2.31 or later, for
+// credentials passed in the environment), shallow at the single commit needed.
+
+var commitRe = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// parseGit splits https://host/repo.git#ref[:subdir] into its parts
+func parseGit(spec string) (repo, ref, subdir string, err error) {
+	repo = spec
+	if h := strings.Index(spec, "#"); h >= 0 {
+		repo = spec[:h]
+		ref = spec[h+1:]
+	}
+	// ":" may not appear in git ref names
+	if c := strings.Index(ref, ":"); c >= 0 {
+		subdir = ref[c+1:]
+		ref = ref[:c]
+	}
+	if ref == "" {
+		ref = "HEAD"
+	}
+	if strings.HasPrefix(ref, "-") {
+		return "", "", "", fmt.Errorf("Invalid git ref in content: %s", ref)
+	}
+	if subdir != "" {
+		subdir = path.Clean(subdir)
+		if path.IsAbs(subdir) || subdir == ".." || strings.HasPrefix(subdir, "../") {
+			return "", "", "", fmt.Errorf("Content git subdir must be within the repository: %s", subdir)
+		}
+	}
+	return repo, ref, subdir, nil
+}
+
+// gitEnv returns the environment for git commands, never prompting and with
+// any credentials as an http header (kept off the command line).
+func gitEnv(auth *Auth) []string {
+	env := append(os.Environ(),
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_ALLOW_PROTOCOL=https",
+	)
+	if auth.Token != "" || auth.Password != "" {
+		user := auth.Username
+		if user == "" {
+			user = "git"
+		}
+		pw := auth.Password
+		if auth.Token != "" {
+			pw = auth.Token
+		}
+		basic := base64.StdEncoding.EncodeToString([]byte(user + ":" + pw))
+		env = append(env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+basic,
+		)
+	}
+	return env
+}
+
+func git(ctx context.Context, env []string, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = env
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Failed git %s: %s: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// lsRemote resolves a ref to its commit, preferring tags to branches as git
+// does, and the commit of annotated tags.
+func lsRemote(ctx context.Context, env []string, repo, ref string) (string, error) {
+	out, err := git(ctx, env, "", "ls-remote", "--", repo, ref)
+	if err != nil {
+		return "", err
+	}
+	refs := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) == 2 {
+			refs[f[1]] = f[0]
+		}
+	}
+	for _, name := range []string{
+		ref + "^{}",
+		ref,
+		"refs/tags/" + ref + "^{}",
+		"refs/tags/" + ref,
+		"refs/heads/" + ref,
+	} {
+		if commit, ok := refs[name]; ok {
+			return commit, nil
+		}
+	}
+	return "", fmt.Errorf("Content git ref %s not found in %s", ref, repo)
+}
+
+// gitCacheKey identifies a commit (and subdir) of a repository, the same
+// commit id fetched from another repository is cached separately.
+func gitCacheKey(repo, commit, subdir string) string {
+	h := sha256.Sum256([]byte(repo + "#" + commit + ":" + subdir))
+	return "git-" + commit + "-" + hex.EncodeToString(h[:8])
+}
+
+// checkTreeSize fails if the files of a fetched commit total more than
+// content_max_size, before they are checked out.
+func checkTreeSize(ctx context.Context, env []string, dir, commit string) error {
+	out, err := git(ctx, env, dir, "ls-tree", "-r", "-l", "-z", commit)
+	if err != nil {
+		return err
+	}
+	var total int64
+	limit := int64(content.Cfg.ContentMaxSize)
+	for _, entry := range strings.Split(out, "\x00") {
+		// <mode> SP <type> SP <object> SP+ <size> TAB <path>
+		f := strings.Fields(strings.SplitN(entry, "\t", 2)[0])
+		if len(f) != 4 || f[1] != "blob" {
+			continue
+		}
+		n, err := strconv.ParseInt(f[3], 10, 64)
+		if err != nil {
+			return fmt.Errorf("Failed to parse git tree entry size: %s", err)
+		}
+		if total += n; total > limit {
+			return fmt.Errorf("Content git commit %s is larger than content_max_size (%d bytes)", commit, limit)
+		}
+	}
+	return nil
+}
+
+// fetchGit returns the content of a git repository (or subdir of it) at a
+// ref, as a targz. The repository is always asked to resolve the ref (or list
+// HEAD, for a commit id) with the job's credentials, so the cache only serves
+// those who can still read the repository.
+func fetchGit(spec string, auth *Auth) ([]byte, error) {
+	repo, ref, subdir, err := parseGit(spec)
+	if err != nil {
+		return nil, err
+	}
+	env := gitEnv(auth)
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout())
+	defer cancel()
+
+	commit := ref
+	if commitRe.MatchString(ref) {
+		_, err = lsRemote(ctx, env, repo, "HEAD")
+	} else {
+		commit, err = lsRemote(ctx, env, repo, ref)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data := cacheGet(gitCacheKey(repo, commit, subdir)); data != nil {
+		return data, nil
+	}
+
+	dir, err := ioutil.TempDir("", "gostint-git-")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create dir for git content: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err = git(ctx, env, dir, "init", "-q"); err != nil {
+		return nil, err
+	}
+	if _, err = git(ctx, env, dir, "fetch", "-q", "--depth", "1", "--", repo, ref); err != nil {
+		return nil, err
+	}
+	// the ref may have moved since it was resolved, cache what was fetched
+	if commit, err = git(ctx, env, dir, "rev-parse", "FETCH_HEAD^{commit}"); err != nil {
+		return nil, err
+	}
+	if err = checkTreeSize(ctx, env, dir, commit); err != nil {
+		return nil, err
+	}
+	if _, err = git(ctx, env, dir, "-c", "advice.detachedHead=false", "checkout", "-q", commit); err != nil {
+		return nil, err
+	}
+
+	root := filepath.Join(dir, filepath.FromSlash(subdir))
+	if fi, err2 := os.Lstat(root); err2 != nil || !fi.IsDir() {
+		return nil, fmt.Errorf("Content git subdir %s not found in %s at %s", subdir, repo, commit)
+	}
+	data, err := tarGz(root)
+	if err != nil {
+		return nil, fmt.Errorf("Failed archiving git content: %s", err)
+	}
+	cachePut(gitCacheKey(repo, commit, subdir), data)
+	return data, nil
+}
+
+// tarGz archives the tree under root (excluding .git) with ./ relative names,
+// as content is expected to be.
+func tarGz(root string) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		if fi.Name() == ".git" {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = "./" + filepath.ToSlash(rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uid, hdr.Gid = 0, 0
+		hdr.Uname, hdr.Gname = "", ""
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	if err = gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package content
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var sha256Re = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// archiveFormats maps url path suffixes to content archive formats
+var archiveFormats = map[string]string{
+	".tar.gz":  "targz",
+	".tgz":     "targz",
+	".tar":     "tar",
+	".tar.zst": "tarzst",
+	".tzst":    "tarzst",
+	".zip":     "zip",
+}
+
+func urlFormat(p string) (string, error) {
+	for suffix, format := range archiveFormats {
+		if strings.HasSuffix(p, suffix) {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("Failed to determine the archive format of content url path %s", p)
+}
+
+// fetchURL downloads an archive, verifying it against the sha256 given in the
+// url's fragment.
+func fetchURL(spec string, auth *Auth) (string, []byte, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to parse content url: %s", err)
+	}
+	frag := u.Fragment
+	u.Fragment = ""
+	u.User = nil // any credentials come from content_auth
+
+	if !strings.HasPrefix(frag, "sha256=") {
+		return "", nil, fmt.Errorf("Content url %s must give the archive's sha256 (#sha256=<hex>)", u)
+	}
+	sum := strings.ToLower(strings.TrimPrefix(frag, "sha256="))
+	if !sha256Re.MatchString(sum) {
+		return "", nil, fmt.Errorf("Content url %s has an invalid sha256", u)
+	}
+	format, err := urlFormat(u.Path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	key := "sha256-" + sum
+	if data := cacheGet(key); data != nil && checkSum(data, sum) == nil {
+		return format, data, nil
+	}
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to create request for content %s: %s", u, err)
+	}
+	if auth.Token != "" || auth.Password != "" {
+		if u.Scheme != "https" {
+			return "", nil, fmt.Errorf("Content credentials are only sent over https: %s", u)
+		}
+		if auth.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+auth.Token)
+		} else {
+			req.SetBasicAuth(auth.Username, auth.Password)
+		}
+	}
+
+	client := &http.Client{Timeout: fetchTimeout()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to fetch content %s: %s", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("Failed to fetch content %s: %s", u, resp.Status)
+	}
+	limit := int64(content.Cfg.ContentMaxSize)
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed reading content %s: %s", u, err)
+	}
+	if int64(len(data)) > limit {
+		return "", nil, fmt.Errorf("Content %s is larger than content_max_size (%d bytes)", u, limit)
+	}
+	if err = checkSum(data, sum); err != nil {
+		return "", nil, fmt.Errorf("Content %s failed verification: %s", u, err)
+	}
+	cachePut(key, data)
+	return format, data, nil
+}
+
+func checkSum(data []byte, sum string) error {
+	h := sha256.Sum256(data)
+	if got := hex.EncodeToString(h[:]); got != sum {
+		return fmt.Errorf("sha256 is %s, expected %s", got, sum)
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package content
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/gbevan/gostint/logmsg"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// Uploaded content is stored content addressed by the sha256 of the uploaded
+// data, its archive in GridFS ("content.files" and "content.chunks") and a
+// Blob document in the "content" collection recording the jobs referencing it.
+// Jobs refer to it as content "ref,sha256:<hex>". Blobs no longer referenced
+// by any job are removed by GC, once content_upload_grace has passed since
+// they were (last) uploaded. Unencrypted content may only be used by the
+// identities that uploaded it, as its ref alone does not prove possession.
+
+// RefPrefix prefixes the sha256 of stored content in a job's content ref
+const RefPrefix = "sha256:"
+
+// Formats of content archives, see Normalise
+var Formats = map[string]bool{
+	"targz":  true,
+	"tar":    true,
+	"tarzst": true,
+	"zip":    true,
+}
+
+// Blob describes an uploaded content archive
+type Blob struct {
+	ID        string          `json:"sha256"    bson:"_id"`
+	Format    string          `json:"format"    bson:"format"`
+	Encrypted bool            `json:"encrypted" bson:"encrypted" description:"Data is vault transit ciphertext of the base64 archive"`
+	Size      int             `json:"size"      bson:"size"`
+	Uploaded  time.Time       `json:"uploaded"  bson:"uploaded"`
+	Refs      []bson.ObjectId `json:"refs,omitempty"      bson:"refs" description:"Jobs referencing the content"`
+	Uploaders []string        `json:"uploaders,omitempty" bson:"uploaders" description:"Identities that uploaded the content, see authenticate.Identity"`
+}
+
+// UsableBy reports whether a job submitted by identity may use the content,
+// encrypted content is usable by any (only gostint's AppRole can decrypt it),
+// unencrypted content only by those that uploaded it.
+func (blob *Blob) UsableBy(identity string) bool {
+	if blob.Encrypted {
+		return true
+	}
+	for _, u := range blob.Uploaders {
+		if identity != "" && u == identity {
+			return true
+		}
+	}
+	return false
+}
+
+func blobs() *mgo.Collection {
+	return content.Db().C("content")
+}
+
+func gridFS() *mgo.GridFS {
+	return content.Db().GridFS("content")
+}
+
+// Store saves content uploaded by identity, returning its blob and true if the
+// same data was already stored (identity is then added to its uploaders).
+func Store(format string, encrypted bool, identity string, data []byte) (*Blob, bool, error) {
+	if !Formats[format] {
+		return nil, false, fmt.Errorf("Unsupported content archive format: %s", format)
+	}
+	h := sha256.Sum256(data)
+	blob := Blob{
+		ID:        hex.EncodeToString(h[:]),
+		Format:    format,
+		Encrypted: encrypted,
+		Size:      len(data),
+		Uploaded:  time.Now(),
+		Refs:      []bson.ObjectId{},
+		Uploaders: []string{identity},
+	}
+
+	// an upload of existing content restarts its grace period
+	err := blobs().UpdateId(blob.ID, bson.M{
+		"$set":      bson.M{"uploaded": blob.Uploaded},
+		"$addToSet": bson.M{"uploaders": identity},
+	})
+	if err == nil {
+		existing, err2 := GetBlob(blob.ID)
+		return existing, true, err2
+	}
+	if err != mgo.ErrNotFound {
+		return nil, false, fmt.Errorf("Failed to update content %s: %s", blob.ID, err)
+	}
+
+	// write the data before the blob document, so a blob always has its data
+	f, err := gridFS().Create(blob.ID)
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed to create content %s: %s", blob.ID, err)
+	}
+	f.SetId(blob.ID)
+	_, err = f.Write(data)
+	if errC := f.Close(); err == nil {
+		err = errC
+	}
+	if err != nil && !mgo.IsDup(err) {
+		return nil, false, fmt.Errorf("Failed to store content %s: %s", blob.ID, err)
+	}
+	if err = blobs().Insert(blob); err != nil {
+		if mgo.IsDup(err) {
+			// uploaded concurrently
+			err = blobs().UpdateId(blob.ID, bson.M{"$addToSet": bson.M{"uploaders": identity}})
+			if err != nil {
+				return nil, false, fmt.Errorf("Failed to update content %s: %s", blob.ID, err)
+			}
+			existing, err2 := GetBlob(blob.ID)
+			return existing, true, err2
+		}
+		return nil, false, fmt.Errorf("Failed to store content %s: %s", blob.ID, err)
+	}
+	return &blob, false, nil
+}
+
+// GetBlob returns the description of stored content
+func GetBlob(sum string) (*Blob, error) {
+	var blob Blob
+	err := blobs().FindId(sum).One(&blob)
+	if err == mgo.ErrNotFound {
+		return nil, fmt.Errorf("Content ref %s%s not found", RefPrefix, sum)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get content %s%s: %s", RefPrefix, sum, err)
+	}
+	return &blob, nil
+}
+
+// Ref records that a job references stored content, so it is kept until the
+// job is removed.
+func Ref(sum string, jobID bson.ObjectId) error {
+	err := blobs().UpdateId(sum, bson.M{"$addToSet": bson.M{"refs": jobID}})
+	if err == mgo.ErrNotFound {
+		return fmt.Errorf("Content ref %s%s not found", RefPrefix, sum)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to reference content %s%s: %s", RefPrefix, sum, err)
+	}
+	return nil
+}
+
+// Load returns stored content and its description, verifying the content
+// against its sha256
+func Load(sum string) (*Blob, []byte, error) {
+	blob, err := GetBlob(sum)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := gridFS().OpenId(sum)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to open content %s%s: %s", RefPrefix, sum, err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to read content %s%s: %s", RefPrefix, sum, err)
+	}
+	if err = checkSum(data, sum); err != nil {
+		return nil, nil, fmt.Errorf("Content %s%s failed verification: %s", RefPrefix, sum, err)
+	}
+	return blob, data, nil
+}
+
+// GC drops references from jobs that no longer exist and removes content
+// without references uploaded more than content_upload_grace ago.
+func GC() error {
+	queues := content.Db().C("queues")
+	cutoff := time.Now().Add(-content.Cfg.ContentUploadGrace.D())
+
+	var blob Blob
+	iter := blobs().Find(nil).Select(bson.M{"refs": 1, "uploaded": 1}).Iter()
+	for iter.Next(&blob) {
+		if len(blob.Refs) > 0 {
+			var live []struct {
+				ID bson.ObjectId `bson:"_id"`
+			}
+			err := queues.Find(bson.M{"_id": bson.M{"$in": blob.Refs}}).Select(bson.M{"_id": 1}).All(&live)
+			if err != nil {
+				iter.Close()
+				return fmt.Errorf("Failed to query jobs referencing content: %s", err)
+			}
+			if len(live) < len(blob.Refs) {
+				gone := []bson.ObjectId{}
+				isLive := map[bson.ObjectId]bool{}
+				for _, j := range live {
+					isLive[j.ID] = true
+				}
+				for _, id := range blob.Refs {
+					if !isLive[id] {
+						gone = append(gone, id)
+					}
+				}
+				err = blobs().UpdateId(blob.ID, bson.M{"$pullAll": bson.M{"refs": gone}})
+				if err != nil && err != mgo.ErrNotFound {
+					logmsg.Error("Failed to drop references to content %s: %s", blob.ID, err)
+				}
+			}
+		}
+		blob = Blob{}
+	}
+	if err := iter.Close(); err != nil {
+		return fmt.Errorf("Failed to query content for gc: %s", err)
+	}
+
+	// conditional on the blob still being unreferenced, in case a job was
+	// submitted since the scan above
+	var unused []Blob
+	err := blobs().Find(bson.M{
+		"refs":     bson.M{"$size": 0},
+		"uploaded": bson.M{"$lt": cutoff},
+	}).Select(bson.M{"_id": 1}).All(&unused)
+	if err != nil {
+		return fmt.Errorf("Failed to query unreferenced content: %s", err)
+	}
+	removed := 0
+	for _, b := range unused {
+		err = blobs().Remove(bson.M{
+			"_id":      b.ID,
+			"refs":     bson.M{"$size": 0},
+			"uploaded": bson.M{"$lt": cutoff},
+		})
+		if err == mgo.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			logmsg.Error("Failed to remove content %s: %s", b.ID, err)
+			continue
+		}
+		if err = gridFS().RemoveId(b.ID); err != nil {
+			logmsg.Error("Failed to remove content data %s: %s", b.ID, err)
+		}
+		removed++
+	}
+	if removed > 0 {
+		logmsg.Info("Content gc removed %d unreferenced uploads", removed)
+	}
+	return nil
+}
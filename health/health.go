@@ -24,8 +24,10 @@ import (
 	"strconv"
 
 	"github.com/gbevan/gostint/jobqueues"
+	"github.com/gbevan/gostint/leader"
 	"github.com/gbevan/gostint/logmsg"
 	"github.com/gbevan/gostint/state"
+	"github.com/gbevan/gostint/vaultsession"
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	. "github.com/visionmedia/go-debug" // nolint
@@ -35,7 +37,7 @@ var debug = Debug("health")
 
 // Health holds props
 type Health struct {
-	db *mgo.Database
+	db func() *mgo.Database
 }
 
 var (
@@ -44,18 +46,39 @@ var (
 )
 
 // Init the health module
-func Init(db *mgo.Database) {
+func Init(db func() *mgo.Database) {
 	health = Health{
 		db: db,
 	}
 }
 
+// leaderHealth adds whether this node is the leader, and the leader's node
+// uuid, to m. If the leader lock cannot be read both are unknown, with the
+// error, which does not fail the node's own health.
+func leaderHealth(m map[string]string) {
+	leaderNode, err := leader.Holder()
+	if err != nil {
+		logmsg.Warn("Failed to read the leader lock for health: %s", err)
+		m["leader"] = "unknown"
+		m["leader_node"] = "unknown"
+		m["leader_error"] = err.Error()
+		return
+	}
+	m["leader"] = strconv.FormatBool(leader.IsLeader())
+	m["leader_node"] = leaderNode
+}
+
 // GetHealthV1 Returns the gostint health status for api v1
 func GetHealthV1() (*map[string]string, error) {
 	m := make(map[string]string)
 	m["state"] = state.GetState()
+	leaderHealth(m)
+
+	for k, v := range vaultsession.Health() {
+		m[k] = v
+	}
 
-	db := health.db
+	db := health.db()
 	c := db.C("queues")
 
 	num, err := c.Count()
@@ -0,0 +1,89 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package health
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gbevan/gostint/config"
+	"github.com/gbevan/gostint/leader"
+	"github.com/gbevan/gostint/mongotest"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// useLeader starts leader election on a fake db server, on which the leader
+// lock is held by node-2 or, if failLock, cannot be read.
+func useLeader(t *testing.T, failLock bool) {
+	t.Helper()
+	srv := mongotest.NewServer(func(req *mongotest.Request) []bson.M {
+		switch req.Command {
+		case "":
+			if failLock {
+				return []bson.M{mongotest.Failed("not authorized on gostint")}
+			}
+			return []bson.M{{"_id": "leader", "holder": "node-2", "expires": time.Now().Add(time.Minute)}}
+		case "update":
+			return []bson.M{mongotest.Written(0)}
+		case "insert":
+			return []bson.M{mongotest.Duplicate()}
+		}
+		return nil
+	})
+	t.Cleanup(srv.Close)
+	session, err := srv.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(session.Close)
+	leader.Init(func() *mgo.Database { return session.DB("gostint") }, &config.Config{LeaderTTL: config.Duration(time.Hour)}, "node-1")
+	t.Cleanup(func() { leader.Resign() })
+}
+
+func TestLeaderHealth(t *testing.T) {
+	tests := []struct {
+		name     string
+		failLock bool
+		want     map[string]string
+	}{
+		{"lock held", false, map[string]string{"leader": "false", "leader_node": "node-2"}},
+		{"lock unreadable", true, map[string]string{
+			"leader":       "unknown",
+			"leader_node":  "unknown",
+			"leader_error": "not authorized on gostint",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLeader(t, tt.failLock)
+			m := map[string]string{}
+			leaderHealth(m)
+			if len(m) != len(tt.want) {
+				t.Errorf("leaderHealth() = %v, want %v", m, tt.want)
+			}
+			for k, v := range tt.want {
+				if m[k] != v {
+					t.Errorf("leaderHealth()[%q] = %q, want %q", k, m[k], v)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imagepolicy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	sigAnnotation   = "dev.cosignproject.cosign/signature"
+	sigType         = "cosign container image signature"
+	maxManifestSize = 4 * 1024 * 1024
+	maxPayloadSize  = 1024 * 1024
+)
+
+var manifestTypes = []string{
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+type sigManifest struct {
+	Layers []struct {
+		Digest      string            `json:"digest"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"layers"`
+}
+
+// simpleSigning is the signed payload
+type simpleSigning struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// verifySignature checks the repository holds a signature of the digest by
+// one of the keys
+func verifySignature(ctx context.Context, c *registryClient, digest string, keys []crypto.PublicKey) error {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return &Denied{fmt.Sprintf("Image digest %s is not sha256, so cannot be verified", digest)}
+	}
+	tag := strings.Replace(digest, ":", "-", 1) + ".sig"
+	data, err := c.get(ctx, "/manifests/"+tag, manifestTypes, maxManifestSize)
+	if err == errNotFound {
+		return &Denied{fmt.Sprintf("Image %s@%s has no signature", c.repo, digest)}
+	}
+	if err != nil {
+		return fmt.Errorf("Failed reading signatures of image %s@%s: %s", c.repo, digest, err)
+	}
+	m := sigManifest{}
+	if err = json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("Failed decoding signatures of image %s@%s: %s", c.repo, digest, err)
+	}
+
+	for _, l := range m.Layers {
+		sig, err := base64.StdEncoding.DecodeString(l.Annotations[sigAnnotation])
+		if err != nil || len(sig) == 0 {
+			continue
+		}
+		payload, err := c.get(ctx, "/blobs/"+l.Digest, nil, maxPayloadSize)
+		if err != nil {
+			return fmt.Errorf("Failed reading signature of image %s@%s: %s", c.repo, digest, err)
+		}
+		if fmt.Sprintf("sha256:%x", sha256.Sum256(payload)) != l.Digest {
+			continue
+		}
+		ss := simpleSigning{}
+		if json.Unmarshal(payload, &ss) != nil ||
+			ss.Critical.Type != sigType ||
+			ss.Critical.Image.DockerManifestDigest != digest {
+			continue
+		}
+		for _, key := range keys {
+			if verify(key, payload, sig) {
+				return nil
+			}
+		}
+	}
+	return &Denied{fmt.Sprintf("Image %s@%s has no valid signature by the queue's signature keys", c.repo, digest)}
+}
+
+// verify checks the signature of the payload by the key
+func verify(key crypto.PublicKey, payload, sig []byte) bool {
+	sum := sha256.Sum256(payload)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, sum[:], sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, payload, sig)
+	}
+	return false
+}
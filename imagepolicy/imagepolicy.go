@@ -0,0 +1,88 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imagepolicy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/gbevan/gostint/config"
+)
+
+// Enforces a queue's image policy on the images of its jobs: the allowed
+// repositories, referencing images by digest and cosign signatures. Cosign
+// stores an image's signatures in its repository, as the layers of an image
+// tagged sha256-<hex of the image's digest>.sig, each a "simple signing"
+// payload naming the image's digest with its signature in an annotation.
+// Verification only needs the image's registry (which may be a local
+// stand-in) and the public keys, not a transparency log.
+
+// fetchTimeout bounds reading an image's signatures from its registry
+const fetchTimeout = time.Minute
+
+// Denied is the reason an image is rejected by the policy
+type Denied struct {
+	Reason string
+}
+
+func (d *Denied) Error() string {
+	return d.Reason
+}
+
+// Registry is how to read an image's signatures from its registry
+type Registry struct {
+	Host     string // as in image names, docker.io for Docker Hub
+	Insecure bool   // over plain http
+	Username string
+	Password string
+	Token    string // a bearer token
+}
+
+// Check checks the image against the policy's allowed repositories and its
+// requirement for a digest, before it is pulled
+func Check(p *config.ImagePolicy, named reference.Named) error {
+	if !p.Allows(named.Name()) {
+		return &Denied{fmt.Sprintf("Image repository %s is not allowed for jobs on this queue", named.Name())}
+	}
+	if _, ok := named.(reference.Canonical); p.RequireDigest && !ok {
+		return &Denied{fmt.Sprintf("Image %s must be referenced by its @sha256 digest on this queue", reference.FamiliarString(named))}
+	}
+	return nil
+}
+
+// Verify checks the image's digest has a signature by one of the policy's
+// keys, if it has any
+func Verify(p *config.ImagePolicy, named reference.Named, digest string, reg Registry) error {
+	keys := p.Keys()
+	if len(keys) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+	c := &registryClient{
+		reg:  reg,
+		repo: reference.Path(named),
+		http: &http.Client{},
+	}
+	return verifySignature(ctx, c, digest, keys)
+}
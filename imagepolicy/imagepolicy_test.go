@@ -0,0 +1,234 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imagepolicy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/gbevan/gostint/config"
+)
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy config.ImagePolicy
+		image  string
+		want   string // error substring, "" for none
+	}{
+		{"any allowed", config.ImagePolicy{}, "alpine", ""},
+		{"exact", config.ImagePolicy{Allowed: []string{"docker.io/library/alpine"}}, "alpine:3.9", ""},
+		{"glob", config.ImagePolicy{Allowed: []string{"registry.example.com/team/*"}}, "registry.example.com/team/app", ""},
+		{"glob one level", config.ImagePolicy{Allowed: []string{"registry.example.com/team/*"}}, "registry.example.com/team/sub/app", "is not allowed"},
+		{"any depth", config.ImagePolicy{Allowed: []string{"registry.example.com/team/**"}}, "registry.example.com/team/sub/app", ""},
+		{"other registry", config.ImagePolicy{Allowed: []string{"registry.example.com/team/**"}}, "registry.example.org/team/app", "is not allowed"},
+		{"prefix is not a match", config.ImagePolicy{Allowed: []string{"docker.io/library/alpine"}}, "alpine2", "is not allowed"},
+		{"digest required", config.ImagePolicy{RequireDigest: true}, "alpine:3.9", "must be referenced by its @sha256 digest"},
+		{"digest given", config.ImagePolicy{RequireDigest: true}, "alpine@" + testDigest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			named, err := reference.ParseNormalizedNamed(tt.image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = Check(&tt.policy, named)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("Check() error = %v", err)
+				}
+				return
+			}
+			if _, ok := err.(*Denied); !ok || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Check() error = %v, want Denied containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyWithoutKeys(t *testing.T) {
+	named, _ := reference.ParseNormalizedNamed("alpine")
+	// no keys, so the (unreachable) registry must not be read
+	if err := Verify(&config.ImagePolicy{}, named, testDigest, Registry{Host: "127.0.0.1:1"}); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+}
+
+// testRegistry serves a repository's blobs and manifests by path, requiring a
+// bearer token from its token service if auth is set
+type testRegistry struct {
+	repo  string
+	files map[string][]byte
+	auth  bool
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		fmt.Fprint(w, `{"token": "pull-token"}`)
+		return
+	}
+	if r.auth && req.Header.Get("Authorization") != "Bearer pull-token" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="test"`, req.Host))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	data, ok := r.files[strings.TrimPrefix(req.URL.Path, "/v2/"+r.repo)]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	w.Write(data)
+}
+
+// sign adds a signature layer of the payload, made by the key, to the
+// registry's signature manifest of the digest
+func (r *testRegistry) sign(t *testing.T, digest string, payload []byte, key *ecdsa.PrivateKey) {
+	t.Helper()
+	sum := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.addLayer(t, digest, payload, sig)
+}
+
+func (r *testRegistry) addLayer(t *testing.T, digest string, payload, sig []byte) {
+	t.Helper()
+	layer := fmt.Sprintf("sha256:%x", sha256.Sum256(payload))
+	r.files["/blobs/"+layer] = payload
+
+	tag := "/manifests/" + strings.Replace(digest, ":", "-", 1) + ".sig"
+	m := map[string]interface{}{}
+	layers := []interface{}{}
+	if data, ok := r.files[tag]; ok {
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Fatal(err)
+		}
+		layers = m["layers"].([]interface{})
+	}
+	m["layers"] = append(layers, map[string]interface{}{
+		"mediaType":   "application/vnd.dev.cosign.simplesigning.v1+json",
+		"digest":      layer,
+		"annotations": map[string]string{sigAnnotation: base64.StdEncoding.EncodeToString(sig)},
+	})
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.files[tag] = data
+}
+
+func simpleSigningPayload(digest string) []byte {
+	return []byte(fmt.Sprintf(
+		`{"critical":{"identity":{"docker-reference":"team/app"},"image":{"docker-manifest-digest":"%s"},"type":"%s"},"optional":null}`,
+		digest, sigType,
+	))
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestVerifySignature(t *testing.T) {
+	key := newKey(t)
+	other := newKey(t)
+	const otherDigest = "sha256:fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"
+
+	tests := []struct {
+		name   string
+		digest string
+		auth   bool
+		setup  func(t *testing.T, r *testRegistry)
+		want   string // Denied substring, "" for verified
+	}{
+		{"signed", testDigest, false, func(t *testing.T, r *testRegistry) {
+			r.sign(t, testDigest, simpleSigningPayload(testDigest), key)
+		}, ""},
+		{"signed behind token auth", testDigest, true, func(t *testing.T, r *testRegistry) {
+			r.sign(t, testDigest, simpleSigningPayload(testDigest), key)
+		}, ""},
+		{"one of several signatures", testDigest, false, func(t *testing.T, r *testRegistry) {
+			r.sign(t, testDigest, simpleSigningPayload(testDigest), other)
+			r.sign(t, testDigest, simpleSigningPayload(testDigest), key)
+		}, ""},
+		{"no signature", testDigest, false, func(t *testing.T, r *testRegistry) {}, "has no signature"},
+		{"signed by another key", testDigest, false, func(t *testing.T, r *testRegistry) {
+			r.sign(t, testDigest, simpleSigningPayload(testDigest), other)
+		}, "has no valid signature"},
+		{"tampered payload", testDigest, false, func(t *testing.T, r *testRegistry) {
+			payload := simpleSigningPayload(testDigest)
+			sum := sha256.Sum256(payload)
+			sig, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			tampered := []byte(strings.Replace(string(payload), "team/app", "team/evil", 1))
+			r.addLayer(t, testDigest, tampered, sig)
+		}, "has no valid signature"},
+		{"signature of another image", testDigest, false, func(t *testing.T, r *testRegistry) {
+			// the other image's signature copied under this image's tag
+			r.sign(t, testDigest, simpleSigningPayload(otherDigest), key)
+		}, "has no valid signature"},
+		{"not sha256", "sha512:0123", false, func(t *testing.T, r *testRegistry) {}, "is not sha256"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &testRegistry{repo: "team/app", files: map[string][]byte{}, auth: tt.auth}
+			tt.setup(t, r)
+			srv := httptest.NewServer(r)
+			defer srv.Close()
+
+			c := &registryClient{
+				reg:  Registry{Host: strings.TrimPrefix(srv.URL, "http://"), Insecure: true},
+				repo: "team/app",
+				http: srv.Client(),
+			}
+			err := verifySignature(context.Background(), c, tt.digest, []crypto.PublicKey{&key.PublicKey})
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("verifySignature() error = %v", err)
+				}
+				return
+			}
+			if _, ok := err.(*Denied); !ok || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("verifySignature() error = %v, want Denied containing %q", err, tt.want)
+			}
+		})
+	}
+}
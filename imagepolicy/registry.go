@@ -0,0 +1,167 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imagepolicy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	errNotFound = errors.New("not found")
+	challengeRe = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+// registryClient reads from a repository with the docker registry v2 api
+type registryClient struct {
+	reg   Registry
+	repo  string
+	http  *http.Client
+	token string // from the registry's token service
+}
+
+func (c *registryClient) url(p string) string {
+	scheme := "https"
+	if c.reg.Insecure {
+		scheme = "http"
+	}
+	host := c.reg.Host
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s%s", scheme, host, c.repo, p)
+}
+
+// get reads up to max bytes from the path under the repository,
+// authenticating with the registry's token service if challenged
+func (c *registryClient) get(ctx context.Context, p string, accept []string, max int64) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest("GET", c.url(p), nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		if len(accept) > 0 {
+			req.Header.Set("Accept", strings.Join(accept, ", "))
+		}
+		switch {
+		case c.token != "":
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		case c.reg.Token != "":
+			req.Header.Set("Authorization", "Bearer "+c.reg.Token)
+		case c.reg.Username != "":
+			req.SetBasicAuth(c.reg.Username, c.reg.Password)
+		}
+
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading %s: %s", req.URL, err)
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 && c.token == "" {
+			challenge := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+			if err = c.authenticate(ctx, challenge); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, errNotFound
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Failed reading %s: %s", req.URL, resp.Status)
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(resp.Body, max+1))
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading %s: %s", req.URL, err)
+		}
+		if int64(len(data)) > max {
+			return nil, fmt.Errorf("Failed reading %s: larger than %d bytes", req.URL, max)
+		}
+		return data, nil
+	}
+}
+
+// authenticate gets a pull token for the repository from the token service
+// named in the registry's Bearer challenge
+func (c *registryClient) authenticate(ctx context.Context, challenge string) error {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return fmt.Errorf("Unsupported registry auth challenge: '%s'", challenge)
+	}
+	params := map[string]string{}
+	for _, m := range challengeRe.FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+	u, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("Invalid realm in registry auth challenge: '%s'", challenge)
+	}
+	q := u.Query()
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull", c.repo)
+	}
+	q.Set("scope", scope)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if c.reg.Username != "" {
+		req.SetBasicAuth(c.reg.Username, c.reg.Password)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed getting registry token: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed getting registry token: %s", resp.Status)
+	}
+	tok := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(&tok); err != nil {
+		return fmt.Errorf("Failed decoding registry token: %s", err)
+	}
+	c.token = tok.Token
+	if c.token == "" {
+		c.token = tok.AccessToken
+	}
+	if c.token == "" {
+		return errors.New("Registry token service returned no token")
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package jobqueues
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gbevan/gostint/meta"
+	"github.com/gbevan/gostint/secretrefs"
+	"github.com/globalsign/mgo/bson"
+)
+
+// DryRun is the result of preparing a job request to run, up to but not
+// including starting its container, without queuing it.
+type DryRun struct {
+	Valid      bool              `json:"valid"`
+	Status     string            `json:"status" description:"Status the job would have ended with, if not valid"`
+	Errors     []string          `json:"errors"`
+	Job        *meta.Meta        `json:"job"`
+	Sources    map[string]string `json:"sources" description:"Layer each field was taken from"`
+	ImageID    string            `json:"image_id"`
+	Network    *JobNetwork       `json:"network"`
+	SecretRefs []SecretRefCheck  `json:"secret_refs"`
+	Audit      []string          `json:"audit"`
+}
+
+// SecretRefCheck reports whether a secret ref could be read and the vars it
+// would inject, never their values.
+type SecretRefCheck struct {
+	Ref   string   `json:"ref"`
+	Vars  []string `json:"vars"`
+	Error string   `json:"error,omitempty"`
+}
+
+// DryRun runs the job request on this node as far as creating its container,
+// which is removed without being started. Nothing is recorded in the queues,
+// the job's token is revoked and any dynamic secret leases are released as
+// they would be after a run. The job is not tracked as running on the node.
+// If ctx is done first (e.g. the image is slow to pull) the dry run is
+// reported as not completed, and finishes cleaning up in the background.
+func (job *Job) DryRun(ctx context.Context) *DryRun {
+	dr := &DryRun{
+		Errors:     []string{},
+		SecretRefs: []SecretRefCheck{},
+		Audit:      []string{},
+	}
+	job.dryRun = dr
+	if job.ID == "" {
+		job.ID = bson.NewObjectId()
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		job.runRequest()
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return &DryRun{
+			Status:     "failed",
+			Errors:     []string{fmt.Sprintf("Dry run did not complete: %s", ctx.Err())},
+			SecretRefs: []SecretRefCheck{},
+			Audit:      []string{},
+		}
+	}
+
+	dr.Valid = len(dr.Errors) == 0
+	if dr.Job != nil {
+		// as resolved for the job's queue
+		dr.Job.Timeout = job.Timeout
+		dr.Job.VaultPolicies = job.VaultPolicies
+		dr.Job.Limits = job.Limits
+	}
+	dr.Network = job.Network
+	return dr
+}
+
+// update records what the dry run would have written to the job
+func (dr *DryRun) update(u bson.M) {
+	status, ok := u["status"].(string)
+	if !ok {
+		return
+	}
+	dr.Status = status
+	if output, ok := u["output"].(string); ok && output != "" {
+		dr.Errors = append(dr.Errors, output)
+	}
+}
+
+// checked records the outcome of resolving a secret ref
+func (dr *DryRun) checked(ref string, injs []secretrefs.Injection, err error) {
+	if dr == nil {
+		return
+	}
+	chk := SecretRefCheck{
+		Ref:  ref,
+		Vars: []string{},
+	}
+	if err != nil {
+		chk.Error = err.Error()
+		dr.Status = "failed"
+		dr.Errors = append(dr.Errors, err.Error())
+	}
+	for _, inj := range injs {
+		chk.Vars = append(chk.Vars, inj.Var)
+	}
+	dr.SecretRefs = append(dr.SecretRefs, chk)
+}
@@ -23,7 +23,6 @@ import (
 	"archive/tar"
 	"bufio"
 	"bytes"
-	"compress/gzip"
 	"context"
 	"encoding/base64"
 	"encoding/json"
@@ -31,30 +30,52 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/avast/retry-go"
+	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/gbevan/gostint/approle"
 	"github.com/gbevan/gostint/cleanup"
+	"github.com/gbevan/gostint/config"
+	"github.com/gbevan/gostint/content"
+	"github.com/gbevan/gostint/imagepolicy"
 	"github.com/gbevan/gostint/logmsg"
+	"github.com/gbevan/gostint/meta"
+	"github.com/gbevan/gostint/redact"
+	"github.com/gbevan/gostint/secretrefs"
 	"github.com/gbevan/gostint/state"
+	"github.com/gbevan/gostint/vaultsession"
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	"github.com/hashicorp/vault/api"
 	. "github.com/visionmedia/go-debug" // nolint
-	yaml "gopkg.in/yaml.v2"
 )
 
+// withheldOutput replaces the output of jobs that cannot be redacted
+const withheldOutput = "gostint: output withheld, the job was reattached after a gostint restart so the secrets injected into it could not be redacted from its output"
+
 const gostintUID = 2001
 const gostintGID = 2001
 
+// Labels placed on job containers to identify them on the docker host. Short
+// lived helper containers, e.g. image probes, are labelled labelHelper instead
+// of labelJobID, so they are never mistaken for a job's container.
+const (
+	labelJobID    = "gostint.job_id"
+	labelNodeUUID = "gostint.node_uuid"
+	labelHelper   = "gostint.helper"
+)
+
 var debug = Debug("jobqueues")
 
 // AppRole holds Vault App Role details
@@ -65,13 +86,31 @@ type AppRole struct {
 
 // JobQueues holds jobqueue settings and state
 type JobQueues struct {
-	Db       *mgo.Database
+	Db       func() *mgo.Database
+	Cfg      *config.Config
 	AppRole  *AppRole
 	NodeUUID string
 }
 
 var jobQueues JobQueues
 
+// runningJob holds what this node needs to renew and stop a job it is running
+type runningJob struct {
+	containerID string
+	fence       int64
+}
+
+// running tracks the jobs being executed by this node, once draining no more
+// may be added
+var running = struct {
+	sync.Mutex
+	wg       sync.WaitGroup
+	jobs     map[bson.ObjectId]*runningJob
+	draining bool
+}{
+	jobs: map[bson.ObjectId]*runningJob{},
+}
+
 // Job structure to represent a job submission request
 type Job struct {
 	ID       bson.ObjectId `json:"_id"               bson:"_id,omitempty"`
@@ -83,6 +122,8 @@ type Job struct {
 	CubbyPath    string `    json:"cubby_path"        bson:"cubby_path"`
 	WrapSecretID string `    json:"wrap_secret_id"    bson:"wrap_secret_id" description:"Wrapping Token for the SecretID"`
 
+	Labels map[string]string `json:"labels"            bson:"labels,omitempty" description:"Arbitrary labels, e.g. for selection by retention policy"`
+
 	Payload string `         json:"payload"           bson:"payload" description:"Encrypted payload for the job from requestor, populated temporarily from the cubbyhole"`
 
 	// These are populated from the decrypted payload
@@ -90,6 +131,7 @@ type Job struct {
 	ContainerImage  string   `json:"container_image"   bson:"container_image"`
 	ImagePullPolicy string   `json:"image_pull_policy" bson:"image_pull_policy"`
 	Content         string   `json:"content"           bson:"content"`
+	ContentAuth     []string `json:"content_auth"      bson:"content_auth" description:"Secret refs of credentials for fetching remote content"`
 	EntryPoint      []string `json:"entrypoint"        bson:"entrypoint"`
 	Run             []string `json:"run"               bson:"run"`
 	WorkingDir      string   `json:"working_directory" bson:"working_directory"`
@@ -98,30 +140,74 @@ type Job struct {
 	SecretRefs      []string `json:"secret_refs"       bson:"secret_refs"`
 	SecretFileType  string   `json:"secret_file_type"  bson:"secret_file_type"`
 	ContOnWarnings  bool     `json:"cont_on_warnings"  bson:"cont_on_warnings"`
+	Idempotent      bool     `json:"idempotent"        bson:"idempotent" description:"Job may be safely re-run if its node fails"`
+	Timeout         string   `json:"timeout"           bson:"timeout" description:"Duration after which the job is stopped and failed"`
+	VaultPolicies   []string `json:"vault_policies"    bson:"vault_policies" description:"Policies of the vault token given to the job"`
+
+	Limits  *config.Limits `json:"limits"  bson:"limits,omitempty" description:"Resource limits and security settings of the job's container"`
+	Network *JobNetwork    `json:"network" bson:"network,omitempty" description:"Network the job's container was attached to"`
 
 	// These are returned
 	Status        string    `json:"status"            bson:"status"`
 	ReturnCode    int       `json:"return_code"       bson:"return_code"`
 	Submitted     time.Time `json:"submitted"         bson:"submitted"`
+	SubmittedBy   string    `json:"submitted_by"      bson:"submitted_by,omitempty" description:"Identity of the submitter, see authenticate.Identity"`
 	Started       time.Time `json:"started"           bson:"started,omitempty"`
 	Ended         time.Time `json:"ended"             bson:"ended,omitempty"`
 	Output        string    `json:"output"            bson:"output"`
 	Stderr        string    `json:"stderr"            bson:"stderr"`
 	ContainerID   string    `json:"container_id"      bson:"container_id"`
 	KillRequested bool      `json:"kill_requested"    bson:"kill_requested"`
+	Pinned        bool      `json:"pinned"            bson:"pinned" description:"Pinned jobs are exempt from retention purging"`
+	Attempts      int       `json:"attempts"          bson:"attempts" description:"Number of times re-queued after its node failed"`
+	Authenticated bool      `json:"authenticated"     bson:"authenticated" description:"Set before the job's wrap_secret_id is unwrapped, which can only be done once"`
+	Popped        time.Time `json:"popped"            bson:"popped,omitempty"`
+	LeaseIDs      []string  `json:"lease_ids"         bson:"lease_ids,omitempty" description:"Vault leases of dynamic secrets read for the job"`
+	Audit         []string  `json:"audit"             bson:"audit,omitempty" description:"Timestamped problems encountered handling the job, e.g. lease revocation failures"`
+
+	// Ownership: the node_uuid owning the job holds a lease until LeaseExpires,
+	// which it must renew. Fence is a fencing token, a new (increasing) value is
+	// assigned on each change of ownership and all updates by the owner are
+	// conditional on it, so a node that lost the job cannot overwrite it.
+	LeaseExpires time.Time `json:"lease_expires"     bson:"lease_expires,omitempty"`
+	Fence        int64     `json:"fence"             bson:"fence"`
 
 	// Internal:
 	contentRdr io.Reader
 	secretsRdr io.Reader
+	secretEnv  []string // secrets injected as environment variables
+	redactor   *redact.Redactor
+	timedOut   int32   // atomic, set when the job's timeout stopped it
+	dryRun     *DryRun // set when the job is only being dry run
+	stagedImg  string  // image staged with the job's content, for a read-only rootfs
 }
 
 func (job *Job) String() string {
 	return fmt.Sprintf("ID: %s, Qname: %s, Submitted: %s, Status: %s, Started: %s, Image: %s, Content: %d", job.ID, job.Qname, job.Submitted, job.Status, job.Started, job.ContainerImage, len(job.Content))
 }
 
+// Sanitised returns a copy of the job with the secret bearing request fields,
+// its vault lease ids and its audit trail (which names them) cleared, suitable
+// for export outside of gostint.
+func (job *Job) Sanitised() Job {
+	j := *job
+	j.CubbyToken = ""
+	j.CubbyPath = ""
+	j.WrapSecretID = ""
+	j.Payload = ""
+	j.LeaseIDs = nil
+	j.Audit = nil
+	j.contentRdr = nil
+	j.secretsRdr = nil
+	j.secretEnv = nil
+	j.redactor = nil
+	return j
+}
+
 // Init Initialises the job queues loop
-func Init(db *mgo.Database, appRole *AppRole, nodeUUID string) {
+func Init(db func() *mgo.Database, cfg *config.Config, appRole *AppRole, nodeUUID string) {
 	jobQueues.Db = db
+	jobQueues.Cfg = cfg
 	jobQueues.AppRole = appRole
 	jobQueues.NodeUUID = nodeUUID
 
@@ -136,14 +222,20 @@ func Init(db *mgo.Database, appRole *AppRole, nodeUUID string) {
 		dockerInfo.ServerVersion,
 	)
 
+	// Clean up after any previous instance of gostint on this docker host
+	reconcileContainers()
+	go reconcileHandler()
+
 	// start go routine to loop on the queues collection for new work
 	// Qname defines the FIFO queue.
 	go requestHandler()
 
 	go killHandler()
 
+	go leaseHandler()
+
 	// Cleanup unused docker images
-	go cleanup.Images()
+	go cleanup.Images(cfg)
 }
 
 // GetDockerInfo retrieves details of the docker client api and server info.
@@ -167,11 +259,9 @@ func GetDockerInfo() (string, *types.Info, error) {
 
 func requestHandler() {
 	// TODO: Provide a Wake channel for immediate pull ???
-	db := jobQueues.Db
-	c := db.C("queues")
-
-	for {
+	for !isDraining() {
 		if state.GetState() == "active" {
+			c := jobQueues.Db().C("queues")
 			var queues []string
 			err := c.Find(bson.M{}).Distinct("qname", &queues)
 			if err != nil {
@@ -179,61 +269,58 @@ func requestHandler() {
 			}
 
 			for _, q := range queues {
-				job := Job{}
-
-				chg := mgo.Change{
-					Update: bson.M{"$set": bson.M{
-						"status": "running",
-					}},
-					ReturnNew: false,
+				if state.GetState() != "active" {
+					break
 				}
 
-				statusCond := []bson.M{}
-				statusCond = append(statusCond, bson.M{"status": "queued"})
-				statusCond = append(statusCond, bson.M{"status": "running"})
-
-				_, err := c.Find(bson.M{"qname": q, "$or": statusCond}).Sort("submitted").Limit(1).Apply(chg, &job)
+				// Queues are serialised, only the job at the head of the FIFO queue
+				// may run, so pop it only if it is not already running.
+				var head Job
+				err := c.Find(bson.M{
+					"qname":  q,
+					"status": bson.M{"$in": []string{"queued", "running"}},
+				}).Sort("submitted").Select(bson.M{"status": 1}).One(&head)
 				if err != nil {
-					if err.Error() == "not found" {
-						continue
+					if err != mgo.ErrNotFound {
+						logmsg.Error("Find head of queue %s failed: %v\n", q, err)
 					}
-					logmsg.Error("Pop from queue %s failed: %v\n", q, err)
+					continue
 				}
-
-				// NOTE: if the returned job has status = "queued", then this has just
-				// been atomically pop'd from the FIFO stack
-				if job.Status != "queued" {
-					break
+				if head.Status != "queued" {
+					continue
 				}
 
-				// set node uuid that we are running on
-				chg2 := mgo.Change{
-					Update: bson.M{"$set": bson.M{
-						"node_uuid": jobQueues.NodeUUID,
-						"started":   time.Now(),
-					}},
-					ReturnNew: true,
+				if isDraining() {
+					break
 				}
-				_, err = c.FindId(job.ID).Apply(chg2, &job)
+				job, err := pop(head.ID)
 				if err != nil {
-					logmsg.Error("Update to node uuid on queue %s failed: %v\n", q, err)
+					if err != mgo.ErrNotFound { // else popped by another node
+						logmsg.Error("Pop from queue %s failed: %v\n", q, err)
+					}
+					continue
 				}
 
+				if !job.track() {
+					// began draining since the check above, the job never ran
+					// so is put back without using up an attempt
+					if err = job.release(); err != nil {
+						logmsg.Error("Re-queue of job %s failed: %s", job.ID.Hex(), err)
+					}
+					break
+				}
 				go job.runRequest()
 			}
 		} // if state active
 
-		time.Sleep(1000 * time.Millisecond)
+		time.Sleep(jobQueues.Cfg.PollInterval.D())
 	}
 }
 
 func killHandler() {
-	db := jobQueues.Db
-	c := db.C("queues")
-
 	for {
 		var queues []Job
-		err := c.Find(bson.M{
+		err := jobQueues.Db().C("queues").Find(bson.M{
 			"node_uuid":      jobQueues.NodeUUID,
 			"kill_requested": true,
 			"status": bson.M{
@@ -254,29 +341,182 @@ func killHandler() {
 			job.kill()
 		}
 
-		time.Sleep(5000 * time.Millisecond)
+		time.Sleep(jobQueues.Cfg.KillPollInterval.D())
+	}
+}
+
+// nextFence returns a new fencing token from the cluster wide counter
+func nextFence() (int64, error) {
+	var counter struct {
+		Seq int64 `bson:"seq"`
 	}
+	_, err := jobQueues.Db().C("counters").FindId("fence").Apply(mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"seq": int64(1)}},
+		Upsert:    true,
+		ReturnNew: true,
+	}, &counter)
+	return counter.Seq, err
 }
 
-// UpdateJob Atomically update a job in MongoDB
+// pop atomically takes ownership of the queued job for this node, with a new
+// lease and fencing token. Returns mgo.ErrNotFound if the job is no longer
+// queued, e.g. popped by another node.
+func pop(id bson.ObjectId) (*Job, error) {
+	fence, err := nextFence()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+
+	var job Job
+	_, err = jobQueues.Db().C("queues").Find(bson.M{
+		"_id":    id,
+		"status": "queued",
+	}).Apply(mgo.Change{
+		Update: bson.M{"$set": bson.M{
+			"status":        "running",
+			"node_uuid":     jobQueues.NodeUUID,
+			"fence":         fence,
+			"lease_expires": now.Add(jobQueues.Cfg.LeaseDuration.D()),
+			"popped":        now,
+			"started":       now,
+		}},
+		ReturnNew: true,
+	}, &job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// release puts a job popped by this node back on its queue as it was before
+// it was popped, for a job this node cannot run after all.
+func (job *Job) release() error {
+	return jobQueues.Db().C("queues").Update(
+		bson.M{
+			"_id":    job.ID,
+			"fence":  job.Fence,
+			"status": "running",
+		},
+		bson.M{
+			"$set": bson.M{
+				"status":    "queued",
+				"node_uuid": "",
+			},
+			"$unset": bson.M{
+				"started":       "",
+				"popped":        "",
+				"lease_expires": "",
+			},
+		},
+	)
+}
+
+// leaseHandler renews the leases of the jobs this node is running
+func leaseHandler() {
+	for {
+		time.Sleep(jobQueues.Cfg.LeaseDuration.D() / 3)
+		renewLeases()
+	}
+}
+
+// renewLeases renews the leases of the jobs this node is running. If a lease
+// cannot be renewed the job has been taken over by another node, so its
+// container is stopped. The db session is replaced on credential rotation, so
+// the collection is got afresh each time.
+func renewLeases() {
+	c := jobQueues.Db().C("queues")
+
+	running.Lock()
+	jobs := map[bson.ObjectId]runningJob{}
+	for id, rj := range running.jobs {
+		jobs[id] = *rj
+	}
+	running.Unlock()
+
+	for id, rj := range jobs {
+		err := c.Update(
+			bson.M{"_id": id, "fence": rj.fence},
+			bson.M{"$set": bson.M{
+				"lease_expires": time.Now().Add(jobQueues.Cfg.LeaseDuration.D()),
+			}},
+		)
+		if err == nil {
+			continue
+		}
+		if err != mgo.ErrNotFound {
+			logmsg.Error("Lease renewal for job %s failed: %s", id.Hex(), err)
+			continue
+		}
+		logmsg.Error("Lost lease on job %s (fence %d), it has been taken over", id.Hex(), rj.fence)
+		if rj.containerID != "" {
+			ctx, cli, err := getDockerClient()
+			if err != nil {
+				logmsg.Error("get docker client error: %s", err)
+				continue
+			}
+			stopContainer(*ctx, cli, rj.containerID)
+			cli.Close()
+		}
+	}
+}
+
+// UpdateJob Atomically update a job in MongoDB.
+// If the job has a fencing token the update only applies while the job still
+// holds it, i.e. has not been taken over by another node.
 func (job *Job) UpdateJob(u bson.M) (*Job, error) {
-	db := jobQueues.Db
-	c := db.C("queues")
+	if job.dryRun != nil {
+		job.dryRun.update(u)
+		return job, nil
+	}
+
+	c := jobQueues.Db().C("queues")
 
 	chg := mgo.Change{
 		Update:    bson.M{"$set": u},
 		ReturnNew: true,
 	}
 
+	cond := bson.M{"_id": job.ID}
+	if job.Fence != 0 {
+		cond["fence"] = job.Fence
+	}
+
 	var resJob Job
-	_, err := c.FindId(job.ID).Apply(chg, &resJob)
+	_, err := c.Find(cond).Apply(chg, &resJob)
 	if err != nil {
+		if err == mgo.ErrNotFound && job.Fence != 0 {
+			logmsg.Warn("update of job %s rejected, fencing token %d is stale\n", job.ID.Hex(), job.Fence)
+			return nil, err
+		}
 		logmsg.Error("update queue failed: %s\n", err)
 		return nil, err
 	}
 	return &resJob, nil
 }
 
+// audit appends a timestamped message to the job's audit trail
+func (job *Job) audit(msg string) {
+	logmsg.Warn("job %s: %s", job.ID.Hex(), msg)
+	if job.dryRun != nil {
+		job.dryRun.Audit = append(job.dryRun.Audit, msg)
+		return
+	}
+
+	cond := bson.M{"_id": job.ID}
+	if job.Fence != 0 {
+		cond["fence"] = job.Fence
+	}
+	err := jobQueues.Db().C("queues").Update(cond, bson.M{
+		"$push": bson.M{
+			"audit": fmt.Sprintf("%s %s", time.Now().UTC().Format(time.RFC3339), msg),
+		},
+	})
+	if err != nil {
+		logmsg.Error("update of job %s audit trail failed: %s", job.ID.Hex(), err)
+	}
+}
+
 func getDockerClient() (*context.Context, *client.Client, error) {
 	ctx := context.Background()
 	cli, err := client.NewEnvClient()
@@ -291,63 +531,207 @@ func (job *Job) jobFailed(status string, err error) {
 	})
 }
 
-func (job *Job) resolveContentMeta() (*Meta, error) {
-	// Handle Content
-	meta := Meta{}
-	if job.Content != "" {
+// recordLeases persists the lease ids of dynamic secrets read for the job so
+// far, so they can be found if this node fails.
+func (job *Job) recordLeases(resolver *secretrefs.Resolver) {
+	if len(resolver.Leases) == len(job.LeaseIDs) {
+		return
+	}
+	for _, l := range resolver.Leases[len(job.LeaseIDs):] {
+		job.LeaseIDs = append(job.LeaseIDs, l.ID)
+	}
+	job.UpdateJob(bson.M{
+		"lease_ids": job.LeaseIDs,
+	})
+}
+
+// leaseClient returns the vault client revoking leases recorded for jobs,
+// gostint's own
+var leaseClient = vaultsession.Client
+
+// revokeLeases revokes the dynamic secret leases recorded for a job whose
+// resolver was lost with the node that ran it, once it has ended or been
+// recovered.
+func (job *Job) revokeLeases() {
+	if len(job.LeaseIDs) == 0 {
+		return
+	}
+	vclient := leaseClient()
+	if vclient == nil {
+		job.audit(fmt.Sprintf("Unable to revoke %d leases, no vault client", len(job.LeaseIDs)))
+		return
+	}
+	secretrefs.RevokeLeases(vclient, job.LeaseIDs, job.audit)
+}
+
+// contentAuth resolves the job's content_auth secret refs, which provide the
+// username, password or token used to fetch remote content.
+func (job *Job) contentAuth(resolver *secretrefs.Resolver) (*content.Auth, error) {
+	auth := content.Auth{}
+	for _, ref := range job.ContentAuth {
+		injs, err := resolver.Resolve(ref)
+		if err != nil {
+			return nil, err
+		}
+		for _, inj := range injs {
+			v, ok := inj.Value.(string)
+			if inj.As != secretrefs.AsValue || !ok {
+				return nil, fmt.Errorf("content_auth %s must be a string value", inj.Var)
+			}
+			switch inj.Var {
+			case "username":
+				auth.Username = v
+			case "password":
+				auth.Password = v
+			case "token":
+				auth.Token = v
+			default:
+				return nil, fmt.Errorf("content_auth var must be username, password or token, got: %s", inj.Var)
+			}
+		}
+	}
+	return &auth, nil
+}
+
+// closeContent releases the job's content tar
+func (job *Job) closeContent() {
+	if c, ok := job.contentRdr.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// loadContentRef returns the format and archive of uploaded content, referenced
+// as sha256:<hex>, decrypting it with the job's AppRole token if it was
+// uploaded transit encrypted.
+func (job *Job) loadContentRef(vclient *api.Client, ref string) (string, []byte, error) {
+	if !strings.HasPrefix(ref, content.RefPrefix) {
+		return "", nil, fmt.Errorf("Failed to parse content ref, expected %s<hex>: %s", content.RefPrefix, ref)
+	}
+	sum := strings.TrimPrefix(ref, content.RefPrefix)
+	blob, data, err := content.Load(sum)
+	if err != nil {
+		return "", nil, err
+	}
+	if !blob.UsableBy(job.SubmittedBy) {
+		return "", nil, fmt.Errorf("Content ref %s%s was not uploaded by the job's submitter, only encrypted content may be shared", content.RefPrefix, sum)
+	}
+	// keep the content while this job exists, in case it was only referenced
+	// in the encrypted payload
+	if job.dryRun == nil {
+		if err = content.Ref(sum, job.ID); err != nil {
+			return "", nil, err
+		}
+	}
+	if !blob.Encrypted {
+		return blob.Format, data, nil
+	}
+
+	resp, err := vclient.Logical().Write(
+		fmt.Sprintf("transit/decrypt/%s", jobQueues.AppRole.Name),
+		map[string]interface{}{
+			"ciphertext": string(data),
+		},
+	)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to decrypt content via vault: %s", err)
+	}
+	plaintext, _ := resp.Data["plaintext"].(string)
+	if data, err = base64.StdEncoding.DecodeString(plaintext); err != nil {
+		return "", nil, fmt.Errorf("Failed to decode decrypted content base64: %s", err)
+	}
+	return blob.Format, data, nil
+}
+
+// loadContent fetches or decodes the job's content (nil if none), normalised
+// to a tar.
+func (job *Job) loadContent(vclient *api.Client, auth *content.Auth) (*content.Archive, error) {
+	if job.Content == "" {
+		return nil, nil
+	}
+	var format string
+	var data []byte
+	if content.IsRemote(job.Content) {
+		var err error
+		if format, data, err = content.Fetch(job.Content, auth); err != nil {
+			return nil, err
+		}
+	} else {
 		parts := strings.Split(job.Content, ",")
 		if len(parts) != 2 {
 			return nil, fmt.Errorf("Failed to parse invalid content")
 		}
-		// decode content base64
-		data, err2 := base64.StdEncoding.DecodeString(parts[1])
-		if err2 != nil {
-			return nil, fmt.Errorf("Failed to decode content base64: %s", err2)
-		}
-		switch parts[0] {
-		case "targz":
-			// Put content reader in job for later copy into container as tar reader
-			rdr, err := gzip.NewReader(strings.NewReader(string(data)))
-			job.contentRdr = rdr
-			if err != nil {
-				return nil, fmt.Errorf("Failed to unzip content: %s", err)
+		var err2 error
+		if parts[0] == "ref" {
+			if format, data, err2 = job.loadContentRef(vclient, parts[1]); err2 != nil {
+				return nil, err2
+			}
+		} else {
+			// decode content base64
+			format = parts[0]
+			if data, err2 = base64.StdEncoding.DecodeString(parts[1]); err2 != nil {
+				return nil, fmt.Errorf("Failed to decode content base64: %s", err2)
 			}
-			break
-		default:
-			return nil, fmt.Errorf("Failed to extract content, unsupported archive format: %s", parts[0])
 		}
+	}
+	arc, err := content.Normalise(format, data)
+	if err != nil {
+		return nil, err
+	}
+	logmsg.Debug("Content %d files, %d bytes", arc.Files, arc.Size)
+	return arc, nil
+}
 
-		// Look for gostint.yml in content
-		tempRdr, err2 := gzip.NewReader(strings.NewReader(string(data)))
-		if err2 != nil {
-			return nil, fmt.Errorf("Failed to unzip content to rdr for gostint.yaml: %s", err2)
-		}
-		tr := tar.NewReader(tempRdr)
-		var bufMeta bytes.Buffer
-		for {
-			hdr, err2 := tr.Next()
-			if err2 == io.EOF {
-				break // End of archive
-			}
-			if err2 != nil {
-				return nil, fmt.Errorf("Failed content tar: %s", err2)
-			}
-			if hdr.Name == "./gostint.yml" {
-				if _, err := io.Copy(&bufMeta, tr); err != nil {
-					return nil, fmt.Errorf("Failed extracting gostint.yml from tar: %s", err)
-				}
-			}
+// resolveContentMeta loads the job's content, returning its gostint.yml meta
+// data (nil if none).
+func (job *Job) resolveContentMeta(vclient *api.Client, auth *content.Auth) (*meta.Meta, error) {
+	arc, err := job.loadContent(vclient, auth)
+	if arc == nil || err != nil {
+		return nil, err
+	}
+	// Put content tar in job for later copy into container
+	job.contentRdr = arc.Tar
 
-			// parse gostint.yml
-			err := yaml.Unmarshal(bufMeta.Bytes(), &meta)
-			if err != nil {
-				return nil, fmt.Errorf("Failed parsing yaml in gostint.yml: %s", err)
-			}
-		} // for
+	if arc.Meta == nil {
+		return nil, nil
+	}
+	return meta.Parse(meta.LayerContent, arc.Meta)
+}
+
+// requestMeta returns the meta data given in the job request (or payload)
+func (job *Job) requestMeta() *meta.Meta {
+	return &meta.Meta{
+		ContainerImage:  job.ContainerImage,
+		ImagePullPolicy: job.ImagePullPolicy,
+		EntryPoint:      job.EntryPoint,
+		Run:             job.Run,
+		WorkingDir:      job.WorkingDir,
+		EnvVars:         job.EnvVars,
+		Tty:             meta.SetIfTrue(job.Tty),
+		SecretRefs:      job.SecretRefs,
+		SecretFileType:  job.SecretFileType,
+		ContOnWarnings:  meta.SetIfTrue(job.ContOnWarnings),
+		Timeout:         job.Timeout,
+		VaultPolicies:   job.VaultPolicies,
+		Limits:          job.Limits,
+	}
+}
 
-		// job.ContainerImage = meta.ContainerImage
+// applyMeta sets the job's fields from its merged meta data
+func (job *Job) applyMeta(m *meta.Meta) {
+	job.EntryPoint = m.EntryPoint
+	job.Run = m.Run
+	job.WorkingDir = m.WorkingDir
+	job.EnvVars = m.EnvVars
+	job.Tty = meta.Bool(m.Tty)
+	job.SecretRefs = m.SecretRefs
+	job.SecretFileType = m.SecretFileType
+	if job.SecretFileType == "" {
+		job.SecretFileType = "yaml"
 	}
-	return &meta, nil
+	job.ContOnWarnings = meta.Bool(m.ContOnWarnings)
+	job.Timeout = m.Timeout
+	job.VaultPolicies = m.VaultPolicies
+	job.Limits = m.Limits
 }
 
 func (job *Job) pullDockerImage(ctx *context.Context, cli *client.Client) (string, error) {
@@ -358,16 +742,16 @@ func (job *Job) pullDockerImage(ctx *context.Context, cli *client.Client) (strin
 		return "", errors.New(errmsg)
 	}
 
-	if strings.Index(job.ContainerImage, ":") == -1 {
-		job.ContainerImage = fmt.Sprintf("%s:latest", job.ContainerImage)
+	named, err := reference.ParseNormalizedNamed(job.ContainerImage)
+	if err != nil {
+		return "", fmt.Errorf("Invalid container_image '%s': %s", job.ContainerImage, err)
 	}
+	named = reference.TagNameOnly(named) // :latest if no tag or digest
+	job.ContainerImage = reference.FamiliarString(named)
 
-	var imgRef string
-	if strings.Contains(job.ContainerImage, "/") {
-		// TODO: Support logins
-		imgRef = job.ContainerImage
-	} else {
-		imgRef = fmt.Sprintf("docker.io/%s", job.ContainerImage)
+	qp := jobQueues.Cfg.QueuePolicyFor(job.Qname)
+	if err = imagepolicy.Check(&qp.Images, named); err != nil {
+		return "", err
 	}
 
 	// Get list of images on host
@@ -386,91 +770,98 @@ func (job *Job) pullDockerImage(ctx *context.Context, cli *client.Client) (strin
 		}
 	}
 
+	// registry credentials are released (any dynamic leases revoked) once the
+	// image is pulled and verified
+	resolver := newRegistryResolver()
+	defer resolver.Release(job.audit)
+
+	local := job.ContainerImage
 	if !imgAlreadyPulled || job.ImagePullPolicy == "Always" {
-		var reader io.ReadCloser
-		// var err2 error
-		err = retry.Do(
-			func() error {
-				logmsg.Info("Trying to pull image %s", imgRef)
-				reader, err = cli.ImagePull(*ctx, imgRef, types.ImagePullOptions{})
-				if err != nil {
-					logmsg.Warn("ImagePull imgRef: %s, %v, will retry", imgRef, err)
-					return err
-				}
-				// return nil
-				// },
-				// )
-				// if err != nil {
-				// 	logmsg.Error("ImagePull imgRef: %s, %v, exceeded retries", imgRef, err)
-				// 	return "", err
-				// }
-
-				// This is currently needed to ensure images are downloaded before we
-				// move on to creating containers...
-				scanner := bufio.NewScanner(reader)
-				for scanner.Scan() {
-					pullStatus := make(map[string]interface{})
-					jsonStr := []byte(scanner.Text())
-					err = json.Unmarshal(jsonStr, &pullStatus)
-					if err != nil {
-						logmsg.Error("parsing docker status: %v", err)
-						return err
-					}
-					// logmsg.Debug("image: %s", pullStatus)
-					// progress := ""
-					if pullStatus["progress"] != nil {
-						progress := pullStatus["progress"].(string)
-						logmsg.Info("%v: %s", pullStatus["status"], progress)
-					} else {
-						// logmsg.Warn("image: jsonStr: %s", jsonStr)
-						if pullStatus["errorDetail"] != nil {
-							return fmt.Errorf("%v", pullStatus["errorDetail"])
-						}
-						logmsg.Info("%v", pullStatus["status"])
-					}
-				}
-				if err = scanner.Err(); err != nil {
-					return err
-				}
-				// io.Copy(os.Stdout, reader)
-				return nil
-			},
-		)
-		if err != nil {
-			logmsg.Error("ImagePull imgRef: %s, %v, exceeded retries", imgRef, err)
+		if local, err = job.pullFromRegistry(ctx, cli, resolver, qp, named); err != nil {
 			return "", err
 		}
-
+		imgID = "" // the pull may have moved the tag to another image
 	} else {
 		logmsg.Info("Image %s already pulled & image_pull_policy: %s", job.ContainerImage, job.ImagePullPolicy)
 	}
 
 	if imgID == "" {
-		// Get image ID
-		imgList, err = cli.ImageList(*ctx, types.ImageListOptions{
-			All: true,
-		})
+		// Get image ID, also of images pulled by digest
+		img, _, err := cli.ImageInspectWithRaw(*ctx, local)
 		if err != nil {
 			return "", err
 		}
-		for _, img := range imgList {
-			if len(img.RepoTags) > 0 && img.RepoTags[0] == job.ContainerImage {
-				imgID = img.ID
-			}
-		}
+		imgID = img.ID
+	}
+
+	// before any container is created from it. Containers are created from
+	// imgID, not the (mutable) name, so the image run is the one verified.
+	if err = job.verifyImage(ctx, cli, resolver, qp, named, imgID); err != nil {
+		return "", err
 	}
 	return imgID, nil
 }
 
+// pullImage pulls the image ref, with the encoded registry credentials if any
+func pullImage(ctx *context.Context, cli *client.Client, imgRef string, registryAuth string) error {
+	var reader io.ReadCloser
+	err := retry.Do(
+		func() error {
+			var err error
+			logmsg.Info("Trying to pull image %s", imgRef)
+			reader, err = cli.ImagePull(*ctx, imgRef, types.ImagePullOptions{
+				RegistryAuth: registryAuth,
+			})
+			if err != nil {
+				logmsg.Warn("ImagePull imgRef: %s, %v, will retry", imgRef, err)
+				return err
+			}
+			defer reader.Close()
+
+			// This is currently needed to ensure images are downloaded before we
+			// move on to creating containers...
+			scanner := bufio.NewScanner(reader)
+			for scanner.Scan() {
+				pullStatus := make(map[string]interface{})
+				jsonStr := []byte(scanner.Text())
+				err = json.Unmarshal(jsonStr, &pullStatus)
+				if err != nil {
+					logmsg.Error("parsing docker status: %v", err)
+					return err
+				}
+				if pullStatus["progress"] != nil {
+					progress := pullStatus["progress"].(string)
+					logmsg.Info("%v: %s", pullStatus["status"], progress)
+				} else {
+					if pullStatus["errorDetail"] != nil {
+						return fmt.Errorf("%v", pullStatus["errorDetail"])
+					}
+					logmsg.Info("%v", pullStatus["status"])
+				}
+			}
+			return scanner.Err()
+		},
+	)
+	if err != nil {
+		logmsg.Error("ImagePull imgRef: %s, %v, exceeded retries", imgRef, err)
+		return err
+	}
+	return nil
+}
+
 func (job *Job) createDockerContainer(ctx *context.Context, cli *client.Client, imgID string) (container.ContainerCreateCreatedBody, error) {
 	cleanup.ImageUsed(imgID, time.Now())
 
 	cfg := container.Config{
-		Image: job.ContainerImage,
+		Image: resolveFirstStr([]string{job.stagedImg, imgID}),
 		Cmd:   job.Run,
 		Tty:   job.Tty,
 		User:  fmt.Sprintf("%d:%d", gostintUID, gostintGID),
-		Env:   job.EnvVars,
+		Env:   append(append([]string{}, job.EnvVars...), job.secretEnv...),
+		Labels: map[string]string{
+			labelJobID:    job.ID.Hex(),
+			labelNodeUUID: jobQueues.NodeUUID,
+		},
 	}
 
 	if len(job.EntryPoint) != 0 {
@@ -483,17 +874,33 @@ func (job *Job) createDockerContainer(ctx *context.Context, cli *client.Client,
 
 	hostCfg := container.HostConfig{}
 	// Map VAULT_CACERT file into container as readonly
-	vaultCaCert := os.Getenv("VAULT_CACERT")
+	vaultCaCert := jobQueues.Cfg.VaultCACert
 	logmsg.Debug("vaultCaCert:", vaultCaCert)
 	if vaultCaCert != "" {
-		hostCfg.Mounts = []mount.Mount{
-			{
-				Type:     mount.TypeBind,
-				Source:   vaultCaCert,
-				Target:   vaultCaCert,
-				ReadOnly: true,
-			},
+		hostCfg.Mounts = append(hostCfg.Mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   vaultCaCert,
+			Target:   vaultCaCert,
+			ReadOnly: true,
+		})
+	}
+
+	// Map the job's secrets directory on the tmpfs into the container, its
+	// files are readable by gostint's group, which the job's user is added to
+	if dir := secretsHostDir(job.ID.Hex()); dir != "" {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return container.ContainerCreateCreatedBody{}, fmt.Errorf("Failed to create secrets directory: %s", err)
 		}
+		hostCfg.Mounts = append(hostCfg.Mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   dir,
+			Target:   secretsMount,
+			ReadOnly: true,
+		})
+		hostCfg.GroupAdd = append(hostCfg.GroupAdd, strconv.Itoa(os.Getegid()))
+	}
+	if err := job.hostLimits(&hostCfg); err != nil {
+		return container.ContainerCreateCreatedBody{}, err
 	}
 	logmsg.Debug("hostCfg:", hostCfg)
 
@@ -507,7 +914,7 @@ func (job *Job) createDockerContainer(ctx *context.Context, cli *client.Client,
 	return resp, nil
 }
 
-func (job *Job) metaFromDockerContainer(ctx *context.Context, cli *client.Client, containerID string, srcPath string) (map[interface{}]interface{}, error) {
+func (job *Job) metaFromDockerContainer(ctx *context.Context, cli *client.Client, containerID string, srcPath string) (*meta.Meta, error) {
 	rdr, _, err := cli.CopyFromContainer(*ctx, containerID, srcPath)
 	defer func() {
 		if rdr != nil {
@@ -543,12 +950,35 @@ func (job *Job) metaFromDockerContainer(ctx *context.Context, cli *client.Client
 	}
 
 	// parse meta yaml
-	meta := make(map[interface{}]interface{})
-	err = yaml.Unmarshal(bufMeta.Bytes(), &meta)
+	return meta.Parse(meta.LayerImage, bufMeta.Bytes())
+}
+
+// imageMeta returns the image's gostint_image.yml meta data (nil if none),
+// read from a container created for the purpose and never started.
+func (job *Job) imageMeta(ctx *context.Context, cli *client.Client, imgID string) (*meta.Meta, error) {
+	cleanup.ImageUsed(imgID, time.Now())
+	cfg := container.Config{
+		Image: imgID,
+		Cmd:   []string{"/gostint-image-meta"}, // not run, for images without a CMD
+		Labels: map[string]string{
+			labelHelper:   "image-meta",
+			labelNodeUUID: jobQueues.NodeUUID,
+		},
+	}
+	resp, err := cli.ContainerCreate(*ctx, &cfg, &container.HostConfig{}, nil, "")
 	if err != nil {
-		return nil, fmt.Errorf("Failed parsing yaml in %s: %s", srcPath, err)
+		return nil, fmt.Errorf("Failed creating container to read %s: %s", meta.ImageFile, err)
 	}
-	return meta, nil
+	defer func() {
+		rmOpts := types.ContainerRemoveOptions{
+			RemoveVolumes: true,
+			Force:         true,
+		}
+		if errD := cli.ContainerRemove(*ctx, resp.ID, rmOpts); errD != nil {
+			logmsg.Error("removing container: %s", errD)
+		}
+	}()
+	return job.metaFromDockerContainer(ctx, cli, resp.ID, meta.ImageFile)
 }
 
 func resolveFirstStr(list []string) string {
@@ -566,19 +996,476 @@ func resolveFirstArray(list [][]string) []string {
 			return element
 		}
 	}
-	return []string{}
-}
+	return []string{}
+}
+
+func resolveFirstBoolTrue(list []bool) bool {
+	for _, element := range list {
+		if element {
+			return element
+		}
+	}
+	return false
+}
+
+// track records the job as running on this node, for lease renewal and Drain,
+// returning false if the node is draining and so cannot run it.
+func (job *Job) track() bool {
+	running.Lock()
+	defer running.Unlock()
+	if running.draining {
+		return false
+	}
+	running.jobs[job.ID] = &runningJob{
+		fence: job.Fence,
+	}
+	running.wg.Add(1)
+	return true
+}
+
+// untrack removes the job from those running on this node
+func (job *Job) untrack() {
+	running.Lock()
+	delete(running.jobs, job.ID)
+	running.Unlock()
+	running.wg.Done()
+}
+
+// trackContainer records the container running the job
+func (job *Job) trackContainer(containerID string) {
+	running.Lock()
+	if rj, ok := running.jobs[job.ID]; ok {
+		rj.containerID = containerID
+	}
+	running.Unlock()
+}
+
+// isTracked returns true if the job (by hex id) is running on this node
+func isTracked(jobID string) bool {
+	if !bson.IsObjectIdHex(jobID) {
+		return false
+	}
+	running.Lock()
+	defer running.Unlock()
+	_, ok := running.jobs[bson.ObjectIdHex(jobID)]
+	return ok
+}
+
+// isDraining returns true once Drain has been called
+func isDraining() bool {
+	running.Lock()
+	defer running.Unlock()
+	return running.draining
+}
+
+// RunningCount returns the number of jobs being executed by this node
+func RunningCount() int {
+	running.Lock()
+	defer running.Unlock()
+	return len(running.jobs)
+}
+
+// Drain waits up to timeout for the jobs running on this node to complete,
+// after which no more jobs will be popped, reattached or tracked by the node.
+// Any jobs still running after the timeout have their containers stopped and
+// are put back on their queues for another node to pick up.
+func Drain(timeout time.Duration) {
+	// no more running.wg.Add()s once draining, so it is safe to Wait
+	running.Lock()
+	running.draining = true
+	running.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		running.wg.Wait()
+		close(done)
+	}()
+
+	logmsg.Info("Waiting up to %s for %d running jobs to complete", timeout, RunningCount())
+	select {
+	case <-done:
+		logmsg.Info("All running jobs completed")
+		return
+	case <-time.After(timeout):
+	}
+
+	// prevent runRequest goroutines from starting any more containers
+	state.SetState("stopping")
+
+	running.Lock()
+	jobs := map[bson.ObjectId]string{}
+	for id, rj := range running.jobs {
+		jobs[id] = rj.containerID
+	}
+	running.Unlock()
+
+	ctx, cli, err := getDockerClient()
+	if err != nil {
+		logmsg.Error("Drain get docker client failed: %s", err)
+	} else {
+		for id, containerID := range jobs {
+			if containerID != "" {
+				logmsg.Warn("Stopping container %s of job %s for requeue", containerID, id.Hex())
+				stopContainer(*ctx, cli, containerID)
+			}
+		}
+		cli.Close()
+	}
+
+	// give the runRequest goroutines a moment to clean up after their containers
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		logmsg.Warn("Timed out waiting for stopped jobs to clean up")
+	}
+
+	c := jobQueues.Db().C("queues")
+	for id := range jobs {
+		var job Job
+		if err = c.FindId(id).One(&job); err != nil {
+			logmsg.Error("Drain get job %s failed: %s", id.Hex(), err)
+			continue
+		}
+		if job.NodeUUID != jobQueues.NodeUUID {
+			continue
+		}
+		if err = job.Recover("gostint node shutdown timed out while the job was running"); err != nil {
+			logmsg.Error("Drain recover job %s failed: %s", id.Hex(), err)
+		}
+	}
+}
+
+// Recover applies the queue's recovery policy to a job orphaned by a node that
+// failed, restarted or was shutdown. Its wrap_secret_id can only be unwrapped
+// once, so only jobs that never got as far as authenticating are put back on
+// their queue (up to the queue's max_attempts), others are marked failed (if
+// they never started a container) or unknown with the reason. The update is
+// conditional on the job still having the fencing token and status it was
+// read with, so concurrent recovery by several nodes is safe, and assigns a
+// new fencing token so the previous owner can no longer update it. Jobs that
+// have already ended, e.g. while their node was draining, keep their results.
+// Leases of dynamic secrets recorded for the job are revoked once recovered.
+func (job *Job) Recover(reason string) error {
+	if job.Status != "running" && job.Status != "stopping" {
+		logmsg.Debug("Job %s is %s, not recovering it", job.ID.Hex(), job.Status)
+		return nil
+	}
+	pol := jobQueues.Cfg.QueuePolicyFor(job.Qname)
+
+	fence, err := nextFence()
+	if err != nil {
+		return err
+	}
+
+	err = jobQueues.Db().C("queues").Update(bson.M{
+		"_id":    job.ID,
+		"fence":  job.Fence,
+		"status": job.Status,
+	}, job.recoverUpdate(&pol, fence, reason))
+	if err == mgo.ErrNotFound {
+		logmsg.Debug("Job %s already recovered or changed", job.ID.Hex())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	job.Fence = fence
+	job.revokeLeases()
+	return nil
+}
+
+// recoverUpdate returns the update recovering the job with the new fence
+func (job *Job) recoverUpdate(pol *config.QueuePolicy, fence int64, reason string) bson.M {
+	unwrapped := job.Authenticated || job.ContainerID != ""
+	if !unwrapped && job.Attempts+1 < pol.MaxAttempts {
+		logmsg.Warn("Re-queuing job %s, it had not started (attempt %d of %d): %s", job.ID.Hex(), job.Attempts+2, pol.MaxAttempts, reason)
+		return bson.M{
+			"$set": bson.M{
+				"status":       "queued",
+				"node_uuid":    "",
+				"container_id": "",
+				"stderr":       "",
+				"return_code":  0,
+				"fence":        fence,
+				"output":       fmt.Sprintf("Re-queued for attempt %d of %d: %s", job.Attempts+2, pol.MaxAttempts, reason),
+			},
+			"$inc": bson.M{"attempts": 1},
+			"$unset": bson.M{
+				"started":       "",
+				"ended":         "",
+				"popped":        "",
+				"lease_expires": "",
+			},
+		}
+	}
+
+	status := "unknown"
+	if job.ContainerID == "" {
+		status = "failed" // its container was never started
+	}
+	why := fmt.Sprintf("job has been attempted %d times", job.Attempts+1)
+	if unwrapped {
+		why = "its wrap_secret_id has already been used, the job must be resubmitted"
+		if job.Idempotent || pol.Idempotent {
+			why = "although idempotent, " + why
+		}
+	}
+	logmsg.Warn("Job %s %s: %s (%s)", job.ID.Hex(), status, reason, why)
+	return bson.M{
+		"$set": bson.M{
+			"status": status,
+			"ended":  time.Now(),
+			"output": fmt.Sprintf("%s, not re-queued as %s", reason, why),
+			"fence":  fence,
+		},
+		"$unset": bson.M{
+			"lease_expires": "",
+		},
+	}
+}
+
+// reconcileHandler periodically reconciles containers left by other gostint
+// nodes on the docker host, until the node drains.
+func reconcileHandler() {
+	for !isDraining() {
+		time.Sleep(jobQueues.Cfg.LeaseDuration.D() / 3)
+		reconcileContainers()
+	}
+}
+
+// nodeAlive returns true if the gostint node has pinged within the stale node
+// threshold, or its liveness cannot be determined.
+func nodeAlive(nodeUUID string) bool {
+	n, err := jobQueues.Db().C("nodes").Find(bson.M{
+		"_id":       nodeUUID,
+		"last_seen": bson.M{"$gte": time.Now().Add(-jobQueues.Cfg.StaleNodeThreshold.D())},
+	}).Count()
+	if err != nil {
+		logmsg.Error("Reconcile get node %s failed: %s", nodeUUID, err)
+		return true
+	}
+	return n > 0
+}
+
+// reconcileContainers handles job containers left on the docker host by
+// other instances of gostint. Containers of jobs whose owning instance's lease
+// has expired are reattached to (if running) or finalised (if exited), those
+// never started are removed and their jobs recovered. Any others, e.g.
+// staging containers, and helper containers are removed only once their
+// instance has stopped pinging, so those of live instances sharing the docker
+// host are left alone.
+func reconcileContainers() {
+	ctx, cli, err := getDockerClient()
+	if err != nil {
+		logmsg.Error("Reconcile containers get docker client failed: %s", err)
+		return
+	}
+	defer cli.Close()
+
+	containers, err := cli.ContainerList(*ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", labelJobID)),
+	})
+	if err != nil {
+		logmsg.Error("Reconcile containers list failed: %s", err)
+		return
+	}
+
+	alive := map[string]bool{}
+	defer reconcileNetworks(ctx, cli, alive)
+	defer reconcileHelpers(ctx, cli, alive)
+
+	c := jobQueues.Db().C("queues")
+	for _, cont := range containers {
+		if isDraining() {
+			return
+		}
+		jobID := cont.Labels[labelJobID]
+		nodeUUID := cont.Labels[labelNodeUUID]
+		if nodeUUID == jobQueues.NodeUUID || isTracked(jobID) {
+			continue // ours, or reattached to by this node
+		}
+
+		var job Job
+		owned := false
+		if bson.IsObjectIdHex(jobID) {
+			err = c.FindId(bson.ObjectIdHex(jobID)).One(&job)
+			if err != nil && err != mgo.ErrNotFound {
+				logmsg.Error("Reconcile get job %s failed: %s", jobID, err)
+				continue
+			}
+			owned = err == nil &&
+				job.NodeUUID == nodeUUID &&
+				job.ContainerID == cont.ID &&
+				(job.Status == "running" || job.Status == "stopping")
+		}
+		if owned && !job.LeaseExpires.Before(time.Now()) {
+			continue // its node may still be running it
+		}
+		if !owned {
+			if _, ok := alive[nodeUUID]; !ok {
+				alive[nodeUUID] = nodeAlive(nodeUUID)
+			}
+			if alive[nodeUUID] {
+				continue
+			}
+		}
+
+		if owned && cont.State != "created" {
+			if job.claim() {
+				if !job.track() {
+					// draining, leave it for another node once the lease expires
+					continue
+				}
+				logmsg.Warn("Reattaching to container %s (%s) of job %s left by gostint node %s", cont.ID, cont.State, jobID, nodeUUID)
+				job.trackContainer(cont.ID)
+
+				go job.reattach(cont.ID)
+				continue
+			}
+			// recovered by another node in the meantime
+			owned = false
+		}
+
+		logmsg.Warn("Removing container %s of job %s left by gostint node %s", cont.ID, jobID, nodeUUID)
+		if cont.State == "running" {
+			stopContainer(*ctx, cli, cont.ID)
+		}
+		err = cli.ContainerRemove(*ctx, cont.ID, types.ContainerRemoveOptions{
+			RemoveVolumes: true,
+			Force:         true,
+		})
+		if err != nil {
+			logmsg.Error("removing container: %s", err)
+		}
+		removeSecretsDir(jobID)
+
+		if owned {
+			// container was created but never started
+			job.ContainerID = ""
+			if err = job.Recover("gostint restarted before the job's container was started"); err != nil {
+				logmsg.Error("Reconcile recover job %s failed: %s", jobID, err)
+			}
+		}
+	}
+}
+
+// reconcileHelpers removes helper containers left by gostint nodes that have
+// stopped pinging.
+func reconcileHelpers(ctx *context.Context, cli *client.Client, alive map[string]bool) {
+	containers, err := cli.ContainerList(*ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", labelHelper)),
+	})
+	if err != nil {
+		logmsg.Error("Reconcile helper containers list failed: %s", err)
+		return
+	}
+	for _, cont := range containers {
+		nodeUUID := cont.Labels[labelNodeUUID]
+		if nodeUUID == jobQueues.NodeUUID {
+			continue
+		}
+		if _, ok := alive[nodeUUID]; !ok {
+			alive[nodeUUID] = nodeAlive(nodeUUID)
+		}
+		if alive[nodeUUID] {
+			continue
+		}
+		logmsg.Warn("Removing %s container %s left by gostint node %s", cont.Labels[labelHelper], cont.ID, nodeUUID)
+		err = cli.ContainerRemove(*ctx, cont.ID, types.ContainerRemoveOptions{
+			RemoveVolumes: true,
+			Force:         true,
+		})
+		if err != nil {
+			logmsg.Error("removing container: %s", err)
+		}
+	}
+}
+
+// claim takes ownership of a job from its previous node for this node, with a
+// new lease and fencing token, returning false if the job has since been
+// changed by another node or its previous node has renewed its lease.
+func (job *Job) claim() bool {
+	fence, err := nextFence()
+	if err != nil {
+		logmsg.Error("Claim of job %s failed: %s", job.ID.Hex(), err)
+		return false
+	}
+	err = jobQueues.Db().C("queues").Update(
+		bson.M{
+			"_id":           job.ID,
+			"fence":         job.Fence,
+			"status":        job.Status,
+			"lease_expires": bson.M{"$lt": time.Now()},
+		},
+		bson.M{"$set": bson.M{
+			"node_uuid":     jobQueues.NodeUUID,
+			"fence":         fence,
+			"lease_expires": time.Now().Add(jobQueues.Cfg.LeaseDuration.D()),
+		}},
+	)
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			logmsg.Error("Claim of job %s failed: %s", job.ID.Hex(), err)
+		}
+		return false
+	}
+	job.NodeUUID = jobQueues.NodeUUID
+	job.Fence = fence
+	return true
+}
+
+// reattach resumes waiting on a job's container started by a previous
+// instance of gostint, collecting its output and finalising the job when it
+// exits (immediately if it already has). The previous instance's resolver
+// is lost, so the leases recorded for the job are revoked by id at the end.
+func (job *Job) reattach(containerID string) {
+	defer job.untrack()
+	defer job.revokeLeases()
+
+	ctx, cli, err := getDockerClient()
+	if err != nil {
+		job.jobFailed("failed", err)
+		return
+	}
+	defer func() {
+		cliErr := cli.Close()
+		if cliErr != nil {
+			logmsg.Error("Error:reattach() docker client close failed: %s\n", cliErr)
+		}
+	}()
 
-func resolveFirstBoolTrue(list []bool) bool {
-	for _, element := range list {
-		if element {
-			return element
+	// Automatically clean up the container
+	defer func() {
+		logmsg.Debug("Removing container %s", containerID)
+		rmOpts := types.ContainerRemoveOptions{
+			RemoveVolumes: true,
+			RemoveLinks:   false,
+			Force:         true,
+		}
+		if errD := cli.ContainerRemove(*ctx, containerID, rmOpts); errD != nil {
+			logmsg.Error("removing container: %s", errD)
 		}
+		removeSecretsDir(job.ID.Hex())
+		removeJobNetworks(ctx, cli, job.ID.Hex())
+	}()
+
+	err = job.waitContainer(ctx, cli, containerID)
+	if err != nil {
+		job.UpdateJob(bson.M{
+			"status": "failed",
+			"ended":  time.Now(),
+			"output": fmt.Sprintf("Reattached container failed: %s", err),
+		})
 	}
-	return false
 }
 
 func (job *Job) runRequest() {
+	if job.dryRun == nil {
+		defer job.untrack()
+	}
+
 	if job.KillRequested {
 		job.UpdateJob(bson.M{
 			"status": "failed",
@@ -600,6 +1487,14 @@ func (job *Job) runRequest() {
 		}
 	}()
 
+	// the wrap_secret_id is single use, so once unwrapping is attempted the job
+	// can no longer be re-queued for another node if this one fails
+	if _, err = job.UpdateJob(bson.M{"authenticated": true}); err != nil {
+		logmsg.Error("Failed to mark job %s authenticated: %s", job.ID.Hex(), err)
+		return
+	}
+	job.Authenticated = true
+
 	token, vclient, err := approle.Authenticate(jobQueues.AppRole.ID, job.WrapSecretID)
 	if err != nil {
 		job.UpdateJob(bson.M{
@@ -650,6 +1545,7 @@ func (job *Job) runRequest() {
 			return
 		}
 
+		// unknown fields are ignored, as in the request, for older clients
 		err = json.Unmarshal(payloadJSON, &payloadObj)
 		if err != nil {
 			job.UpdateJob(bson.M{
@@ -678,266 +1574,193 @@ func (job *Job) runRequest() {
 	job.Payload = ""
 
 	/****************************************
-	 * meta data layering:
+	 * meta data layering, see package meta:
 	 *  1) docker image /gostint_image.yml
 	 *  2) Content tar /gostint.yml
-	 *  3) Command line SecretRefs
+	 *  3) the request
+	 *  4) the request's encrypted payload
 	 */
 
+	// Resolves the job's secret refs (content_auth and secret_refs), it
+	// briefly caches each path read to allow multiple values to be extracted
+	// without needing to re-query the backend.
+	resolver := secretrefs.NewResolver(
+		vclient,
+		job.ContOnWarnings || payloadObj.ContOnWarnings,
+		jobQueues.Cfg.QueuePolicyFor(job.Qname).SecretBackendsFor(),
+	)
+	// Revoke the job's dynamic secret leases when done, before its token
+	// (deferred above)
+	defer resolver.Release(job.audit)
+
 	// Get Content to resolve gostint.yml meta data
 	job.Content = resolveFirstStr([]string{payloadObj.Content, job.Content})
-	// if payloadObj.Content != "" {
-	// 	job.Content = payloadObj.Content
-	// }
-	contentMeta, err := job.resolveContentMeta()
+	job.ContentAuth = resolveFirstArray([][]string{payloadObj.ContentAuth, job.ContentAuth})
+	auth, err := job.contentAuth(resolver)
+	job.recordLeases(resolver)
+	if err != nil {
+		job.jobFailed("failed", err)
+		return
+	}
+	contentMeta, err := job.resolveContentMeta(vclient, auth)
+	defer job.closeContent()
 	if err != nil {
 		job.jobFailed("failed", err)
 		return
 	}
 
-	// resolve image
-	job.ContainerImage = resolveFirstStr([]string{payloadObj.ContainerImage, job.ContainerImage, contentMeta.ContainerImage})
-	// if payloadObj.ContainerImage != "" {
-	// 	job.ContainerImage = payloadObj.ContainerImage
-	// }
-	job.ImagePullPolicy = resolveFirstStr([]string{payloadObj.ImagePullPolicy, job.ImagePullPolicy})
-	// if payloadObj.ImagePullPolicy != "" {
-	// 	job.ImagePullPolicy = payloadObj.ImagePullPolicy
-	// }
-
-	job.EntryPoint = resolveFirstArray([][]string{payloadObj.EntryPoint, job.EntryPoint})
-	job.Run = resolveFirstArray([][]string{payloadObj.Run, job.Run})
-	job.WorkingDir = resolveFirstStr([]string{payloadObj.WorkingDir, job.WorkingDir})
-	job.EnvVars = append(
-		payloadObj.EnvVars,
-		"VAULT_ADDR="+os.Getenv("VAULT_ADDR"),
-		"VAULT_CACERT="+os.Getenv("VAULT_CACERT"),
-		"VAULT_TOKEN="+token,
-	)
-	job.SecretFileType = resolveFirstStr([]string{payloadObj.SecretFileType, job.SecretFileType})
-	job.ContOnWarnings = resolveFirstBoolTrue([]bool{payloadObj.ContOnWarnings, job.ContOnWarnings})
-	job.Tty = resolveFirstBoolTrue([]bool{payloadObj.Tty, job.Tty})
+	// resolve image, which the image layer cannot set
+	layers := []meta.Layer{
+		{Name: meta.LayerContent, Meta: contentMeta},
+		{Name: meta.LayerRequest, Meta: job.requestMeta()},
+		{Name: meta.LayerPayload, Meta: payloadObj.requestMeta()},
+	}
+	merged, _ := meta.Merge(layers...)
+	if errs := merged.Validate(meta.LayerPayload); len(errs) > 0 {
+		job.jobFailed("failed", fmt.Errorf("Invalid job: %s", strings.Join(errs, ", ")))
+		return
+	}
+	job.ContainerImage = merged.ContainerImage
+	job.ImagePullPolicy = merged.ImagePullPolicy
+	if job.ImagePullPolicy == "" {
+		job.ImagePullPolicy = "IfNotPresent"
+	}
+	job.Idempotent = resolveFirstBoolTrue([]bool{payloadObj.Idempotent, job.Idempotent})
 
 	job.UpdateJob(bson.M{
 		"container_image":   job.ContainerImage,
 		"image_pull_policy": job.ImagePullPolicy,
-		"entrypoint":        job.EntryPoint,
-		"tty":               job.Tty,
+		"idempotent":        job.Idempotent,
 	})
 
 	// get image
 	imgID, err := job.pullDockerImage(ctx, cli)
+	job.recordLeases(resolver)
 	if err != nil {
-		job.jobFailed("failed", err)
+		status := "failed"
+		if _, denied := err.(*imagepolicy.Denied); denied {
+			status = "notauthorised"
+		}
+		job.jobFailed(status, err)
 		return
 	}
 
-	// Create Container, without running
-	containerBody, err := job.createDockerContainer(ctx, cli, imgID)
+	// Get /gostint_image.yml from the image, merge fields
+	imageMeta, err := job.imageMeta(ctx, cli, imgID)
 	if err != nil {
 		job.jobFailed("failed", err)
 		return
 	}
-
-	job.UpdateJob(bson.M{
-		"container_id": containerBody.ID,
-	})
-
-	logmsg.Info("Created container ID: %s", containerBody.ID)
-
-	// Automatically clean up the container
-	defer func() {
-		logmsg.Debug("Removing container %s", containerBody.ID)
-		rmOpts := types.ContainerRemoveOptions{
-			RemoveVolumes: true,
-			RemoveLinks:   false,
-			Force:         true,
-		}
-		if errD := cli.ContainerRemove(*ctx, containerBody.ID, rmOpts); errD != nil {
-			logmsg.Error("removing container: %s", errD)
-		}
-	}()
-
-	if job.SecretFileType == "" {
-		job.SecretFileType = "yaml"
-	}
-
-	if job.ImagePullPolicy == "" {
-		job.ImagePullPolicy = "IfNotPresent"
+	merged, sources := meta.Merge(append([]meta.Layer{{Name: meta.LayerImage, Meta: imageMeta}}, layers...)...)
+	job.applyMeta(merged)
+	if job.dryRun != nil {
+		job.dryRun.Job = merged
+		job.dryRun.Sources = sources
+		job.dryRun.ImageID = imgID
 	}
+	resolver.ContOnWarnings = job.ContOnWarnings
 
-	// Get /gostint_image.yml from Container, merge fields
-	imageMeta, err := job.metaFromDockerContainer(ctx, cli, containerBody.ID, "gostint_image.yml")
+	qp := jobQueues.Cfg.QueuePolicyFor(job.Qname)
+	timeout, err := job.resolveTimeout(qp)
 	if err != nil {
 		job.jobFailed("failed", err)
 		return
 	}
-
-	// Merge fields from layered meta sources (image, content, payload)
-	srs, ok := imageMeta["secret_refs"].([]interface{})
-	if ok {
-		for _, sr := range srs {
-			job.SecretRefs = append(job.SecretRefs, sr.(string))
-		}
+	if err = job.resolveVaultPolicies(qp); err != nil {
+		job.jobFailed("notauthorised", err)
+		return
 	}
-	job.SecretRefs = append(job.SecretRefs, contentMeta.SecretRefs...)
-	job.SecretRefs = append(job.SecretRefs, payloadObj.SecretRefs...)
-
-	if job.ImagePullPolicy != "IfNotPresent" && job.ImagePullPolicy != "Always" {
-		job.UpdateJob(bson.M{
-			"status": "failed",
-			"ended":  time.Now(),
-			"output": fmt.Sprintf("Incorrect value for image_pull_policy: %s", job.ImagePullPolicy),
-		})
+	if err = job.resolveLimits(qp); err != nil {
+		job.jobFailed("failed", err)
 		return
 	}
 
-	// Allow SecretRefs to be passed in job, e.g.
-	// SecretRefs: see tests/job1.json
-	// briefly cache the path response to allow multiple values to be extracted
-	// without needing to re-query the Vault.
-	secRefRe, err := regexp.Compile("^(\\w+)@([\\w\\-_/]+)\\.([\\w\\-_]+)$")
+	// Mint the job's own scoped vault token for its container
+	jobToken, jobAccessor, err := job.createJobToken(vclient, qp, timeout)
 	if err != nil {
-		job.UpdateJob(bson.M{
-			"status": "failed",
-			"ended":  time.Now(),
-			"output": fmt.Sprintf("Regex compilation error: %s", err),
-		})
+		job.jobFailed("failed", err)
 		return
 	}
-	secrets := map[string]string{}
-	secrets["TOKEN"] = token
-	cache := map[string]*api.Secret{}
-	for _, v := range job.SecretRefs {
-		parts := secRefRe.FindStringSubmatch(v)
-		if len(parts) < 3 {
-			job.UpdateJob(bson.M{
-				"status": "failed",
-				"ended":  time.Now(),
-				"output": fmt.Sprintf("Secretref is unparseable: %s", v),
-			})
-			return
-		}
-		secVarName := parts[1]
-		secPath := parts[2]
-		secKey := parts[3]
-
-		if secVarName == "" {
-			job.UpdateJob(bson.M{
-				"status": "failed",
-				"ended":  time.Now(),
-				"output": fmt.Sprintf("Target variable name in secretref cannot be empty"),
-			})
-			return
-		}
-		if secPath == "" {
-			job.UpdateJob(bson.M{
-				"status": "failed",
-				"ended":  time.Now(),
-				"output": fmt.Sprintf("Secretref must have a path"),
-			})
-			return
-		}
-		if secKey == "" {
-			job.UpdateJob(bson.M{
-				"status": "failed",
-				"ended":  time.Now(),
-				"output": fmt.Sprintf("Secretref must have a path.key"),
-			})
-			return
-		}
-
-		// var secretValues api.Secret
-		secretValues := cache[secPath]
-		if secretValues == nil {
-			secretValues, err = vclient.Logical().Read(secPath)
-
-			if err != nil {
-				job.UpdateJob(bson.M{
-					"status": "failed",
-					"ended":  time.Now(),
-					"output": fmt.Sprintf("Failed to retrieve secret %s from vault err: %v", secPath, err),
-				})
-				return
-			}
+	// deferred after the AppRole token's revoke-self, so runs before it
+	defer revokeJobToken(vclient, jobAccessor)
+	job.EnvVars = append(
+		append([]string{}, merged.EnvVars...),
+		"VAULT_ADDR="+jobQueues.Cfg.VaultAddr,
+		"VAULT_CACERT="+jobQueues.Cfg.VaultCACert,
+	)
+	job.EnvVars = append(job.EnvVars, job.secretsEnv(jobToken)...)
 
-			if secretValues == nil {
-				job.UpdateJob(bson.M{
-					"status": "failed",
-					"ended":  time.Now(),
-					"output": fmt.Sprintf("Failed to retrieve secret %s from vault: response is nil", secPath),
-				})
-				return
-			}
+	job.UpdateJob(bson.M{
+		"entrypoint":     job.EntryPoint,
+		"tty":            job.Tty,
+		"timeout":        job.Timeout,
+		"vault_policies": job.VaultPolicies,
+		"limits":         job.Limits,
+	})
 
-			if !job.ContOnWarnings && len(secretValues.Warnings) > 0 {
-				job.UpdateJob(bson.M{
-					"status": "failed",
-					"ended":  time.Now(),
-					"output": fmt.Sprintf("FailOnWarnings from vault path %s lookups: %v", secPath, secretValues.Warnings),
-				})
-				return
+	// Allow SecretRefs to be passed in job, e.g.
+	// SecretRefs: see tests/job1.json
+	secrets := map[string]interface{}{}
+	secrets["TOKEN"] = jobToken
+	secretEnv := []string{}
+	var entries []TarEntry
+	for _, v := range job.SecretRefs {
+		injs, err2 := resolver.Resolve(v)
+		job.recordLeases(resolver)
+		job.dryRun.checked(v, injs, err2)
+		if err2 != nil {
+			if job.dryRun != nil {
+				continue // report every secret ref that cannot be read
 			}
-
-			cache[secPath] = secretValues
-		}
-		var data interface{}
-		if secretValues.Data["data"] != nil { // kv v2
-			data = secretValues.Data["data"]
-		} else if secretValues.Data != nil { // kv v1
-			data = secretValues.Data
-		} else {
 			job.UpdateJob(bson.M{
 				"status": "failed",
 				"ended":  time.Now(),
-				"output": fmt.Sprintf("No data returned from vault path %s.%s", secPath, secKey),
+				"output": err2.Error(),
 			})
 			return
 		}
-		secVal := (data.(map[string]interface{}))[secKey]
-		if secVal == nil {
-			job.UpdateJob(bson.M{
-				"status": "failed",
-				"ended":  time.Now(),
-				"output": fmt.Sprintf("Failed retrieving from vault path %s.%s", secPath, secKey),
-			})
-			return
+		for _, inj := range injs {
+			switch inj.As {
+			case secretrefs.AsEnv:
+				secretEnv = append(secretEnv, fmt.Sprintf("%s=%s", inj.Var, inj.Value))
+			case secretrefs.AsFile:
+				entry := TarEntry{
+					Name:    strings.TrimPrefix(inj.FilePath, "/"),
+					Content: inj.Content,
+					Mode:    inj.Mode,
+					UID:     gostintUID,
+					GID:     gostintGID,
+				}
+				if inj.Owner != nil {
+					entry.UID = inj.Owner.UID
+					entry.GID = inj.Owner.GID
+				}
+				entries = append(entries, entry)
+			default:
+				secrets[inj.Var] = inj.Value
+			}
 		}
-		secrets[secVarName] = (data.(map[string]interface{}))[secKey].(string)
 	} // for SecretRefs
+	if job.dryRun != nil && len(job.dryRun.Errors) > 0 {
+		return
+	}
+	resolver.KeepLeases(job.audit)
 
-	// Create tar rdr for /secrets.yml|json in container
-	var entries []TarEntry
-	if job.SecretFileType == "yaml" {
-		secretsYAML, err2 := yaml.Marshal(secrets)
-		if err2 != nil {
-			job.UpdateJob(bson.M{
-				"status": "failed",
-				"ended":  time.Now(),
-				"output": fmt.Sprintf("Failed to Marshal secrets to yaml for container injection: %s", err),
-			})
-			return
-		}
-		yamlHdr := []byte("---\n# gostint vault secrets injected:\n")
-		secretsYAML = append(yamlHdr, secretsYAML...)
+	// Mask every value injected from the captured output
+	values := []string{token, jobToken, auth.Password, auth.Token}
+	collectValues(secrets, &values)
+	for _, e := range secretEnv {
+		values = append(values, e[strings.Index(e, "=")+1:])
+	}
+	for _, e := range entries {
+		values = append(values, string(e.Content))
+	}
+	job.redactor = redact.New(values)
 
-		entries = []TarEntry{
-			{Name: "secrets.yml", Content: secretsYAML},
-		}
-	} else if job.SecretFileType == "json" {
-		secretsJSON, err2 := json.Marshal(secrets)
-		if err2 != nil {
-			job.UpdateJob(bson.M{
-				"status": "failed",
-				"ended":  time.Now(),
-				"output": fmt.Sprintf("Failed to Marshal secrets to json for container injection: %s", err2),
-			})
-			return
-		}
-		entries = []TarEntry{
-			{Name: "secrets.json", Content: secretsJSON},
-		}
-	} else {
+	// Prepare secrets.yml|json|... for the container, with any secrets injected
+	// as files of their own
+	secretsFile, ok := secretrefs.SecretFiles[job.SecretFileType]
+	if !ok {
 		job.UpdateJob(bson.M{
 			"status": "failed",
 			"ended":  time.Now(),
@@ -945,8 +1768,7 @@ func (job *Job) runRequest() {
 		})
 		return
 	}
-
-	job.secretsRdr, err = createTar(&entries)
+	secretsContent, err := secretrefs.Encode(job.SecretFileType, secrets)
 	if err != nil {
 		job.UpdateJob(bson.M{
 			"status": "failed",
@@ -955,6 +1777,67 @@ func (job *Job) runRequest() {
 		})
 		return
 	}
+	// removed after the container (deferred below)
+	defer removeSecretsDir(job.ID.Hex())
+	if err = job.injectSecrets(jobToken, secretsFile, secretsContent, entries); err != nil {
+		job.UpdateJob(bson.M{
+			"status": "failed",
+			"ended":  time.Now(),
+			"output": err.Error(),
+		})
+		return
+	}
+
+	// A read-only rootfs cannot be copied into once its container is created
+	if job.Limits.ReadOnlyRootfs {
+		job.stagedImg, err = job.stageImage(ctx, cli, imgID)
+		if err != nil {
+			job.jobFailed("failed", err)
+			return
+		}
+		// removed after the container (deferred below)
+		defer removeImage(ctx, cli, job.stagedImg)
+	}
+
+	if err = job.setupNetwork(ctx, cli); err != nil {
+		job.jobFailed("failed", err)
+		return
+	}
+	// removed after the container (deferred below)
+	defer removeJobNetworks(ctx, cli, job.ID.Hex())
+
+	// Create Container, without running
+	job.secretEnv = secretEnv
+	containerBody, err := job.createDockerContainer(ctx, cli, imgID)
+	if err != nil {
+		job.jobFailed("failed", err)
+		return
+	}
+
+	job.UpdateJob(bson.M{
+		"container_id": containerBody.ID,
+	})
+	job.trackContainer(containerBody.ID)
+
+	logmsg.Info("Created container ID: %s", containerBody.ID)
+
+	// Automatically clean up the container
+	defer func() {
+		logmsg.Debug("Removing container %s", containerBody.ID)
+		rmOpts := types.ContainerRemoveOptions{
+			RemoveVolumes: true,
+			RemoveLinks:   false,
+			Force:         true,
+		}
+		if errD := cli.ContainerRemove(*ctx, containerBody.ID, rmOpts); errD != nil {
+			logmsg.Error("removing container: %s", errD)
+		}
+	}()
+
+	if job.dryRun != nil {
+		// the container is removed without being started (deferred above)
+		return
+	}
 
 	if job.KillRequested {
 		job.UpdateJob(bson.M{
@@ -965,6 +1848,14 @@ func (job *Job) runRequest() {
 		return
 	}
 
+	if state.GetState() == "stopping" {
+		// node is shutting down, container never started so Drain will requeue
+		job.UpdateJob(bson.M{
+			"container_id": "",
+		})
+		return
+	}
+
 	err = job.runContainer(ctx, cli, containerBody.ID)
 	if err != nil {
 		job.UpdateJob(bson.M{
@@ -976,14 +1867,42 @@ func (job *Job) runRequest() {
 	}
 }
 
-// Meta defines the format of the gostint.yml file
-type Meta struct {
-	ContainerImage string   `yaml:"container_image"`
-	SecretRefs     []string `yaml:"secret_refs"`
+// collectValues appends each string in the (nested) secret value to values.
+// Booleans and numbers, e.g. from secrets injected as maps, are left out, they
+// would mask unrelated output.
+func collectValues(v interface{}, values *[]string) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for _, e := range val {
+			collectValues(e, values)
+		}
+	case []interface{}:
+		for _, e := range val {
+			collectValues(e, values)
+		}
+	case string:
+		*values = append(*values, val)
+	}
 }
 
 func (job *Job) runContainer(ctx *context.Context, cli *client.Client, containerID string) error {
-	// Copy content into container prior to start it
+	// else copied into the staged image
+	if job.stagedImg == "" {
+		if err := job.copyToContainer(ctx, cli, containerID); err != nil {
+			return err
+		}
+	}
+
+	if err := cli.ContainerStart(*ctx, containerID, types.ContainerStartOptions{}); err != nil {
+		return err
+	}
+
+	return job.waitContainer(ctx, cli, containerID)
+}
+
+// copyToContainer copies the job's content, secrets and gostint user into its
+// container, prior to starting it
+func (job *Job) copyToContainer(ctx *context.Context, cli *client.Client, containerID string) error {
 	opts := types.CopyToContainerOptions{
 		AllowOverwriteDirWithFile: true,
 	}
@@ -992,19 +1911,25 @@ func (job *Job) runContainer(ctx *context.Context, cli *client.Client, container
 		return err
 	}
 
-	// Copy secrets into container prior to start it
 	err = cli.CopyToContainer(*ctx, containerID, "/", job.secretsRdr, opts)
 	if err != nil {
 		return err
 	}
 
-	err = addUser(*ctx, cli, containerID, "gostint", gostintUID, gostintGID, "/tmp")
-	if err != nil {
-		return err
-	}
+	return addUser(*ctx, cli, containerID, "gostint", gostintUID, gostintGID, "/tmp")
+}
 
-	if err = cli.ContainerStart(*ctx, containerID, types.ContainerStartOptions{}); err != nil {
-		return err
+// waitContainer waits for the job's container to exit, then records its
+// output and return code against the job.
+func (job *Job) waitContainer(ctx *context.Context, cli *client.Client, containerID string) error {
+	if timeout := job.timeout(); timeout > 0 {
+		// counted from when the job was started (popped) on a node
+		timer := time.AfterFunc(time.Until(job.Started.Add(timeout)), func() {
+			logmsg.Warn("job %s timed out after %s, stopping its container", job.ID.Hex(), timeout)
+			atomic.StoreInt32(&job.timedOut, 1)
+			stopContainer(*ctx, cli, containerID)
+		})
+		defer timer.Stop()
 	}
 
 	statusCh, errCh := cli.ContainerWait(*ctx, containerID, "")
@@ -1046,14 +1971,26 @@ func (job *Job) runContainer(ctx *context.Context, cli *client.Client, container
 	if status != 0 {
 		finalStatus = "failed"
 	}
+	output := job.redactor.Redact(buf.String())
+	stderr := job.redactor.Redact(buferr.String())
+	if job.redactor == nil {
+		// reattached after a gostint restart, the secrets injected into the job
+		// are no longer known so its output cannot be safely saved
+		output = withheldOutput
+		stderr = ""
+	}
+	if atomic.LoadInt32(&job.timedOut) == 1 {
+		finalStatus = "failed"
+		stderr += fmt.Sprintf("\ngostint: job timed out after %s\n", job.Timeout)
+	}
 	// logmsg.Warn("output:%v", buf.String())
 	// logmsg.Warn("stderr:%v", buferr.String())
 
 	job.UpdateJob(bson.M{
 		"status":      finalStatus,
 		"ended":       time.Now(),
-		"output":      buf.String(),
-		"stderr":      buferr.String(),
+		"output":      output,
+		"stderr":      stderr,
 		"return_code": status,
 	})
 
@@ -1113,8 +2050,12 @@ func addUser(ctx context.Context, cli *client.Client, containerID, name string,
 
 // TarEntry holds a tar file entity
 type TarEntry struct {
-	Name    string
-	Content []byte
+	Name     string
+	Content  []byte
+	Mode     int64 // defaults to 0444
+	UID      int
+	GID      int
+	Linkname string // makes the entry a symlink
 }
 
 func createTar(entries *[]TarEntry) (rdrClose io.Reader, err error) {
@@ -1124,9 +2065,19 @@ func createTar(entries *[]TarEntry) (rdrClose io.Reader, err error) {
 	for _, entry := range *entries {
 		hdr := &tar.Header{
 			Name: entry.Name,
-			Mode: 0444,
+			Mode: entry.Mode,
+			Uid:  entry.UID,
+			Gid:  entry.GID,
 			Size: int64(len(entry.Content)),
 		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0444
+		}
+		if entry.Linkname != "" {
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = entry.Linkname
+			hdr.Mode = 0777
+		}
 		if err = wtr.WriteHeader(hdr); err != nil {
 			return nil, fmt.Errorf("Failed to write %s to tar header for container injection: %s", entry.Name, err)
 		}
@@ -1157,21 +2108,24 @@ func (job *Job) kill() error {
 		"status": "stopping",
 	})
 
-	go func() {
-		timeout := time.Duration(15) * time.Second
+	go stopContainer(ctx, cli, job.ContainerID)
 
-		err = cli.ContainerStop(ctx, job.ContainerID, &timeout)
-		if err != nil {
-			logmsg.Error("Stop container %s request failed: %s", job.ContainerID, err)
-		}
+	return nil
+}
 
-		err = cli.ContainerKill(ctx, job.ContainerID, "KILL")
-		if err != nil {
-			if !strings.HasSuffix(err.Error(), "is not running") {
-				logmsg.Error("Kill container %s request failed: %s", job.ContainerID, err)
-			}
-		}
-	}()
+// stopContainer stops the container, killing it if it does not stop in time
+func stopContainer(ctx context.Context, cli *client.Client, containerID string) {
+	timeout := time.Duration(15) * time.Second
 
-	return nil
+	err := cli.ContainerStop(ctx, containerID, &timeout)
+	if err != nil {
+		logmsg.Error("Stop container %s request failed: %s", containerID, err)
+	}
+
+	err = cli.ContainerKill(ctx, containerID, "KILL")
+	if err != nil {
+		if !strings.HasSuffix(err.Error(), "is not running") {
+			logmsg.Error("Kill container %s request failed: %s", containerID, err)
+		}
+	}
 }
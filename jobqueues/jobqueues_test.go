@@ -0,0 +1,311 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package jobqueues
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gbevan/gostint/config"
+	"github.com/gbevan/gostint/mongotest"
+	"github.com/gbevan/gostint/state"
+	"github.com/globalsign/mgo/bson"
+	"github.com/hashicorp/vault/api"
+)
+
+// undrain resets the node to active and not draining when the test ends
+func undrain(t *testing.T) {
+	t.Cleanup(func() {
+		running.Lock()
+		running.draining = false
+		running.Unlock()
+		state.SetState("active")
+	})
+}
+
+func TestTrackRefusedOnceDraining(t *testing.T) {
+	undrain(t)
+
+	job := &Job{ID: bson.NewObjectId(), Fence: 1}
+	if !job.track() {
+		t.Fatal("track() refused a job before draining")
+	}
+	if RunningCount() != 1 {
+		t.Fatalf("RunningCount() = %d, want 1", RunningCount())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		Drain(time.Minute)
+		close(done)
+	}()
+
+	// wait for Drain to mark the node draining
+	for !isDraining() {
+		time.Sleep(time.Millisecond)
+	}
+	late := &Job{ID: bson.NewObjectId(), Fence: 2}
+	if late.track() {
+		t.Error("track() accepted a job while draining")
+	}
+
+	select {
+	case <-done:
+		t.Fatal("Drain returned while a job was running")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	job.untrack()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Drain did not return once the running job completed")
+	}
+	if RunningCount() != 0 {
+		t.Errorf("RunningCount() = %d, want 0", RunningCount())
+	}
+}
+
+func TestPoppedJobReleasedWhenDraining(t *testing.T) {
+	undrain(t)
+	state.SetState("active")
+
+	id := bson.NewObjectId()
+	u := &updates{}
+	session := fakeSession(t, func(req *mongotest.Request) []bson.M {
+		switch {
+		case req.Command == "distinct":
+			return []bson.M{{"values": []string{"q1"}, "ok": 1}}
+		case req.Command == "" && req.Collection == "queues":
+			return []bson.M{{"_id": id, "status": "queued"}}
+		case req.Doc["findAndModify"] == "counters":
+			return []bson.M{mongotest.Modified(bson.M{"_id": "fence", "seq": int64(9)})}
+		case req.Doc["findAndModify"] == "queues":
+			// the node begins draining between the pop and tracking the job
+			running.Lock()
+			running.draining = true
+			running.Unlock()
+			return []bson.M{mongotest.Modified(bson.M{"_id": id, "qname": "q1", "status": "running", "fence": int64(9)})}
+		}
+		return u.handler(1)(req)
+	})
+	useDb(t, session, &config.Config{PollInterval: config.Duration(time.Millisecond)})
+
+	done := make(chan struct{})
+	go func() {
+		requestHandler()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("requestHandler did not stop once draining")
+	}
+
+	if isTracked(id.Hex()) {
+		t.Error("job tracked while draining")
+	}
+	got := u.get()
+	if len(got) != 1 {
+		t.Fatalf("got %d updates, want the job's release", len(got))
+	}
+	q := got[0]["q"].(bson.M)
+	if q["_id"] != id || q["fence"] != int64(9) || q["status"] != "running" {
+		t.Errorf("release condition = %v, want the popped job", q)
+	}
+	upd := got[0]["u"].(bson.M)
+	if upd["$set"].(bson.M)["status"] != "queued" {
+		t.Errorf("release update = %v, want the job queued", upd)
+	}
+	if _, inc := upd["$inc"]; inc {
+		t.Errorf("release update = %v, counted an attempt", upd)
+	}
+}
+
+func TestDrainKeepsEndedJobs(t *testing.T) {
+	undrain(t)
+	ended, stuck := bson.NewObjectId(), bson.NewObjectId()
+	u := &updates{}
+	session := fakeSession(t, func(req *mongotest.Request) []bson.M {
+		switch {
+		case req.Command == "" && req.Doc["_id"] == ended:
+			// completed while its container was being stopped
+			return []bson.M{{"_id": ended, "status": "success", "node_uuid": "node-1", "fence": int64(3), "output": "done"}}
+		case req.Command == "" && req.Doc["_id"] == stuck:
+			return []bson.M{{"_id": stuck, "status": "running", "node_uuid": "node-1", "fence": int64(4)}}
+		case req.Doc["findAndModify"] == "counters":
+			return []bson.M{mongotest.Modified(bson.M{"_id": "fence", "seq": int64(9)})}
+		}
+		return u.handler(1)(req)
+	})
+	useDb(t, session, &config.Config{})
+	oldUUID := jobQueues.NodeUUID
+	jobQueues.NodeUUID = "node-1"
+	defer func() { jobQueues.NodeUUID = oldUUID }()
+
+	jobs := []*Job{{ID: ended, Fence: 3}, {ID: stuck, Fence: 4}}
+	for _, job := range jobs {
+		job.track()
+	}
+	go func() {
+		// the jobs' runRequests finish once their containers are stopped
+		for state.GetState() != "stopping" {
+			time.Sleep(time.Millisecond)
+		}
+		for _, job := range jobs {
+			job.untrack()
+		}
+	}()
+	Drain(time.Millisecond)
+
+	got := u.get()
+	if len(got) != 1 {
+		t.Fatalf("got %d updates, want 1 recovering the job still running", len(got))
+	}
+	if q := got[0]["q"].(bson.M); q["_id"] != stuck || q["status"] != "running" {
+		t.Errorf("recovery condition = %v, want the running job", q)
+	}
+}
+
+// fakeVault sets the vault client revoking job leases to one of a fake vault
+// server for the test, returning a func listing the paths requested.
+func fakeVault(t *testing.T) func() []string {
+	t.Helper()
+	var mutex sync.Mutex
+	paths := []string{}
+	vclient := vaultClient(t, func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		mutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	old := leaseClient
+	leaseClient = func() *api.Client { return vclient }
+	t.Cleanup(func() { leaseClient = old })
+	return func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string{}, paths...)
+	}
+}
+
+func TestRecoverRevokesLeases(t *testing.T) {
+	tests := []struct {
+		name    string
+		matched int
+		want    []string
+	}{
+		{"recovered", 1, []string{
+			"PUT /v1/sys/leases/revoke/database/creds/app/l1",
+			"PUT /v1/sys/leases/revoke/aws/creds/app/l2",
+		}},
+		{"already recovered", 0, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := fakeSession(t, func(req *mongotest.Request) []bson.M {
+				if req.Doc["findAndModify"] == "counters" {
+					return []bson.M{mongotest.Modified(bson.M{"_id": "fence", "seq": int64(9)})}
+				}
+				return (&updates{}).handler(tt.matched)(req)
+			})
+			useDb(t, session, &config.Config{})
+			paths := fakeVault(t)
+
+			job := &Job{
+				ID:            bson.NewObjectId(),
+				Status:        "running",
+				Fence:         4,
+				Authenticated: true,
+				ContainerID:   "c1",
+				LeaseIDs:      []string{"database/creds/app/l1", "aws/creds/app/l2"},
+			}
+			if err := job.Recover("node failed"); err != nil {
+				t.Fatal(err)
+			}
+			if got := paths(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("vault requests = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecoverUpdate(t *testing.T) {
+	pol := &config.QueuePolicy{MaxAttempts: 3}
+	idem := &config.QueuePolicy{Idempotent: true, MaxAttempts: 3}
+
+	tests := []struct {
+		name   string
+		job    Job
+		pol    *config.QueuePolicy
+		status string
+		output string
+	}{
+		{"not started", Job{}, pol, "queued", "Re-queued for attempt 2 of 3"},
+		{"not started, out of attempts", Job{Attempts: 2}, pol, "failed", "job has been attempted 3 times"},
+		{"authenticated", Job{Authenticated: true}, pol, "failed", "wrap_secret_id has already been used"},
+		{"authenticated idempotent", Job{Authenticated: true}, idem, "failed", "although idempotent"},
+		{"container started", Job{Authenticated: true, ContainerID: "c1"}, idem, "unknown", "wrap_secret_id has already been used"},
+		{"container of a job from before authenticated", Job{ContainerID: "c1", Idempotent: true}, pol, "unknown", "although idempotent"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.job.ID = bson.NewObjectId()
+			upd := tt.job.recoverUpdate(tt.pol, 42, "node failed")
+			set := upd["$set"].(bson.M)
+			if set["status"] != tt.status {
+				t.Errorf("status = %v, want %s", set["status"], tt.status)
+			}
+			if set["fence"] != int64(42) {
+				t.Errorf("fence = %v, want 42", set["fence"])
+			}
+			if out, _ := set["output"].(string); !strings.Contains(out, tt.output) || !strings.Contains(out, "node failed") {
+				t.Errorf("output = %q, want containing %q and the reason", out, tt.output)
+			}
+			_, inc := upd["$inc"]
+			if inc != (tt.status == "queued") {
+				t.Errorf("attempts incremented = %v for status %s", inc, tt.status)
+			}
+		})
+	}
+}
+
+func TestCollectValues(t *testing.T) {
+	values := []string{}
+	collectValues(map[string]interface{}{
+		"password": "s3cr3t-pw",
+		"port":     8080,
+		"tls":      true,
+		"ratio":    1.5,
+		"none":     nil,
+		"nested": map[string]interface{}{
+			"keys": []interface{}{"key-one", 1234, false},
+		},
+	}, &values)
+	sort.Strings(values)
+	if want := []string{"key-one", "s3cr3t-pw"}; !reflect.DeepEqual(values, want) {
+		t.Errorf("collectValues() = %v, want %v", values, want)
+	}
+}
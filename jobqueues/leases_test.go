@@ -0,0 +1,145 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package jobqueues
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gbevan/gostint/config"
+	"github.com/gbevan/gostint/mongotest"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// fakeSession returns a session to a fake db server passing requests to the
+// handler, both closed when the test ends (unless closed by the test).
+func fakeSession(t *testing.T, handler mongotest.Handler) *mgo.Session {
+	t.Helper()
+	srv := mongotest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	session, err := srv.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(session.Close)
+	return session
+}
+
+// useDb sets the db and config the package uses for the test, returning a
+// func swapping in another session, as on db credential rotation.
+func useDb(t *testing.T, session *mgo.Session, cfg *config.Config) func(*mgo.Session) {
+	t.Helper()
+	var mutex sync.Mutex
+	oldDb, oldCfg := jobQueues.Db, jobQueues.Cfg
+	jobQueues.Db = func() *mgo.Database {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return session.DB("gostint")
+	}
+	jobQueues.Cfg = cfg
+	t.Cleanup(func() { jobQueues.Db, jobQueues.Cfg = oldDb, oldCfg })
+	return func(s *mgo.Session) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		session = s
+	}
+}
+
+// updates records the first update statement of each update command
+type updates struct {
+	sync.Mutex
+	list []bson.M // {"q": ..., "u": ...}
+}
+
+func (u *updates) handler(n int) mongotest.Handler {
+	return func(req *mongotest.Request) []bson.M {
+		if req.Command != "update" {
+			return nil
+		}
+		stmts, _ := req.Doc["updates"].([]interface{})
+		u.Lock()
+		defer u.Unlock()
+		if len(stmts) > 0 {
+			u.list = append(u.list, stmts[0].(bson.M))
+		}
+		return []bson.M{mongotest.Written(n)}
+	}
+}
+
+func (u *updates) get() []bson.M {
+	u.Lock()
+	defer u.Unlock()
+	return append([]bson.M{}, u.list...)
+}
+
+func TestRenewLeasesAfterDbSwap(t *testing.T) {
+	oldUpdates, newUpdates := &updates{}, &updates{}
+	oldSession := fakeSession(t, oldUpdates.handler(1))
+	newSession := fakeSession(t, newUpdates.handler(1))
+	swap := useDb(t, oldSession, &config.Config{LeaseDuration: config.Duration(time.Minute)})
+
+	job := &Job{ID: bson.NewObjectId(), Fence: 7}
+	job.track()
+	defer job.untrack()
+
+	renewLeases()
+
+	// rotation swaps in the new session and (after a grace period) closes the
+	// old one, using it after that panics
+	swap(newSession)
+	oldSession.Close()
+	renewLeases()
+
+	if n := len(oldUpdates.get()); n != 1 {
+		t.Errorf("old session got %d renewals, want 1", n)
+	}
+	got := newUpdates.get()
+	if len(got) != 1 {
+		t.Fatalf("new session got %d renewals, want 1", len(got))
+	}
+	q := got[0]["q"].(bson.M)
+	if q["_id"] != job.ID || q["fence"] != int64(7) {
+		t.Errorf("renewal condition = %v, want the job's id and fence", q)
+	}
+	set := got[0]["u"].(bson.M)["$set"].(bson.M)
+	if exp, _ := set["lease_expires"].(time.Time); exp.Before(time.Now().Add(50 * time.Second)) {
+		t.Errorf("lease_expires = %v, want a lease duration from now", set["lease_expires"])
+	}
+}
+
+func TestRenewLeasesLost(t *testing.T) {
+	u := &updates{}
+	useDb(t, fakeSession(t, u.handler(0)), &config.Config{LeaseDuration: config.Duration(time.Minute)})
+
+	// taken over by another node, no container yet so nothing to stop
+	job := &Job{ID: bson.NewObjectId(), Fence: 7}
+	job.track()
+	defer job.untrack()
+
+	renewLeases()
+	if n := len(u.get()); n != 1 {
+		t.Errorf("got %d renewals, want 1", n)
+	}
+	if !isTracked(job.ID.Hex()) {
+		t.Error("lost job untracked, its runRequest still owns it")
+	}
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package jobqueues
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	units "github.com/docker/go-units"
+	"github.com/gbevan/gostint/config"
+)
+
+// resolveLimits resolves the limits of the job's container from its own, its
+// queue's and the node's container_limits. Resources default to the queue's
+// then the node's and may not exceed either, security settings required by
+// the queue or node cannot be relaxed.
+func (job *Job) resolveLimits(qp config.QueuePolicy) error {
+	node := jobQueues.Cfg.ContainerLimits
+	req := config.Limits{}
+	if job.Limits != nil {
+		req = *job.Limits
+	}
+	errs := req.Validate()
+	l := node.Override(&qp.Limits).Override(&req)
+
+	maxima := []struct {
+		field          string
+		v, queue, node float64
+		format         func(float64) string
+	}{
+		{"memory", float64(l.Memory), float64(qp.Limits.Memory), float64(node.Memory), units.BytesSize},
+		{"cpus", l.CPUs, qp.Limits.CPUs, node.CPUs, formatFloat},
+		{"pids_limit", float64(l.PidsLimit), float64(qp.Limits.PidsLimit), float64(node.PidsLimit), formatFloat},
+	}
+	for _, m := range maxima {
+		if m.queue > 0 && m.v > m.queue {
+			errs = append(errs, fmt.Sprintf("%s %s exceeds the queue's maximum of %s", m.field, m.format(m.v), m.format(m.queue)))
+		} else if m.node > 0 && m.v > m.node {
+			errs = append(errs, fmt.Sprintf("%s %s exceeds the node's maximum of %s", m.field, m.format(m.v), m.format(m.node)))
+		}
+	}
+
+	profiles := []struct {
+		field          string
+		v, queue, node string
+		set            *string
+	}{
+		{"seccomp_profile", req.SeccompProfile, qp.Limits.SeccompProfile, node.SeccompProfile, &l.SeccompProfile},
+		{"apparmor_profile", req.AppArmorProfile, qp.Limits.AppArmorProfile, node.AppArmorProfile, &l.AppArmorProfile},
+	}
+	for _, p := range profiles {
+		required, by := p.node, "node"
+		if required == "" {
+			required, by = p.queue, "queue"
+		}
+		switch {
+		case required != "":
+			if p.v != "" && p.v != required {
+				errs = append(errs, fmt.Sprintf("%s is required to be '%s' by the %s", p.field, required, by))
+			}
+			*p.set = required
+		case p.v == config.ProfileUnconfined:
+			errs = append(errs, fmt.Sprintf("%s cannot be %s", p.field, config.ProfileUnconfined))
+		}
+	}
+
+	mode, err := resolveNetworkMode(qp, node, req)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	l.NetworkMode = mode
+
+	if l.ReadOnlyRootfs && jobQueues.Cfg.SecretsTmpfsDir == "" {
+		errs = append(errs, "read_only_rootfs is not supported by this node, it needs secrets_tmpfs_dir")
+	}
+	if p := l.SeccompProfile; p != "" && p != config.ProfileDefault && p != config.ProfileUnconfined {
+		if _, err := jobQueues.Cfg.SeccompProfile(p); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Invalid limits: %s", strings.Join(errs, ", "))
+	}
+	job.Limits = &l
+	return nil
+}
+
+// CheckLimits checks the limits requested by the job against those of its
+// queue and this node, without changing the job.
+func (job *Job) CheckLimits() error {
+	j := Job{
+		Qname:  job.Qname,
+		Limits: job.Limits,
+	}
+	return j.resolveLimits(jobQueues.Cfg.QueuePolicyFor(job.Qname))
+}
+
+// hostLimits applies the job's resolved limits to its container's host config
+func (job *Job) hostLimits(hostCfg *container.HostConfig) error {
+	l := job.Limits
+	if l == nil {
+		return nil
+	}
+	hostCfg.Memory = int64(l.Memory)
+	hostCfg.NanoCPUs = int64(l.CPUs * 1e9)
+	hostCfg.PidsLimit = l.PidsLimit
+	hostCfg.CapDrop = l.CapDrop
+	if l.NoNewPrivileges {
+		hostCfg.SecurityOpt = append(hostCfg.SecurityOpt, "no-new-privileges")
+	}
+	switch l.SeccompProfile {
+	case "", config.ProfileDefault:
+	case config.ProfileUnconfined:
+		hostCfg.SecurityOpt = append(hostCfg.SecurityOpt, "seccomp=unconfined")
+	default:
+		profile, err := jobQueues.Cfg.SeccompProfile(l.SeccompProfile)
+		if err != nil {
+			return err
+		}
+		hostCfg.SecurityOpt = append(hostCfg.SecurityOpt, "seccomp="+string(profile))
+	}
+	switch l.AppArmorProfile {
+	case "", config.ProfileDefault:
+	default:
+		hostCfg.SecurityOpt = append(hostCfg.SecurityOpt, "apparmor="+l.AppArmorProfile)
+	}
+	if job.Network != nil {
+		hostCfg.NetworkMode = container.NetworkMode(job.Network.Name)
+	}
+	if l.ReadOnlyRootfs {
+		// the gostint user's home stays writable, with its vault token
+		hostCfg.ReadonlyRootfs = true
+		hostCfg.Mounts = append(hostCfg.Mounts,
+			mount.Mount{
+				Type:         mount.TypeTmpfs,
+				Target:       "/tmp",
+				TmpfsOptions: &mount.TmpfsOptions{Mode: 01777},
+			},
+			mount.Mount{
+				Type:     mount.TypeBind,
+				Source:   filepath.Join(secretsHostDir(job.ID.Hex()), "token"),
+				Target:   "/tmp/.vault-token",
+				ReadOnly: true,
+			},
+		)
+	}
+	return nil
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package jobqueues
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gbevan/gostint/config"
+)
+
+func withNodeLimits(t *testing.T, node config.Limits) {
+	t.Helper()
+	old := jobQueues.Cfg
+	jobQueues.Cfg = &config.Config{ContainerLimits: node}
+	t.Cleanup(func() { jobQueues.Cfg = old })
+}
+
+func TestResolveLimits(t *testing.T) {
+	node := config.Limits{
+		Memory:          2 << 30,
+		CPUs:            4,
+		CapDrop:         []string{"NET_RAW"},
+		NoNewPrivileges: true,
+	}
+	tests := []struct {
+		name  string
+		queue config.Limits
+		req   *config.Limits
+		want  config.Limits
+		err   string // error substring, "" for none
+	}{
+		{
+			name: "node defaults",
+			want: config.Limits{Memory: 2 << 30, CPUs: 4, CapDrop: []string{"NET_RAW"}, NoNewPrivileges: true, NetworkMode: "bridge"},
+		},
+		{
+			name:  "queue then request",
+			queue: config.Limits{Memory: 1 << 30, CapDrop: []string{"MKNOD"}},
+			req:   &config.Limits{CPUs: 0.5, CapDrop: []string{"NET_RAW"}},
+			want:  config.Limits{Memory: 1 << 30, CPUs: 0.5, CapDrop: []string{"NET_RAW", "MKNOD"}, NoNewPrivileges: true, NetworkMode: "bridge"},
+		},
+		{
+			name:  "exceeds queue",
+			queue: config.Limits{Memory: 1 << 30},
+			req:   &config.Limits{Memory: 1536 << 20},
+			err:   "memory 1.5GiB exceeds the queue's maximum of 1GiB",
+		},
+		{
+			name: "exceeds node",
+			req:  &config.Limits{CPUs: 8},
+			err:  "cpus 8 exceeds the node's maximum of 4",
+		},
+		{
+			name:  "required profile",
+			queue: config.Limits{AppArmorProfile: "gostint-jobs"},
+			req:   &config.Limits{AppArmorProfile: "other"},
+			err:   "apparmor_profile is required to be 'gostint-jobs' by the queue",
+		},
+		{
+			name: "unconfined",
+			req:  &config.Limits{SeccompProfile: config.ProfileUnconfined},
+			err:  "seccomp_profile cannot be unconfined",
+		},
+		{
+			name: "read only rootfs needs tmpfs",
+			req:  &config.Limits{ReadOnlyRootfs: true},
+			err:  "read_only_rootfs is not supported by this node",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withNodeLimits(t, node)
+			job := Job{Limits: tt.req}
+			err := job.resolveLimits(config.QueuePolicy{Limits: tt.queue})
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("resolveLimits() error = %v, want containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveLimits() error = %v", err)
+			}
+			got := *job.Limits
+			if got.Memory != tt.want.Memory || got.CPUs != tt.want.CPUs ||
+				got.NoNewPrivileges != tt.want.NoNewPrivileges || got.NetworkMode != tt.want.NetworkMode ||
+				strings.Join(got.CapDrop, ",") != strings.Join(tt.want.CapDrop, ",") {
+				t.Errorf("resolveLimits() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package jobqueues
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/gbevan/gostint/config"
+	"github.com/gbevan/gostint/logmsg"
+	"github.com/globalsign/mgo/bson"
+)
+
+// JobNetwork records the network a job's container was attached to
+type JobNetwork struct {
+	Mode   string `json:"mode"   bson:"mode"`
+	Name   string `json:"name"   bson:"name"`
+	ID     string `json:"id"     bson:"id,omitempty"`
+	Egress bool   `json:"egress" bson:"egress" description:"Whether the network allowed traffic out of the docker host"`
+}
+
+// resolveNetworkMode resolves the job's network mode from its request, its
+// queue's and the node's default. A job may choose a mode from its queue's
+// networks allow-list, or if it has none, a mode at least as restrictive as
+// the default. none set by the node is enforced.
+func resolveNetworkMode(qp config.QueuePolicy, node, req config.Limits) (string, error) {
+	def := resolveFirstStr([]string{qp.Limits.NetworkMode, node.NetworkMode, config.NetworkBridge})
+	if node.NetworkMode == config.NetworkNone {
+		def = config.NetworkNone
+	}
+	mode := req.NetworkMode
+	if mode == "" || mode == def {
+		return def, nil
+	}
+	if node.NetworkMode == config.NetworkNone {
+		return def, fmt.Errorf("network_mode is required to be %s by the node", config.NetworkNone)
+	}
+
+	if len(qp.Networks) > 0 {
+		for _, n := range qp.Networks {
+			if n == mode {
+				return mode, nil
+			}
+		}
+		return def, fmt.Errorf("network_mode '%s' is not in the queue's networks", mode)
+	}
+	rank, ok := config.NetworkRank[mode]
+	if !ok {
+		return def, fmt.Errorf("network '%s' is not in the queue's networks", mode)
+	}
+	if defRank, defOk := config.NetworkRank[def]; mode != config.NetworkNone && (!defOk || rank < defRank) {
+		return def, fmt.Errorf("network_mode '%s' is less restrictive than the queue's %s", mode, def)
+	}
+	return mode, nil
+}
+
+// setupNetwork creates the network dedicated to the job for the isolated and
+// internal modes, and records the network of the job's container.
+func (job *Job) setupNetwork(ctx *context.Context, cli *client.Client) error {
+	mode := config.NetworkBridge
+	if job.Limits != nil && job.Limits.NetworkMode != "" {
+		mode = job.Limits.NetworkMode
+	}
+	n := JobNetwork{
+		Mode: mode,
+		Name: mode,
+	}
+	switch mode {
+	case config.NetworkBridge:
+		n.Egress = true
+	case config.NetworkNone:
+	case config.NetworkIsolated, config.NetworkInternal:
+		n.Name = "gostint-" + job.ID.Hex()
+		resp, err := cli.NetworkCreate(*ctx, n.Name, types.NetworkCreate{
+			CheckDuplicate: true,
+			Driver:         "bridge",
+			Internal:       mode == config.NetworkInternal,
+			Labels: map[string]string{
+				labelJobID:    job.ID.Hex(),
+				labelNodeUUID: jobQueues.NodeUUID,
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("Failed creating the job's network: %s", err)
+		}
+		n.ID = resp.ID
+		n.Egress = mode == config.NetworkIsolated
+	default:
+		nw, err := cli.NetworkInspect(*ctx, mode, types.NetworkInspectOptions{})
+		if err != nil {
+			return fmt.Errorf("Failed inspecting network %s: %s", mode, err)
+		}
+		n.ID = nw.ID
+		n.Egress = !nw.Internal
+	}
+
+	job.Network = &n
+	job.UpdateJob(bson.M{
+		"network": job.Network,
+	})
+	return nil
+}
+
+// removeJobNetworks removes the networks created for the job
+func removeJobNetworks(ctx *context.Context, cli *client.Client, jobID string) {
+	networks, err := cli.NetworkList(*ctx, types.NetworkListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", labelJobID+"="+jobID)),
+	})
+	if err != nil {
+		logmsg.Error("listing networks of job %s: %s", jobID, err)
+		return
+	}
+	for _, nw := range networks {
+		if err = cli.NetworkRemove(*ctx, nw.ID); err != nil {
+			logmsg.Error("removing network %s: %s", nw.Name, err)
+		}
+	}
+}
+
+// reconcileNetworks removes the networks of jobs left by other instances of
+// gostint on this docker host that have stopped pinging, except those of jobs
+// this node has since reattached to.
+func reconcileNetworks(ctx *context.Context, cli *client.Client, alive map[string]bool) {
+	networks, err := cli.NetworkList(*ctx, types.NetworkListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", labelJobID)),
+	})
+	if err != nil {
+		logmsg.Error("Reconcile networks list failed: %s", err)
+		return
+	}
+	for _, nw := range networks {
+		jobID := nw.Labels[labelJobID]
+		nodeUUID := nw.Labels[labelNodeUUID]
+		if nodeUUID == jobQueues.NodeUUID || isTracked(jobID) {
+			continue
+		}
+		if _, ok := alive[nodeUUID]; !ok {
+			alive[nodeUUID] = nodeAlive(nodeUUID)
+		}
+		if alive[nodeUUID] {
+			continue
+		}
+		logmsg.Warn("Removing network %s of job %s left by gostint node %s", nw.Name, jobID, nodeUUID)
+		if err = cli.NetworkRemove(*ctx, nw.ID); err != nil {
+			logmsg.Error("removing network %s: %s", nw.Name, err)
+		}
+	}
+}
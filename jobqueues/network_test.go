@@ -0,0 +1,67 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package jobqueues
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gbevan/gostint/config"
+)
+
+func TestResolveNetworkMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		node     string
+		queue    string
+		networks []string
+		req      string
+		want     string
+		err      string // error substring, "" for none
+	}{
+		{name: "default bridge", want: "bridge"},
+		{name: "queue default", queue: "isolated", want: "isolated"},
+		{name: "more restrictive", queue: "isolated", req: "internal", want: "internal"},
+		{name: "none always allowed", req: "none", want: "none"},
+		{name: "less restrictive", queue: "internal", req: "bridge", want: "internal", err: "less restrictive than the queue's internal"},
+		{name: "named needs allow-list", req: "lab-net", want: "bridge", err: "not in the queue's networks"},
+		{name: "allow-listed", networks: []string{"lab-net", "bridge"}, queue: "isolated", req: "lab-net", want: "lab-net"},
+		{name: "not allow-listed", networks: []string{"lab-net"}, req: "internal", want: "bridge", err: "network_mode 'internal' is not in the queue's networks"},
+		{name: "node none enforced", node: "none", queue: "bridge", want: "none"},
+		{name: "node none refuses", node: "none", req: "isolated", want: "none", err: "required to be none by the node"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qp := config.QueuePolicy{
+				Limits:   config.Limits{NetworkMode: tt.queue},
+				Networks: tt.networks,
+			}
+			got, err := resolveNetworkMode(qp, config.Limits{NetworkMode: tt.node}, config.Limits{NetworkMode: tt.req})
+			if got != tt.want {
+				t.Errorf("resolveNetworkMode() = %s, want %s", got, tt.want)
+			}
+			if tt.err == "" && err != nil {
+				t.Errorf("resolveNetworkMode() error = %v", err)
+			} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("resolveNetworkMode() error = %v, want containing %q", err, tt.err)
+			}
+		})
+	}
+}
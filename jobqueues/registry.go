@@ -0,0 +1,213 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package jobqueues
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/gbevan/gostint/config"
+	"github.com/gbevan/gostint/imagepolicy"
+	"github.com/gbevan/gostint/logmsg"
+	"github.com/gbevan/gostint/secretrefs"
+	"github.com/gbevan/gostint/vaultsession"
+)
+
+// newRegistryResolver returns a resolver for registries' auth secret refs,
+// which are the node's (or queue's) configuration, so are read with gostint's
+// own vault token rather than the job's, from any backend.
+func newRegistryResolver() *secretrefs.Resolver {
+	allowed := []config.SecretBackend{}
+	for _, s := range config.SecretSchemes {
+		allowed = append(allowed, config.SecretBackend{Scheme: s})
+	}
+	return secretrefs.NewResolver(vaultsession.Client(), false, allowed)
+}
+
+// pullFromRegistry pulls the job's image, via its registry's mirror if it
+// has one, with the registry's credentials read by resolver. The credentials
+// are only passed to docker, never recorded on the job. It returns the
+// reference the pulled image is known by locally: its own name, except for
+// images pulled by digest from a mirror, which cannot be tagged with it.
+func (job *Job) pullFromRegistry(ctx *context.Context, cli *client.Client, resolver *secretrefs.Resolver, qp config.QueuePolicy, named reference.Named) (string, error) {
+	host := reference.Domain(named)
+	reg := jobQueues.Cfg.RegistryFor(qp, host)
+
+	if reg != nil && reg.Mirror != "" {
+		mirrored := reg.Mirror + strings.TrimPrefix(named.String(), host)
+		err := job.pullVia(ctx, cli, resolver, qp, mirrored, reg.Mirror)
+		if err == nil {
+			if _, isDigest := named.(reference.Canonical); isDigest {
+				return mirrored, nil
+			}
+			// so it is found by its own name
+			return named.String(), cli.ImageTag(*ctx, mirrored, named.String())
+		}
+		logmsg.Warn("Pull of %s from mirror %s failed, pulling from %s: %s", named, reg.Mirror, host, err)
+	}
+	return named.String(), job.pullVia(ctx, cli, resolver, qp, named.String(), host)
+}
+
+// pullVia pulls the image ref from the registry host
+func (job *Job) pullVia(ctx *context.Context, cli *client.Client, resolver *secretrefs.Resolver, qp config.QueuePolicy, imgRef, host string) error {
+	reg := jobQueues.Cfg.RegistryFor(qp, host)
+	if err := checkInsecure(ctx, cli, host, reg); err != nil {
+		return err
+	}
+	auth, err := registryAuth(resolver, host, reg)
+	if err != nil {
+		return err
+	}
+	encoded := ""
+	if auth != nil {
+		buf, err := json.Marshal(auth)
+		if err != nil {
+			return err
+		}
+		encoded = base64.URLEncoding.EncodeToString(buf)
+	}
+	return pullImage(ctx, cli, imgRef, encoded)
+}
+
+// verifyImage checks the job's pulled image, imgID, is signed as its queue's
+// image policy requires, reading its signatures from the image's registry
+func (job *Job) verifyImage(ctx *context.Context, cli *client.Client, resolver *secretrefs.Resolver, qp config.QueuePolicy, named reference.Named, imgID string) error {
+	if len(qp.Images.Keys()) == 0 {
+		return nil
+	}
+	digest, err := imageDigest(ctx, cli, imgID, named)
+	if err != nil {
+		return err
+	}
+	host := reference.Domain(named)
+	reg := jobQueues.Cfg.RegistryFor(qp, host)
+	auth, err := registryAuth(resolver, host, reg)
+	if err != nil {
+		return err
+	}
+	r := imagepolicy.Registry{
+		Host:     host,
+		Insecure: reg != nil && reg.Insecure,
+	}
+	if auth != nil {
+		r.Username = auth.Username
+		r.Password = auth.Password
+		r.Token = auth.RegistryToken
+	}
+	return imagepolicy.Verify(&qp.Images, named, digest, r)
+}
+
+// imageDigest returns the registry digest of the job's pulled image, image
+// being its ID
+func imageDigest(ctx *context.Context, cli *client.Client, image string, named reference.Named) (string, error) {
+	if c, ok := named.(reference.Canonical); ok {
+		return c.Digest().String(), nil
+	}
+	img, _, err := cli.ImageInspectWithRaw(*ctx, image)
+	if err != nil {
+		return "", err
+	}
+	for _, rd := range img.RepoDigests {
+		r, err := reference.ParseNormalizedNamed(rd)
+		if c, ok := r.(reference.Canonical); ok && err == nil && reference.Path(r) == reference.Path(named) {
+			return c.Digest().String(), nil
+		}
+	}
+	return "", &imagepolicy.Denied{Reason: fmt.Sprintf("Image %s (%s) has no registry digest, so its signature cannot be verified", reference.FamiliarString(named), image)}
+}
+
+// registryAuth resolves the registry's credentials, nil if it has none
+func registryAuth(resolver *secretrefs.Resolver, host string, reg *config.Registry) (*types.AuthConfig, error) {
+	if reg == nil || len(reg.Auth) == 0 {
+		return nil, nil
+	}
+	auth := types.AuthConfig{
+		ServerAddress: host,
+	}
+	for _, ref := range reg.Auth {
+		injs, err := resolver.Resolve(ref)
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading credentials for registry %s: %s", host, err)
+		}
+		for _, inj := range injs {
+			v, ok := inj.Value.(string)
+			if inj.As != secretrefs.AsValue || !ok {
+				return nil, fmt.Errorf("registry %s auth %s must be a string value", host, inj.Var)
+			}
+			switch inj.Var {
+			case "username":
+				auth.Username = v
+			case "password":
+				auth.Password = v
+			case "identitytoken":
+				auth.IdentityToken = v
+			case "registrytoken":
+				auth.RegistryToken = v
+			default:
+				return nil, fmt.Errorf("registry %s auth var must be username, password, identitytoken or registrytoken, got %s", host, inj.Var)
+			}
+		}
+	}
+	return &auth, nil
+}
+
+// checkInsecure refuses pulls from a registry the docker daemon treats as
+// insecure (by its insecure-registries), unless it is configured as insecure
+func checkInsecure(ctx *context.Context, cli *client.Client, host string, reg *config.Registry) error {
+	if reg != nil && reg.Insecure {
+		return nil
+	}
+	info, err := cli.Info(*ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to get docker info: %s", err)
+	}
+	if info.RegistryConfig == nil {
+		return nil
+	}
+
+	insecure := false
+	if idx, ok := info.RegistryConfig.IndexConfigs[host]; ok {
+		insecure = !idx.Secure
+	} else {
+		hostname := host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			hostname = h
+		}
+		ips, _ := net.LookupIP(hostname)
+		for _, ip := range ips {
+			for _, cidr := range info.RegistryConfig.InsecureRegistryCIDRs {
+				if (*net.IPNet)(cidr).Contains(ip) {
+					insecure = true
+				}
+			}
+		}
+	}
+	if insecure {
+		return fmt.Errorf("Registry %s is insecure and not allowed, configure it with insecure: true to allow it", host)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package jobqueues
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/gbevan/gostint/logmsg"
+)
+
+// stageImage prepares the image for a job with a read-only root filesystem,
+// which cannot be copied into once its container is created. The job's
+// content, secrets links and gostint user are copied into a staging container
+// of its image, which is committed as the image its container is created
+// from. Secrets themselves stay on the node's tmpfs. imgID is the job's
+// pulled (and verified) image.
+func (job *Job) stageImage(ctx *context.Context, cli *client.Client, imgID string) (string, error) {
+	cfg := container.Config{
+		Image:      imgID,
+		Cmd:        job.Run,
+		Entrypoint: job.EntryPoint,
+		Labels: map[string]string{
+			labelJobID:    job.ID.Hex(),
+			labelNodeUUID: jobQueues.NodeUUID,
+		},
+	}
+	resp, err := cli.ContainerCreate(*ctx, &cfg, &container.HostConfig{}, nil, "")
+	if err != nil {
+		return "", fmt.Errorf("Failed creating container to stage the job's image: %s", err)
+	}
+	defer func() {
+		rmOpts := types.ContainerRemoveOptions{
+			RemoveVolumes: true,
+			Force:         true,
+		}
+		if errD := cli.ContainerRemove(*ctx, resp.ID, rmOpts); errD != nil {
+			logmsg.Error("removing container: %s", errD)
+		}
+	}()
+
+	if err = job.copyToContainer(ctx, cli, resp.ID); err != nil {
+		return "", fmt.Errorf("Failed staging the job's image: %s", err)
+	}
+	img, err := cli.ContainerCommit(*ctx, resp.ID, types.ContainerCommitOptions{
+		Comment: "gostint job " + job.ID.Hex(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Failed committing the job's staged image: %s", err)
+	}
+	return img.ID, nil
+}
+
+// removeImage removes a job's staged image
+func removeImage(ctx *context.Context, cli *client.Client, imgID string) {
+	rmOpts := types.ImageRemoveOptions{
+		Force:         true,
+		PruneChildren: true,
+	}
+	if _, err := cli.ImageRemove(*ctx, imgID, rmOpts); err != nil {
+		logmsg.Error("removing staged image %s: %s", imgID, err)
+	}
+}
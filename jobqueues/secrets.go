@@ -0,0 +1,148 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package jobqueues
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/gbevan/gostint/logmsg"
+	"github.com/gbevan/gostint/secretrefs"
+	"github.com/globalsign/mgo/bson"
+)
+
+// secretsMount is where a job's secrets are mounted in its container, when
+// the node has a secrets_tmpfs_dir, keeping them off the docker host's disk.
+const secretsMount = "/run/gostint"
+
+// secretsHostDir returns the job's directory under the node's
+// secrets_tmpfs_dir, or "" if secrets are copied into the container instead.
+func secretsHostDir(jobID string) string {
+	if jobQueues.Cfg.SecretsTmpfsDir == "" || !bson.IsObjectIdHex(jobID) {
+		return ""
+	}
+	return filepath.Join(jobQueues.Cfg.SecretsTmpfsDir, jobID)
+}
+
+// removeSecretsDir removes the job's secrets from the tmpfs, if any
+func removeSecretsDir(jobID string) {
+	dir := secretsHostDir(jobID)
+	if dir == "" {
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		logmsg.Error("removing secrets of job %s: %s", jobID, err)
+	}
+}
+
+// secretsEnv returns the environment variables telling the job where to find
+// its secrets (and the vault token).
+func (job *Job) secretsEnv(token string) []string {
+	secretsFile := secretrefs.SecretFiles[job.SecretFileType]
+	if secretsHostDir(job.ID.Hex()) == "" {
+		return []string{
+			"VAULT_TOKEN=" + token,
+			"GOSTINT_SECRETS_FILE=/" + secretsFile,
+		}
+	}
+	env := []string{
+		"GOSTINT_SECRETS_DIR=" + secretsMount,
+		"GOSTINT_SECRETS_FILE=" + path.Join(secretsMount, secretsFile),
+		"GOSTINT_TOKEN_FILE=" + path.Join(secretsMount, "token"),
+	}
+	if jobQueues.Cfg.SecretsLegacyPaths {
+		env = append(env, "VAULT_TOKEN="+token)
+	}
+	return env
+}
+
+// injectSecrets prepares the job's secrets file, vault token and secrets
+// injected as files for its container. With a secrets_tmpfs_dir they are
+// written there, to be mounted at /run/gostint, and only symlinks to them
+// are copied into the container (the vault cli's ~/.vault-token, and the
+// original paths if secrets_legacy_paths), otherwise they are all copied in.
+func (job *Job) injectSecrets(token string, secretsFile string, secretsContent []byte, files []TarEntry) error {
+	size := len(token) + len(secretsContent)
+	for _, f := range files {
+		size += len(f.Content)
+	}
+	if size > jobQueues.Cfg.SecretsMaxSize {
+		return fmt.Errorf("Secrets for the job total %d bytes, exceeding the node's secrets_max_size of %d", size, jobQueues.Cfg.SecretsMaxSize)
+	}
+
+	var err error
+	dir := secretsHostDir(job.ID.Hex())
+	if dir == "" {
+		entries := append(files, TarEntry{Name: secretsFile, Content: secretsContent})
+		job.secretsRdr, err = createTar(&entries)
+		return err
+	}
+
+	links := []TarEntry{
+		{Name: "tmp/.vault-token", Linkname: path.Join(secretsMount, "token")},
+	}
+	toWrite := []TarEntry{
+		{Name: secretsFile, Content: secretsContent},
+		{Name: "token", Content: []byte(token)},
+	}
+	if jobQueues.Cfg.SecretsLegacyPaths {
+		links = append(links, TarEntry{Name: secretsFile, Linkname: path.Join(secretsMount, secretsFile)})
+	}
+	for _, f := range files {
+		links = append(links, TarEntry{Name: f.Name, Linkname: path.Join(secretsMount, "files", f.Name)})
+		f.Name = path.Join("files", f.Name)
+		toWrite = append(toWrite, f)
+	}
+
+	for _, f := range toWrite {
+		if err = writeSecretFile(dir, f); err != nil {
+			return err
+		}
+	}
+	job.secretsRdr, err = createTar(&links)
+	return err
+}
+
+// writeSecretFile writes the entry under dir. Its files are owned by gostint,
+// which may not be privileged to chown them, so the entry's owner permissions
+// are given to gostint's group instead, which the job's user is added to (by
+// default readable only by them).
+func writeSecretFile(dir string, f TarEntry) error {
+	name := filepath.Join(dir, filepath.FromSlash(f.Name))
+	if err := os.MkdirAll(filepath.Dir(name), 0750); err != nil {
+		return fmt.Errorf("Failed to create secrets directory for %s: %s", f.Name, err)
+	}
+
+	mode := os.FileMode(f.Mode)
+	if mode == 0 {
+		mode = secretrefs.DefaultFileMode
+	}
+	mode |= (mode & 0700) >> 3
+	if err := ioutil.WriteFile(name, f.Content, 0600); err != nil {
+		return fmt.Errorf("Failed to write secrets file %s: %s", f.Name, err)
+	}
+	if err := os.Chmod(name, mode); err != nil {
+		return fmt.Errorf("Failed to set mode of secrets file %s: %s", f.Name, err)
+	}
+	return nil
+}
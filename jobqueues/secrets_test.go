@@ -0,0 +1,64 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package jobqueues
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteSecretFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gostint-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		entry TarEntry
+		want  os.FileMode
+	}{
+		{TarEntry{Name: "secrets.yml", Content: []byte("a: b\n")}, 0440},
+		{TarEntry{Name: "files/etc/ca.pem", Content: []byte("ca"), Mode: 0644, UID: 1, GID: 1}, 0664},
+		{TarEntry{Name: "files/bin/run", Content: []byte("x"), Mode: 0500}, 0550},
+	}
+	for _, tt := range tests {
+		t.Run(tt.entry.Name, func(t *testing.T) {
+			// owners other than gostint are not applied, so no privilege is needed
+			if err := writeSecretFile(dir, tt.entry); err != nil {
+				t.Fatal(err)
+			}
+			name := filepath.Join(dir, filepath.FromSlash(tt.entry.Name))
+			fi, err := os.Stat(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != tt.want {
+				t.Errorf("mode = %o, want %o", fi.Mode().Perm(), tt.want)
+			}
+			data, _ := ioutil.ReadFile(name)
+			if string(data) != string(tt.entry.Content) {
+				t.Errorf("content = %q, want %q", data, tt.entry.Content)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package jobqueues
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gbevan/gostint/config"
+	"github.com/gbevan/gostint/logmsg"
+	"github.com/hashicorp/vault/api"
+)
+
+// resolveTimeout sets the job's timeout from its request or queue policy,
+// returning it (0 for none). A job may not exceed its queue's timeout.
+func (job *Job) resolveTimeout(qp config.QueuePolicy) (time.Duration, error) {
+	if job.Timeout == "" {
+		if qp.Timeout == 0 {
+			return 0, nil
+		}
+		job.Timeout = qp.Timeout.D().String()
+	}
+	d, err := time.ParseDuration(job.Timeout)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("Invalid timeout '%s', must be a positive duration e.g. 30m", job.Timeout)
+	}
+	if qp.Timeout > 0 && d > qp.Timeout.D() {
+		return 0, fmt.Errorf("Timeout %s exceeds the queue's maximum of %s", d, qp.Timeout.D())
+	}
+	return d, nil
+}
+
+// timeout returns the job's resolved timeout, 0 for none
+func (job *Job) timeout() time.Duration {
+	d, err := time.ParseDuration(job.Timeout)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// resolveVaultPolicies sets the policies for the job's vault token from its
+// request or queue policy, a job may only request policies its queue allows.
+func (job *Job) resolveVaultPolicies(qp config.QueuePolicy) error {
+	if len(job.VaultPolicies) == 0 {
+		job.VaultPolicies = qp.VaultPolicies
+		return nil
+	}
+	if len(qp.VaultPolicies) == 0 {
+		return nil // vault limits them to the AppRole's
+	}
+	allowed := map[string]bool{}
+	for _, p := range qp.VaultPolicies {
+		allowed[p] = true
+	}
+	for _, p := range job.VaultPolicies {
+		if !allowed[p] {
+			return fmt.Errorf("Vault policy '%s' is not allowed for jobs on queue %s", p, job.Qname)
+		}
+	}
+	return nil
+}
+
+// createJobToken mints the vault token given to the job's container, from the
+// job's AppRole token, rather than handing over the AppRole token itself. Its
+// ttl is the job's timeout (or job_token_ttl), and cannot be extended. The
+// token's accessor is returned with it, for revoking it later.
+func (job *Job) createJobToken(vclient *api.Client, qp config.QueuePolicy, timeout time.Duration) (string, string, error) {
+	ttl := timeout
+	if ttl == 0 {
+		ttl = jobQueues.Cfg.JobTokenTTL.D()
+	}
+	renewable := false
+	req := api.TokenCreateRequest{
+		Policies:       job.VaultPolicies,
+		TTL:            fmt.Sprintf("%ds", int(ttl.Seconds())),
+		ExplicitMaxTTL: fmt.Sprintf("%ds", int(ttl.Seconds())),
+		NumUses:        qp.VaultTokenNumUses,
+		Renewable:      &renewable,
+		DisplayName:    "gostint-job-" + job.ID.Hex(),
+		Metadata: map[string]string{
+			"job_id": job.ID.Hex(),
+			"qname":  job.Qname,
+		},
+	}
+
+	var secret *api.Secret
+	var err error
+	if jobQueues.Cfg.JobTokenOrphan {
+		secret, err = vclient.Auth().Token().CreateOrphan(&req)
+	} else {
+		secret, err = vclient.Auth().Token().Create(&req)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to create the job's vault token: %s", err)
+	}
+	if secret == nil || secret.Auth == nil {
+		return "", "", fmt.Errorf("Failed to create the job's vault token: no auth returned")
+	}
+	return secret.Auth.ClientToken, secret.Auth.Accessor, nil
+}
+
+// revokeJobToken revokes the job's vault token by its accessor, once its
+// container has exited. This uses the AppRole token (vclient), as the job's
+// token cannot revoke itself once its num_uses have been used up.
+func revokeJobToken(vclient *api.Client, accessor string) {
+	if err := vclient.Auth().Token().RevokeAccessor(accessor); err != nil {
+		logmsg.Warn("revoking job token: %s", err)
+	}
+}
@@ -0,0 +1,233 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package jobqueues
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gbevan/gostint/config"
+	"github.com/globalsign/mgo/bson"
+	"github.com/hashicorp/vault/api"
+)
+
+// vaultClient returns a client, with the AppRole's token, of a fake vault
+// server handling requests with handler.
+func vaultClient(t *testing.T, handler http.HandlerFunc) *api.Client {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	vclient, err := api.NewClient(&api.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vclient.SetToken("approle-token")
+	return vclient
+}
+
+// useCfg sets the config the package uses for the test
+func useCfg(t *testing.T, cfg *config.Config) {
+	t.Helper()
+	old := jobQueues.Cfg
+	jobQueues.Cfg = cfg
+	t.Cleanup(func() { jobQueues.Cfg = old })
+}
+
+// vaultRequest is a request received by a fake vault server
+type vaultRequest struct {
+	Method string
+	Path   string
+	Token  string
+	Body   map[string]interface{}
+}
+
+// recordingVault returns a client of a fake vault server recording its
+// requests and replying to each with reply, and a func listing the requests.
+func recordingVault(t *testing.T, reply string) (*api.Client, func() []vaultRequest) {
+	t.Helper()
+	var mutex sync.Mutex
+	reqs := []vaultRequest{}
+	vclient := vaultClient(t, func(w http.ResponseWriter, r *http.Request) {
+		vr := vaultRequest{Method: r.Method, Path: r.URL.Path, Token: r.Header.Get("X-Vault-Token")}
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &vr.Body)
+		mutex.Lock()
+		reqs = append(reqs, vr)
+		mutex.Unlock()
+		if reply == "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(reply))
+	})
+	return vclient, func() []vaultRequest {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]vaultRequest{}, reqs...)
+	}
+}
+
+func TestResolveTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout string
+		qp      config.QueuePolicy
+		want    time.Duration
+		err     string
+	}{
+		{"none", "", config.QueuePolicy{}, 0, ""},
+		{"job's", "30m", config.QueuePolicy{}, 30 * time.Minute, ""},
+		{"queue's", "", config.QueuePolicy{Timeout: config.Duration(time.Hour)}, time.Hour, ""},
+		{"within the queue's", "30m", config.QueuePolicy{Timeout: config.Duration(time.Hour)}, 30 * time.Minute, ""},
+		{"exceeds the queue's", "2h", config.QueuePolicy{Timeout: config.Duration(time.Hour)}, 0, "exceeds the queue's maximum of 1h0m0s"},
+		{"invalid", "soon", config.QueuePolicy{}, 0, "Invalid timeout 'soon'"},
+		{"negative", "-1m", config.QueuePolicy{}, 0, "must be a positive duration"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := &Job{Timeout: tt.timeout}
+			d, err := job.resolveTimeout(tt.qp)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("resolveTimeout() error = %v, want containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || d != tt.want {
+				t.Errorf("resolveTimeout() = %s, %v, want %s", d, err, tt.want)
+			}
+			if d > 0 && job.timeout() != d {
+				t.Errorf("timeout() = %s after resolving %s", job.timeout(), d)
+			}
+		})
+	}
+}
+
+func TestResolveVaultPolicies(t *testing.T) {
+	tests := []struct {
+		name     string
+		policies []string
+		allowed  []string
+		want     []string
+		err      string
+	}{
+		{"queue's", nil, []string{"read-kv"}, []string{"read-kv"}, ""},
+		{"any, left to vault", []string{"admin"}, nil, []string{"admin"}, ""},
+		{"allowed", []string{"read-kv"}, []string{"read-kv", "read-db"}, []string{"read-kv"}, ""},
+		{"not allowed", []string{"read-kv", "admin"}, []string{"read-kv"}, nil, "Vault policy 'admin' is not allowed for jobs on queue play"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := &Job{Qname: "play", VaultPolicies: tt.policies}
+			err := job.resolveVaultPolicies(config.QueuePolicy{VaultPolicies: tt.allowed})
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("resolveVaultPolicies() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(job.VaultPolicies, tt.want) {
+				t.Errorf("resolveVaultPolicies() = %v, %v, want %v", job.VaultPolicies, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateJobToken(t *testing.T) {
+	const reply = `{"auth": {"client_token": "s.job", "accessor": "acc-1"}}`
+	tests := []struct {
+		name    string
+		orphan  bool
+		timeout time.Duration
+		path    string
+		ttl     string
+	}{
+		{"child", false, 10 * time.Minute, "/v1/auth/token/create", "600s"},
+		{"orphan", true, 10 * time.Minute, "/v1/auth/token/create-orphan", "600s"},
+		{"no timeout", false, 0, "/v1/auth/token/create", "1200s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCfg(t, &config.Config{JobTokenTTL: config.Duration(20 * time.Minute), JobTokenOrphan: tt.orphan})
+			vclient, reqs := recordingVault(t, reply)
+			job := &Job{ID: bson.NewObjectId(), Qname: "play", VaultPolicies: []string{"read-kv"}}
+
+			token, accessor, err := job.createJobToken(vclient, config.QueuePolicy{VaultTokenNumUses: 5}, tt.timeout)
+			if err != nil || token != "s.job" || accessor != "acc-1" {
+				t.Fatalf("createJobToken() = %q, %q, %v", token, accessor, err)
+			}
+			got := reqs()
+			if len(got) != 1 || got[0].Path != tt.path || got[0].Token != "approle-token" {
+				t.Fatalf("requests = %+v, want one to %s with the AppRole token", got, tt.path)
+			}
+			body := got[0].Body
+			want := map[string]interface{}{
+				"policies":         []interface{}{"read-kv"},
+				"ttl":              tt.ttl,
+				"explicit_max_ttl": tt.ttl,
+				"num_uses":         float64(5),
+				"renewable":        false,
+				"display_name":     "gostint-job-" + job.ID.Hex(),
+				"meta":             map[string]interface{}{"job_id": job.ID.Hex(), "qname": "play"},
+			}
+			for k, v := range want {
+				if !reflect.DeepEqual(body[k], v) {
+					t.Errorf("request %s = %#v, want %#v", k, body[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateJobTokenNoAuth(t *testing.T) {
+	useCfg(t, &config.Config{JobTokenTTL: config.Duration(time.Minute)})
+	vclient, _ := recordingVault(t, `{"data": {}}`)
+	job := &Job{ID: bson.NewObjectId()}
+	if _, _, err := job.createJobToken(vclient, config.QueuePolicy{}, 0); err == nil || !strings.Contains(err.Error(), "no auth returned") {
+		t.Errorf("createJobToken() error = %v, want no auth returned", err)
+	}
+}
+
+func TestRevokeJobToken(t *testing.T) {
+	vclient, reqs := recordingVault(t, "")
+	revokeJobToken(vclient, "acc-1")
+
+	got := reqs()
+	if len(got) != 1 {
+		t.Fatalf("requests = %+v, want one", got)
+	}
+	want := vaultRequest{
+		Method: "POST",
+		Path:   "/v1/auth/token/revoke-accessor",
+		Token:  "approle-token",
+		Body:   map[string]interface{}{"accessor": "acc-1"},
+	}
+	if !reflect.DeepEqual(got[0], want) {
+		t.Errorf("request = %+v, want %+v", got[0], want)
+	}
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package jobqueues
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/gbevan/gostint/content"
+	"github.com/gbevan/gostint/imagepolicy"
+	"github.com/gbevan/gostint/meta"
+	"github.com/gbevan/gostint/secretrefs"
+)
+
+// Validation is the result of validating a job request without running it
+type Validation struct {
+	Valid   bool              `json:"valid"`
+	Errors  []string          `json:"errors"`
+	Notes   []string          `json:"notes"`
+	Job     *meta.Meta        `json:"job"`
+	Sources map[string]string `json:"sources" description:"Layer each field was taken from"`
+}
+
+// Validate resolves a job request's meta data from its content and the
+// request, as the node running it would, without running it. What only the
+// running node can see (the encrypted payload, encrypted or authenticated
+// content and the image's gostint_image.yml) is reported in the notes.
+func (job *Job) Validate() *Validation {
+	v := Validation{
+		Errors: []string{},
+		Notes:  []string{},
+	}
+	if job.Payload != "" || job.CubbyToken != "" {
+		v.Notes = append(v.Notes, "the encrypted payload is only decrypted by the node running the job, so is not validated")
+	}
+
+	contentMeta, err := job.validateContent(&v)
+	if err != nil {
+		v.Errors = append(v.Errors, err.Error())
+	}
+	requestMeta := job.requestMeta()
+	for _, e := range requestMeta.Validate(meta.LayerRequest) {
+		v.Errors = append(v.Errors, "request: "+e)
+	}
+	v.Job, v.Sources = meta.Merge(
+		meta.Layer{Name: meta.LayerContent, Meta: contentMeta},
+		meta.Layer{Name: meta.LayerRequest, Meta: requestMeta},
+	)
+	v.Notes = append(v.Notes, fmt.Sprintf("the image's %s is read when the job runs, it may add env_vars and secret_refs and set fields not set here", meta.ImageFile))
+
+	// as resolved for the job's queue
+	qp := jobQueues.Cfg.QueuePolicyFor(job.Qname)
+	if v.Job.ContainerImage == "" {
+		v.Errors = append(v.Errors, "container_image is required, in the request or content")
+	} else if named, err := reference.ParseNormalizedNamed(v.Job.ContainerImage); err != nil {
+		v.Errors = append(v.Errors, fmt.Sprintf("Invalid container_image '%s': %s", v.Job.ContainerImage, err))
+	} else if err = imagepolicy.Check(&qp.Images, reference.TagNameOnly(named)); err != nil {
+		v.Errors = append(v.Errors, err.Error())
+	}
+	if len(qp.Images.Keys()) > 0 {
+		v.Notes = append(v.Notes, "the image's signature is verified by the node running the job, after pulling it")
+	}
+	resolved := Job{
+		Qname:         job.Qname,
+		Timeout:       v.Job.Timeout,
+		VaultPolicies: v.Job.VaultPolicies,
+		Limits:        v.Job.Limits,
+	}
+	if _, err = resolved.resolveTimeout(qp); err != nil {
+		v.Errors = append(v.Errors, err.Error())
+	}
+	if err = resolved.resolveVaultPolicies(qp); err != nil {
+		v.Errors = append(v.Errors, err.Error())
+	}
+	if err = resolved.resolveLimits(qp); err != nil {
+		v.Errors = append(v.Errors, err.Error())
+	}
+	v.Job.Timeout = resolved.Timeout
+	v.Job.VaultPolicies = resolved.VaultPolicies
+	v.Job.Limits = resolved.Limits
+
+	// secret refs are parsed, not read
+	resolver := secretrefs.NewResolver(nil, false, qp.SecretBackendsFor())
+	for _, ref := range append(append([]string{}, job.ContentAuth...), v.Job.SecretRefs...) {
+		if _, err = resolver.Parse(ref); err != nil {
+			v.Errors = append(v.Errors, err.Error())
+		}
+	}
+
+	v.Valid = len(v.Errors) == 0
+	return &v
+}
+
+// validateContent returns the meta data of the job's content, if it can be
+// read without the job's vault token.
+func (job *Job) validateContent(v *Validation) (*meta.Meta, error) {
+	if job.Content == "" {
+		return nil, nil
+	}
+	if content.IsRemote(job.Content) && len(job.ContentAuth) > 0 {
+		v.Notes = append(v.Notes, "content needing content_auth is only fetched by the node running the job, so is not validated")
+		return nil, nil
+	}
+	if strings.HasPrefix(job.Content, "ref,") {
+		sum := strings.TrimPrefix(strings.TrimPrefix(job.Content, "ref,"), content.RefPrefix)
+		blob, err := content.GetBlob(sum)
+		if err != nil {
+			return nil, err
+		}
+		if !blob.UsableBy(job.SubmittedBy) {
+			return nil, fmt.Errorf("Content ref %s%s was not uploaded by the job's submitter, only encrypted content may be shared", content.RefPrefix, sum)
+		}
+		if blob.Encrypted {
+			v.Notes = append(v.Notes, "encrypted content is only decrypted by the node running the job, so is not validated")
+			return nil, nil
+		}
+		_, data, err := content.Load(sum)
+		if err != nil {
+			return nil, err
+		}
+		arc, err := content.Normalise(blob.Format, data)
+		if err != nil {
+			return nil, err
+		}
+		return archiveMeta(arc)
+	}
+
+	arc, err := job.loadContent(nil, nil)
+	if arc == nil || err != nil {
+		return nil, err
+	}
+	return archiveMeta(arc)
+}
+
+// archiveMeta returns the meta data of a content archive, closing it
+func archiveMeta(arc *content.Archive) (*meta.Meta, error) {
+	defer arc.Close()
+	if arc.Meta == nil {
+		return nil, nil
+	}
+	return meta.Parse(meta.LayerContent, arc.Meta)
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package leader
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gbevan/gostint/config"
+	"github.com/gbevan/gostint/logmsg"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Leader election for singleton cluster duties (e.g. the stale node sweep and
+// job retention purge), using a lock document with an expiry (TTL) in the
+// "locks" collection. The leader renews the lock every third of the TTL, if it
+// fails to for a whole TTL another node takes over. Node clocks are assumed to
+// agree to well within the TTL.
+
+const lockID = "leader"
+
+// Leader holds module state
+type Leader struct {
+	Db       func() *mgo.Database
+	Cfg      *config.Config
+	NodeUUID string
+
+	mutex   sync.Mutex
+	leader  bool
+	expires time.Time // local view of when our leadership lapses
+	stop    chan struct{}
+	done    chan struct{} // closed when the election interval has stopped
+}
+
+type lock struct {
+	ID      string    `bson:"_id"`
+	Holder  string    `bson:"holder"`
+	Expires time.Time `bson:"expires"`
+}
+
+var (
+	leader Leader
+
+	leaderGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "gostint_leader",
+		Help: "1 if this gostint node is the cluster leader, else 0.",
+	})
+)
+
+// Init starts taking part in leader election
+func Init(db func() *mgo.Database, cfg *config.Config, nodeUUID string) {
+	leader.Db = db
+	leader.Cfg = cfg
+	leader.NodeUUID = nodeUUID
+	leader.stop = make(chan struct{})
+	leader.done = make(chan struct{})
+
+	// let mongodb clean up locks long expired
+	err := db().C("locks").EnsureIndex(mgo.Index{
+		Key:         []string{"expires"},
+		ExpireAfter: cfg.LeaderTTL.D(),
+	})
+	if err != nil {
+		logmsg.Error("Failed to create locks ttl index: %s", err)
+	}
+
+	elect()
+	go interval()
+}
+
+// IsLeader returns true if this node currently holds the leadership
+func IsLeader() bool {
+	leader.mutex.Lock()
+	defer leader.mutex.Unlock()
+	return leader.leader && time.Now().Before(leader.expires)
+}
+
+// Holder returns the node uuid of the current leader, if any
+func Holder() (string, error) {
+	var l lock
+	err := leader.Db().C("locks").Find(bson.M{
+		"_id":     lockID,
+		"expires": bson.M{"$gte": time.Now()},
+	}).One(&l)
+	if err == mgo.ErrNotFound {
+		return "", nil
+	}
+	return l.Holder, err
+}
+
+// Resign gives up leadership (if held) and stops taking part in elections,
+// for a clean shutdown. It waits for any election in progress, which could
+// otherwise take the lock back once removed.
+func Resign() error {
+	close(leader.stop)
+	<-leader.done
+	leader.set(false, time.Time{})
+	err := leader.Db().C("locks").Remove(bson.M{
+		"_id":    lockID,
+		"holder": leader.NodeUUID,
+	})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (l *Leader) set(isLeader bool, expires time.Time) {
+	l.mutex.Lock()
+	was := l.leader
+	l.leader = isLeader
+	l.expires = expires
+	l.mutex.Unlock()
+
+	if isLeader != was {
+		if isLeader {
+			logmsg.Info("This node is now the cluster leader")
+			leaderGauge.Set(1)
+		} else {
+			logmsg.Info("This node is no longer the cluster leader")
+			leaderGauge.Set(0)
+		}
+	}
+}
+
+// elect acquires or renews the leader lock
+func elect() {
+	c := leader.Db().C("locks")
+	now := time.Now()
+	expires := now.Add(leader.Cfg.LeaderTTL.D())
+
+	err := c.Update(
+		bson.M{
+			"_id": lockID,
+			"$or": []bson.M{
+				{"holder": leader.NodeUUID},
+				{"expires": bson.M{"$lt": now}},
+			},
+		},
+		bson.M{"$set": bson.M{
+			"holder":  leader.NodeUUID,
+			"expires": expires,
+		}},
+	)
+	if err == mgo.ErrNotFound {
+		// no lock yet, or held by another node
+		err = c.Insert(lock{
+			ID:      lockID,
+			Holder:  leader.NodeUUID,
+			Expires: expires,
+		})
+		if mgo.IsDup(err) {
+			leader.set(false, time.Time{})
+			return
+		}
+	}
+	if err != nil {
+		// keep any leadership until it lapses, the next attempt may succeed
+		logmsg.Error("Leader election failed: %s", err)
+		return
+	}
+	leader.set(true, expires)
+}
+
+func interval() {
+	defer close(leader.done)
+	for {
+		select {
+		case <-leader.stop:
+			return
+		case <-time.After(leader.Cfg.LeaderTTL.D() / 3):
+		}
+		elect()
+	}
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package leader
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gbevan/gostint/config"
+	"github.com/gbevan/gostint/mongotest"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// fakeLocks is a locks collection holding at most the leader lock, served by
+// a fake db server applying the conditions elect, Holder and Resign use
+type fakeLocks struct {
+	sync.Mutex
+	lock bson.M // nil if none
+}
+
+func (f *fakeLocks) handler(req *mongotest.Request) []bson.M {
+	f.Lock()
+	defer f.Unlock()
+	switch req.Command {
+	case "":
+		gte := req.Doc["expires"].(bson.M)["$gte"].(time.Time)
+		if f.lock == nil || f.lock["expires"].(time.Time).Before(gte) {
+			return nil
+		}
+		return []bson.M{f.lock}
+	case "update":
+		stmt := req.Doc["updates"].([]interface{})[0].(bson.M)
+		if f.lock == nil || !f.matchesOr(stmt["q"].(bson.M)) {
+			return []bson.M{mongotest.Written(0)}
+		}
+		for k, v := range stmt["u"].(bson.M)["$set"].(bson.M) {
+			f.lock[k] = v
+		}
+		return []bson.M{mongotest.Written(1)}
+	case "insert":
+		if f.lock != nil {
+			return []bson.M{mongotest.Duplicate()}
+		}
+		f.lock = req.Doc["documents"].([]interface{})[0].(bson.M)
+		return []bson.M{mongotest.Written(1)}
+	case "delete":
+		q := req.Doc["deletes"].([]interface{})[0].(bson.M)["q"].(bson.M)
+		if f.lock == nil || f.lock["holder"] != q["holder"] {
+			return []bson.M{mongotest.Written(0)}
+		}
+		f.lock = nil
+		return []bson.M{mongotest.Written(1)}
+	}
+	return nil
+}
+
+// matchesOr reports whether the lock matches one of the $or conditions of
+// elect: held by the node, or expired
+func (f *fakeLocks) matchesOr(q bson.M) bool {
+	for _, c := range q["$or"].([]interface{}) {
+		c := c.(bson.M)
+		if h, ok := c["holder"]; ok && f.lock["holder"] == h {
+			return true
+		}
+		if e, ok := c["expires"]; ok && f.lock["expires"].(time.Time).Before(e.(bson.M)["$lt"].(time.Time)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeLocks) holder() interface{} {
+	f.Lock()
+	defer f.Unlock()
+	if f.lock == nil {
+		return nil
+	}
+	return f.lock["holder"]
+}
+
+// expire backdates the lock, as if its holder stopped renewing it
+func (f *fakeLocks) expire() {
+	f.Lock()
+	defer f.Unlock()
+	f.lock["expires"] = time.Now().Add(-time.Second)
+}
+
+// useLocks points the package at a fake db server serving the locks, as node
+// nodeUUID, for the test
+func useLocks(t *testing.T, locks *fakeLocks, nodeUUID string) {
+	t.Helper()
+	srv := mongotest.NewServer(locks.handler)
+	t.Cleanup(srv.Close)
+	session, err := srv.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(session.Close)
+	oldDb, oldCfg, oldUUID := leader.Db, leader.Cfg, leader.NodeUUID
+	leader.Db = func() *mgo.Database { return session.DB("gostint") }
+	leader.Cfg = &config.Config{LeaderTTL: config.Duration(time.Minute)}
+	leader.NodeUUID = nodeUUID
+	t.Cleanup(func() {
+		leader.set(false, time.Time{})
+		leader.Db, leader.Cfg, leader.NodeUUID = oldDb, oldCfg, oldUUID
+	})
+}
+
+func TestElectAndTakeover(t *testing.T) {
+	locks := &fakeLocks{}
+	useLocks(t, locks, "node-1")
+
+	elect()
+	if !IsLeader() || locks.holder() != "node-1" {
+		t.Fatalf("node-1 not leader of an unheld lock: IsLeader() = %v, holder %v", IsLeader(), locks.holder())
+	}
+	elect() // renewal
+	if !IsLeader() {
+		t.Fatal("node-1 lost the leadership renewing its own lock")
+	}
+
+	leader.NodeUUID = "node-2"
+	leader.set(false, time.Time{})
+	elect()
+	if IsLeader() || locks.holder() != "node-1" {
+		t.Fatalf("node-2 took a lock held by node-1: IsLeader() = %v, holder %v", IsLeader(), locks.holder())
+	}
+
+	locks.expire()
+	elect()
+	if !IsLeader() || locks.holder() != "node-2" {
+		t.Fatalf("node-2 did not take over an expired lock: IsLeader() = %v, holder %v", IsLeader(), locks.holder())
+	}
+	if h, err := Holder(); err != nil || h != "node-2" {
+		t.Errorf("Holder() = %q, %v, want node-2", h, err)
+	}
+
+	leader.NodeUUID = "node-1"
+	leader.set(true, time.Now().Add(time.Minute))
+	elect()
+	if IsLeader() {
+		t.Error("node-1 still leader after node-2 took over")
+	}
+}
+
+func TestHolder(t *testing.T) {
+	locks := &fakeLocks{}
+	useLocks(t, locks, "node-1")
+
+	if h, err := Holder(); err != nil || h != "" {
+		t.Errorf("Holder() without a lock = %q, %v, want none", h, err)
+	}
+	locks.lock = bson.M{"_id": lockID, "holder": "node-2", "expires": time.Now().Add(time.Minute)}
+	if h, err := Holder(); err != nil || h != "node-2" {
+		t.Errorf("Holder() = %q, %v, want node-2", h, err)
+	}
+	locks.expire()
+	if h, err := Holder(); err != nil || h != "" {
+		t.Errorf("Holder() of an expired lock = %q, %v, want none", h, err)
+	}
+}
+
+func TestIsLeaderLapses(t *testing.T) {
+	useLocks(t, &fakeLocks{}, "node-1")
+	leader.set(true, time.Now().Add(-time.Millisecond))
+	if IsLeader() {
+		t.Error("IsLeader() after the leadership lapsed")
+	}
+}
+
+func TestResign(t *testing.T) {
+	locks := &fakeLocks{}
+	useLocks(t, locks, "node-1")
+	Init(leader.Db, &config.Config{LeaderTTL: config.Duration(3 * time.Millisecond)}, "node-1")
+	if !IsLeader() {
+		t.Fatal("node-1 not leader after Init")
+	}
+	time.Sleep(5 * time.Millisecond) // renewing
+
+	if err := Resign(); err != nil {
+		t.Fatalf("Resign() error = %v", err)
+	}
+	if IsLeader() || locks.holder() != nil {
+		t.Fatalf("after Resign() IsLeader() = %v, holder %v", IsLeader(), locks.holder())
+	}
+	time.Sleep(5 * time.Millisecond)
+	if h := locks.holder(); h != nil {
+		t.Errorf("lock taken back by %v after Resign()", h)
+	}
+}
+
+func TestResignOthersLock(t *testing.T) {
+	locks := &fakeLocks{lock: bson.M{"_id": lockID, "holder": "node-2", "expires": time.Now().Add(time.Minute)}}
+	useLocks(t, locks, "node-1")
+	Init(leader.Db, leader.Cfg, "node-1")
+	if IsLeader() {
+		t.Fatal("node-1 leader of a lock held by node-2")
+	}
+	if err := Resign(); err != nil {
+		t.Fatalf("Resign() error = %v", err)
+	}
+	if h := locks.holder(); h != "node-2" {
+		t.Errorf("Resign() by node-1 removed node-2's lock, holder %v", h)
+	}
+}
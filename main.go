@@ -20,24 +20,35 @@ along with gostint.  If not, see <https://www.gnu.org/licenses/>.
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"runtime"
-	"strconv"
+	"time"
 
 	"github.com/gbevan/gostint/approle"
+	"github.com/gbevan/gostint/authenticate"
+	"github.com/gbevan/gostint/config"
+	"github.com/gbevan/gostint/content"
 	"github.com/gbevan/gostint/health"
 	"github.com/gbevan/gostint/jobqueues"
+	"github.com/gbevan/gostint/leader"
 	"github.com/gbevan/gostint/logmsg"
 	"github.com/gbevan/gostint/metrics"
 	"github.com/gbevan/gostint/pingclean"
+	"github.com/gbevan/gostint/retention"
+	"github.com/gbevan/gostint/secretrefs"
 	"github.com/gbevan/gostint/state"
 	"github.com/gbevan/gostint/ui"
+	"github.com/gbevan/gostint/v1/config"
+	"github.com/gbevan/gostint/v1/content"
 	"github.com/gbevan/gostint/v1/health"
 	"github.com/gbevan/gostint/v1/job"
+	"github.com/gbevan/gostint/v1/node"
 	"github.com/gbevan/gostint/v1/vault"
+	"github.com/gbevan/gostint/vaultsession"
 	"github.com/globalsign/mgo"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
@@ -49,20 +60,21 @@ import (
 //go:generate esc -o banner.go banner.txt
 //go:generate esc -prefix "ui" -include "(^ui/favicon.ico|^ui/index.html|^ui/css|^ui/dist|css/bootstrap.css)" -pkg ui -o ui/ui.go ui
 
-// MongoDB session and db
-var dbSession *mgo.Session
-var gostintDb *mgo.Database
-
 var appRoleID string
 
-// GetDbSession returns the MongoDB session
+var cfg *config.Config
+
+// version is set at build time by goreleaser
+var version = "dev"
+
+// GetDbSession returns the current MongoDB session
 func GetDbSession() *mgo.Session {
-	return dbSession
+	return vaultsession.DB().Session
 }
 
-// GetDb returns the gostint Db
+// GetDb returns the gostint Db, on the current session
 func GetDb() *mgo.Database {
-	return gostintDb
+	return vaultsession.DB()
 }
 
 // GetAppRoleID returns the instance's App Role ID
@@ -70,55 +82,6 @@ func GetAppRoleID() string {
 	return appRoleID
 }
 
-// getDbCreds() Get Ephemeral username & password from Vault using the
-// One-Time (num_uses=2) token passed from provisioner (in dev see
-// Gododir/main.go tasks "default" -> "gettoken").
-func getDbCreds() (string, string, error) {
-	// new Vault API Client
-	// client, err := api.NewClient(&api.Config{
-	// 	Address: os.Getenv("VAULT_ADDR"),
-	// })
-	// if err != nil {
-	// 	return "", "", err
-	// }
-
-	// Authenticate with Vault using passed one-time token
-	// client.SetToken(os.Getenv("GOSTINT_DBAUTH_TOKEN"))
-	// os.Setenv("GOSTINT_DBAUTH_TOKEN", "")
-
-	// Authenticate with vault using gostint-run(time) approle
-	token, client, err := approle.AuthenticatePushMode(
-		os.Getenv("GOSTINT_RUN_ROLEID"),
-		os.Getenv("GOSTINT_RUN_SECRETID"),
-	)
-	if err != nil {
-		return "", "", err
-	}
-
-	client.SetToken(token)
-
-	// Get MongoDB ephemeral credentials
-	secretValues, err := client.Logical().Read("database/creds/gostint-dbauth-role")
-	if err != nil {
-		return "", "", err
-	}
-
-	username := ""
-	password := ""
-	for k, v := range secretValues.Data {
-		switch k {
-		case "username":
-			username = v.(string)
-			break
-		case "password":
-			password = v.(string)
-			break
-		}
-	}
-
-	return username, password, nil
-}
-
 // Routes defines RESTful api middleware and routes.
 func Routes() *chi.Mux {
 	router := chi.NewRouter()
@@ -134,9 +97,12 @@ func Routes() *chi.Mux {
 	)
 
 	router.Route("/v1", func(r chi.Router) {
-		r.Mount("/api/job", job.Routes(GetDb()))
-		r.Mount("/api/health", healthApi.Routes(GetDb()))
-		r.Mount("/api/vault", vault.Routes())
+		r.Mount("/api/job", job.Routes(GetDb, cfg))
+		r.Mount("/api/content", contentApi.Routes(cfg))
+		r.Mount("/api/health", healthApi.Routes(GetDb))
+		r.Mount("/api/vault", vault.Routes(cfg))
+		r.Mount("/api/config", configApi.Routes(cfg))
+		r.Mount("/api/node", nodeApi.Routes(GetDb))
 
 		// prometheus metrics exposition
 		r.Mount("/api/metrics", promhttp.Handler())
@@ -149,7 +115,7 @@ func Routes() *chi.Mux {
 		http.Redirect(w, r, "../", 301)
 	})
 
-	if os.Getenv("GOSTINT_UI") == "1" {
+	if cfg.UI {
 		logmsg.Info("Enabling UI")
 		// Note: http.FileServer will automatically resolve Content-Type headers
 		router.Mount("/", http.FileServer(ui.FS(false)))
@@ -159,49 +125,53 @@ func Routes() *chi.Mux {
 }
 
 func main() {
-	if os.Getenv("GOSTINT_DEBUG") != "" {
-		logmsg.EnableDebug()
-	}
-
 	banner, err := FSString(false, "/banner.txt")
 	if err != nil {
 		logmsg.Error("banner failed: %v", err)
 	}
 	fmt.Println(banner)
 
-	serverPort := 3232
-	if os.Getenv("GOSTINT_PORT") != "" {
-		sp, err2 := strconv.Atoi(os.Getenv("GOSTINT_PORT"))
-		if err2 != nil {
-			panic(err2)
-		}
-		serverPort = sp
+	cfg, err = config.Load(os.Getenv("GOSTINT_CONFIG"))
+	if err != nil {
+		logmsg.Error("%s", err)
+		os.Exit(1)
 	}
-	logmsg.Info("Compiled with: %v", runtime.Version())
-	logmsg.Info("Starting gostint...")
 
-	username, password, err := getDbCreds()
-	if err != nil {
-		panic(err)
+	if cfg.LogDebug {
+		logmsg.EnableDebug()
 	}
-	logmsg.Debug("Dialing Mongodb")
-	dbSession, err = mgo.Dial(os.Getenv("GOSTINT_DBURL"))
-	if err != nil {
-		panic(err)
+	for _, w := range cfg.Warnings() {
+		logmsg.Warn("%s", w)
 	}
-	logmsg.Debug("Logging in to gostint db")
-	gostintDb = dbSession.DB("gostint")
-	err = gostintDb.Login(username, password)
+
+	// load job history retention policy, validated with the config
+	err = retention.Init(cfg.RetentionPolicy, cfg.PurgeAge.D())
 	if err != nil {
+		logmsg.Error("%s", err)
+		os.Exit(1)
+	}
+
+	approle.Init(cfg)
+	authenticate.Init(cfg)
+	secretrefs.Init(cfg)
+
+	logmsg.Info("gostint version %s, compiled with: %v", version, runtime.Version())
+	logmsg.Info("Starting gostint...")
+
+	// Login to the vault for gostint's ephemeral db credentials, renewing
+	// them and the token in the background
+	if err = vaultsession.Init(cfg); err != nil {
 		panic(err)
 	}
 
+	content.Init(GetDb, cfg)
+
 	// init ping and clean
-	nodeUUID := pingclean.Init(gostintDb)
+	nodeUUID := pingclean.Init(GetDb, cfg, version)
 
 	appRole := jobqueues.AppRole{
-		ID:   os.Getenv("GOSTINT_ROLEID"),
-		Name: os.Getenv("GOSTINT_ROLENAME"),
+		ID:   cfg.RoleID,
+		Name: cfg.RoleName,
 	}
 
 	// Create RESTful routes
@@ -210,17 +180,48 @@ func main() {
 	// initialise state
 	state.Init(nodeUUID)
 
+	// take part in leader election for singleton cluster duties
+	leader.Init(GetDb, cfg, nodeUUID)
+
 	// initialise health
-	health.Init(gostintDb)
+	health.Init(GetDb)
 
 	// Start job queues
-	jobqueues.Init(gostintDb, &appRole, nodeUUID)
-
-	logmsg.Info("gostint listening on https port %d", serverPort)
-	log.Fatal(http.ListenAndServeTLS(
-		fmt.Sprintf(":%d", serverPort),
-		os.Getenv("GOSTINT_SSL_CERT"),
-		os.Getenv("GOSTINT_SSL_KEY"),
-		router,
-	))
+	jobqueues.Init(GetDb, cfg, &appRole, nodeUUID)
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.Port),
+		Handler: router,
+	}
+	go func() {
+		logmsg.Info("gostint listening on https port %d", cfg.Port)
+		err := srv.ListenAndServeTLS(cfg.SSLCert, cfg.SSLKey)
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Wait for SIGINT/SIGTERM, then drain running jobs and shutdown cleanly.
+	// The api continues to serve while draining so job status can be polled.
+	<-state.Shutdown()
+	jobqueues.Drain(cfg.ShutdownTimeout.D())
+
+	if err = leader.Resign(); err != nil {
+		logmsg.Error("Resign leadership failed: %s", err)
+	}
+
+	logmsg.Info("Deregistering node %s", nodeUUID)
+	if err = pingclean.Deregister(); err != nil {
+		logmsg.Error("Deregister node failed: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	if err = srv.Shutdown(ctx); err != nil {
+		logmsg.Error("http server shutdown failed: %s", err)
+	}
+	cancel()
+	vaultsession.Stop()
+
+	logmsg.Info("gostint shutdown complete")
+	os.Exit(0)
 }
@@ -0,0 +1,239 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package meta
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gbevan/gostint/config"
+	"github.com/gbevan/gostint/secretrefs"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// A job's meta data is layered, each layer overriding those before it:
+//   image    /gostint_image.yml in the job's container image
+//   content  /gostint.yml in the job's content
+//   request  the job request
+//   payload  the job request's encrypted payload
+// Merging, for each field:
+//   strings and lists      the last layer to set it wins
+//   booleans               the last layer to set it wins (false is unset in
+//                          the request and payload, so cannot override true)
+//   env_vars               merged by variable name, the last layer wins
+//   secret_refs            concatenated in layer order, so later refs to the
+//                          same var override earlier ones
+//   limits                 merged by field, the last layer wins, except
+//                          booleans can only be set and cap_drop accumulates
+// The image layer may not set container_image or image_pull_policy.
+
+// Version is the latest version of the meta schema
+const Version = 1
+
+// Layer names, in increasing precedence
+const (
+	LayerImage   = "image"
+	LayerContent = "content"
+	LayerRequest = "request"
+	LayerPayload = "payload"
+)
+
+// Files of the meta data layers
+const (
+	ImageFile   = "gostint_image.yml"
+	ContentFile = "gostint.yml"
+)
+
+// Meta is the schema of a job's meta data
+type Meta struct {
+	Version         int            `yaml:"version"           json:"version"`
+	ContainerImage  string         `yaml:"container_image"   json:"container_image,omitempty"`
+	ImagePullPolicy string         `yaml:"image_pull_policy" json:"image_pull_policy,omitempty"`
+	EntryPoint      []string       `yaml:"entrypoint"        json:"entrypoint,omitempty"`
+	Run             []string       `yaml:"run"               json:"run,omitempty"`
+	WorkingDir      string         `yaml:"working_directory" json:"working_directory,omitempty"`
+	EnvVars         []string       `yaml:"env_vars"          json:"env_vars,omitempty"`
+	Tty             *bool          `yaml:"tty"               json:"tty,omitempty"`
+	SecretRefs      []string       `yaml:"secret_refs"       json:"secret_refs,omitempty"`
+	SecretFileType  string         `yaml:"secret_file_type"  json:"secret_file_type,omitempty"`
+	ContOnWarnings  *bool          `yaml:"cont_on_warnings"  json:"cont_on_warnings,omitempty"`
+	Timeout         string         `yaml:"timeout"           json:"timeout,omitempty"`
+	VaultPolicies   []string       `yaml:"vault_policies"    json:"vault_policies,omitempty"`
+	Limits          *config.Limits `yaml:"limits"            json:"limits,omitempty"`
+}
+
+// Layer is one source of a job's meta data
+type Layer struct {
+	Name string
+	Meta *Meta
+}
+
+// Parse strictly parses a meta data file (yaml or json) of the named layer,
+// rejecting unknown fields, and validates it.
+func Parse(layer string, data []byte) (*Meta, error) {
+	file := ContentFile
+	if layer == LayerImage {
+		file = ImageFile
+	}
+	m := Meta{}
+	if err := yaml.UnmarshalStrict(data, &m); err != nil {
+		return nil, fmt.Errorf("Failed parsing yaml in %s: %s", file, err)
+	}
+	if errs := m.Validate(layer); len(errs) > 0 {
+		return nil, fmt.Errorf("Invalid %s: %s", file, strings.Join(errs, ", "))
+	}
+	return &m, nil
+}
+
+// Validate checks the meta data of the named layer, returning any problems
+func (m *Meta) Validate(layer string) []string {
+	errs := []string{}
+	if m.Version < 0 || m.Version > Version {
+		errs = append(errs, fmt.Sprintf("unsupported version %d, this gostint supports up to %d", m.Version, Version))
+	}
+	if layer == LayerImage {
+		if m.ContainerImage != "" {
+			errs = append(errs, "container_image cannot be set by the image")
+		}
+		if m.ImagePullPolicy != "" {
+			errs = append(errs, "image_pull_policy cannot be set by the image")
+		}
+	}
+	switch m.ImagePullPolicy {
+	case "", "IfNotPresent", "Always":
+	default:
+		errs = append(errs, fmt.Sprintf("incorrect value for image_pull_policy: %s", m.ImagePullPolicy))
+	}
+	if m.SecretFileType != "" {
+		if _, ok := secretrefs.SecretFiles[m.SecretFileType]; !ok {
+			errs = append(errs, fmt.Sprintf("invalid secret_file_type: '%s'", m.SecretFileType))
+		}
+	}
+	if m.Timeout != "" {
+		if d, err := time.ParseDuration(m.Timeout); err != nil || d <= 0 {
+			errs = append(errs, fmt.Sprintf("timeout '%s' is not a positive duration", m.Timeout))
+		}
+	}
+	for _, e := range m.EnvVars {
+		if strings.Index(e, "=") < 1 {
+			errs = append(errs, fmt.Sprintf("env_vars entry '%s' is not NAME=value", e))
+		}
+	}
+	if m.Limits != nil {
+		for _, e := range m.Limits.Validate() {
+			errs = append(errs, "limits: "+e)
+		}
+	}
+	return errs
+}
+
+// Merge combines the layers, given in increasing precedence, returning the
+// result and the name of the layer each field was taken from.
+func Merge(layers ...Layer) (*Meta, map[string]string) {
+	m := Meta{Version: Version}
+	from := map[string]string{}
+	envIdx := map[string]int{}
+
+	str := func(dst *string, v, field, layer string) {
+		if v != "" {
+			*dst = v
+			from[field] = layer
+		}
+	}
+	list := func(dst *[]string, v []string, field, layer string) {
+		if len(v) > 0 {
+			*dst = v
+			from[field] = layer
+		}
+	}
+	boolean := func(dst **bool, v *bool, field, layer string) {
+		if v != nil {
+			b := *v
+			*dst = &b
+			from[field] = layer
+		}
+	}
+
+	refLayers := []string{}
+	limitLayers := []string{}
+	for _, l := range layers {
+		lm := l.Meta
+		if lm == nil {
+			continue
+		}
+		str(&m.ContainerImage, lm.ContainerImage, "container_image", l.Name)
+		str(&m.ImagePullPolicy, lm.ImagePullPolicy, "image_pull_policy", l.Name)
+		list(&m.EntryPoint, lm.EntryPoint, "entrypoint", l.Name)
+		list(&m.Run, lm.Run, "run", l.Name)
+		str(&m.WorkingDir, lm.WorkingDir, "working_directory", l.Name)
+		boolean(&m.Tty, lm.Tty, "tty", l.Name)
+		str(&m.SecretFileType, lm.SecretFileType, "secret_file_type", l.Name)
+		boolean(&m.ContOnWarnings, lm.ContOnWarnings, "cont_on_warnings", l.Name)
+		str(&m.Timeout, lm.Timeout, "timeout", l.Name)
+		list(&m.VaultPolicies, lm.VaultPolicies, "vault_policies", l.Name)
+
+		for _, e := range lm.EnvVars {
+			name := e
+			if i := strings.Index(e, "="); i >= 0 {
+				name = e[:i]
+			}
+			if i, ok := envIdx[name]; ok {
+				m.EnvVars[i] = e
+			} else {
+				envIdx[name] = len(m.EnvVars)
+				m.EnvVars = append(m.EnvVars, e)
+			}
+			from["env_vars."+name] = l.Name
+		}
+
+		if len(lm.SecretRefs) > 0 {
+			m.SecretRefs = append(m.SecretRefs, lm.SecretRefs...)
+			refLayers = append(refLayers, l.Name)
+		}
+
+		if lm.Limits != nil {
+			limits := config.Limits{}.Override(m.Limits).Override(lm.Limits)
+			m.Limits = &limits
+			limitLayers = append(limitLayers, l.Name)
+		}
+	}
+	if len(refLayers) > 0 {
+		from["secret_refs"] = strings.Join(refLayers, ",")
+	}
+	if len(limitLayers) > 0 {
+		from["limits"] = strings.Join(limitLayers, ",")
+	}
+	return &m, from
+}
+
+// Bool returns b, or false if unset
+func Bool(b *bool) bool {
+	return b != nil && *b
+}
+
+// SetIfTrue returns a pointer to true if b, else nil (unset), for the
+// request's booleans where false cannot be told from unset.
+func SetIfTrue(b bool) *bool {
+	if !b {
+		return nil
+	}
+	return &b
+}
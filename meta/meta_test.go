@@ -0,0 +1,128 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package meta
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gbevan/gostint/config"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		layer string
+		data  string
+		want  string // error substring, "" for none
+	}{
+		{"valid", LayerContent, "version: 1\nrun: [site.yml]\ntimeout: 10m\n", ""},
+		{"unknown field", LayerContent, "runn: [site.yml]\n", "Failed parsing yaml in gostint.yml"},
+		{"newer version", LayerContent, "version: 2\n", "unsupported version 2"},
+		{"image sets image", LayerImage, "container_image: alpine\n", "container_image cannot be set by the image"},
+		{"image sets pull policy", LayerImage, "image_pull_policy: Always\n", "Invalid gostint_image.yml"},
+		{"bad pull policy", LayerContent, "image_pull_policy: Sometimes\n", "image_pull_policy"},
+		{"bad timeout", LayerContent, "timeout: -1m\n", "timeout '-1m'"},
+		{"bad env var", LayerContent, "env_vars: [NOVALUE]\n", "env_vars entry 'NOVALUE'"},
+		{"bad limits", LayerContent, "limits:\n  cpus: -1\n", "limits: cpus"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.layer, []byte(tt.data))
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("Parse() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Parse() error = %v, want containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	yes := true
+	no := false
+	m, from := Merge(
+		Layer{LayerImage, &Meta{
+			EntryPoint: []string{"/bin/sh", "-c"},
+			EnvVars:    []string{"A=image", "B=image"},
+			SecretRefs: []string{"TOKEN@secret/image"},
+			Tty:        &yes,
+			Limits:     &config.Limits{Memory: 512, CapDrop: []string{"NET_RAW"}, ReadOnlyRootfs: true},
+		}},
+		Layer{LayerContent, &Meta{
+			Run:        []string{"site.yml"},
+			EnvVars:    []string{"B=content"},
+			SecretRefs: []string{"TOKEN@secret/content"},
+			Timeout:    "10m",
+			Limits:     &config.Limits{Memory: 1024, CapDrop: []string{"MKNOD"}},
+		}},
+		Layer{LayerRequest, nil},
+		Layer{LayerPayload, &Meta{
+			Run:     []string{"other.yml"},
+			EnvVars: []string{"C=payload"},
+			Tty:     SetIfTrue(no),
+		}},
+	)
+
+	if !reflect.DeepEqual(m.Run, []string{"other.yml"}) || from["run"] != LayerPayload {
+		t.Errorf("run = %v from %s, want the payload's", m.Run, from["run"])
+	}
+	if from["entrypoint"] != LayerImage || from["timeout"] != LayerContent {
+		t.Errorf("sources = %v", from)
+	}
+	if !reflect.DeepEqual(m.EnvVars, []string{"A=image", "B=content", "C=payload"}) {
+		t.Errorf("env_vars = %v", m.EnvVars)
+	}
+	if from["env_vars.B"] != LayerContent {
+		t.Errorf("env_vars.B from %s", from["env_vars.B"])
+	}
+	if !reflect.DeepEqual(m.SecretRefs, []string{"TOKEN@secret/image", "TOKEN@secret/content"}) || from["secret_refs"] != "image,content" {
+		t.Errorf("secret_refs = %v from %s", m.SecretRefs, from["secret_refs"])
+	}
+	if !Bool(m.Tty) || from["tty"] != LayerImage {
+		t.Errorf("tty unset by an unset (false) payload value")
+	}
+	if m.Limits.Memory != 1024 || !m.Limits.ReadOnlyRootfs || len(m.Limits.CapDrop) != 2 {
+		t.Errorf("limits = %+v", m.Limits)
+	}
+	if from["limits"] != "image,content" {
+		t.Errorf("limits from %s", from["limits"])
+	}
+	if m.Version != Version {
+		t.Errorf("version = %d", m.Version)
+	}
+}
+
+func TestMergeExplicitFalse(t *testing.T) {
+	yes := true
+	no := false
+	m, from := Merge(
+		Layer{LayerImage, &Meta{ContOnWarnings: &yes}},
+		Layer{LayerContent, &Meta{ContOnWarnings: &no}},
+	)
+	if Bool(m.ContOnWarnings) || from["cont_on_warnings"] != LayerContent {
+		t.Errorf("cont_on_warnings = %v from %s, want false from the content", Bool(m.ContOnWarnings), from["cont_on_warnings"])
+	}
+}
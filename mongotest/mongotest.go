@@ -0,0 +1,285 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mongotest
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// A fake MongoDB server for unit tests of code using mgo, without a real
+// MongoDB. It speaks just enough of the (pre 3.0, OP_QUERY only) wire protocol
+// for mgo: the handshake and MONGODB-CR logins are handled here, every other
+// query and command is passed to the test's Handler, which returns the
+// documents to reply with. With this protocol version mgo sends writes as
+// commands (insert, update, delete, findAndModify) and finds as queries of the
+// collection.
+
+const (
+	opReply   = 1
+	opQuery   = 2004
+	opGetMore = 2005
+)
+
+// Request is a query or command received by the server
+type Request struct {
+	DB         string
+	Collection string // "$cmd" for commands
+	Command    string // the command's name, e.g. "update", "" for queries
+	Doc        bson.M // the command, or the query's filter
+	User       string // the user the connection is logged in as, if any
+}
+
+// Handler returns the documents replying to a request, a command replying
+// nil gets {ok: 1}
+type Handler func(req *Request) []bson.M
+
+// Server is a fake MongoDB server listening on a local port
+type Server struct {
+	// Addr is the host:port the server listens on
+	Addr string
+
+	handler Handler
+	ln      net.Listener
+	mutex   sync.Mutex
+	users   map[string]string // logins are refused unless listed
+	conns   map[net.Conn]bool
+	wg      sync.WaitGroup
+}
+
+// NewServer starts a server passing requests to the handler
+func NewServer(handler Handler) *Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("mongotest: failed to listen: " + err.Error())
+	}
+	s := &Server{
+		Addr:    ln.Addr().String(),
+		users:   map[string]string{},
+		handler: handler,
+		ln:      ln,
+		conns:   map[net.Conn]bool{},
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// SetUser adds a user, or changes their password
+func (s *Server) SetUser(user, password string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.users[user] = password
+}
+
+// Dial returns an mgo session to the server
+func (s *Server) Dial() (*mgo.Session, error) {
+	return mgo.DialWithTimeout(s.Addr+"?connect=direct", 5*time.Second)
+}
+
+// Close stops the server and drops its connections
+func (s *Server) Close() {
+	s.ln.Close()
+	s.mutex.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mutex.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.conns[c] = true
+		s.mutex.Unlock()
+		s.wg.Add(1)
+		go s.conn(c)
+	}
+}
+
+// conn serves a connection until it is closed
+func (s *Server) conn(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, c)
+		s.mutex.Unlock()
+		c.Close()
+	}()
+
+	user := ""
+	nonce := ""
+	for {
+		hdr := make([]byte, 16)
+		if _, err := io.ReadFull(c, hdr); err != nil {
+			return
+		}
+		size := int(binary.LittleEndian.Uint32(hdr))
+		if size < 16 {
+			return
+		}
+		body := make([]byte, size-16)
+		if _, err := io.ReadFull(c, body); err != nil {
+			return
+		}
+		requestID := int32(binary.LittleEndian.Uint32(hdr[4:]))
+		switch binary.LittleEndian.Uint32(hdr[12:]) {
+		case opGetMore:
+			// cursors are never left open, so there is never more
+			if s.reply(c, requestID, nil) != nil {
+				return
+			}
+			continue
+		case opQuery:
+		default:
+			continue // needing no reply, e.g. kill cursors
+		}
+
+		// flags, collection, skip, limit, query
+		end := 4 + strings.IndexByte(string(body[4:]), 0)
+		if end < 4 {
+			return
+		}
+		full := string(body[4:end])
+		raw := body[end+9:]
+		docSize := int(binary.LittleEndian.Uint32(raw))
+		var d bson.D
+		req := &Request{User: user}
+		if bson.Unmarshal(raw[:docSize], &d) != nil || bson.Unmarshal(raw[:docSize], &req.Doc) != nil {
+			return
+		}
+
+		dot := strings.IndexByte(full, '.')
+		req.DB, req.Collection = full[:dot], full[dot+1:]
+		if req.Collection == "$cmd" && len(d) > 0 {
+			req.Command = d[0].Name
+		} else if q, ok := req.Doc["$query"]; ok {
+			req.Doc, _ = q.(bson.M)
+			if req.Doc == nil {
+				req.Doc = bson.M{}
+			}
+		}
+
+		var docs []bson.M
+		switch strings.ToLower(req.Command) {
+		case "ismaster":
+			docs = []bson.M{{"ismaster": true, "maxWireVersion": 2, "minWireVersion": 0, "ok": 1}}
+		case "ping", "logout":
+			if req.Command == "logout" {
+				user = ""
+			}
+			docs = []bson.M{{"ok": 1}}
+		case "getnonce":
+			nonce = bson.NewObjectId().Hex()
+			docs = []bson.M{{"nonce": nonce, "ok": 1}}
+		case "authenticate":
+			u, _ := req.Doc["user"].(string)
+			key, _ := req.Doc["key"].(string)
+			if password, ok := s.password(u); ok && key == loginKey(nonce, u, password) {
+				user = u
+				docs = []bson.M{{"ok": 1}}
+			} else {
+				docs = []bson.M{{"ok": 0, "errmsg": "auth failed", "code": 18}}
+			}
+		default:
+			docs = s.handler(req)
+			if req.Command != "" && len(docs) == 0 {
+				docs = []bson.M{{"ok": 1}}
+			}
+		}
+		if s.reply(c, requestID, docs) != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) password(user string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	p, ok := s.users[user]
+	return p, ok
+}
+
+// reply sends the documents in reply to the request, with no cursor
+func (s *Server) reply(c net.Conn, requestID int32, docs []bson.M) error {
+	buf := make([]byte, 36)
+	for _, doc := range docs {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, data...)
+	}
+	binary.LittleEndian.PutUint32(buf[0:], uint32(len(buf)))
+	binary.LittleEndian.PutUint32(buf[8:], uint32(requestID))
+	binary.LittleEndian.PutUint32(buf[12:], opReply)
+	binary.LittleEndian.PutUint32(buf[32:], uint32(len(docs)))
+	_, err := c.Write(buf)
+	return err
+}
+
+// loginKey is the MONGODB-CR key proving the user knows the password
+func loginKey(nonce, user, password string) string {
+	p := md5.Sum([]byte(user + ":mongo:" + password))
+	k := md5.Sum([]byte(nonce + user + hex.EncodeToString(p[:])))
+	return hex.EncodeToString(k[:])
+}
+
+// Written is the reply to an insert, update or delete command writing n
+// documents, mgo returns mgo.ErrNotFound for updates writing none
+func Written(n int) bson.M {
+	return bson.M{"ok": 1, "n": n, "nModified": n}
+}
+
+// Failed is the reply to a query failing with the error message
+func Failed(msg string) bson.M {
+	return bson.M{"$err": msg}
+}
+
+// Duplicate is the reply to an insert command violating a unique index
+func Duplicate() bson.M {
+	return bson.M{"ok": 1, "n": 0, "writeErrors": []bson.M{
+		{"index": 0, "code": 11000, "errmsg": "E11000 duplicate key error"},
+	}}
+}
+
+// Modified is the reply to a findAndModify command returning the document,
+// nil if none matched
+func Modified(doc interface{}) bson.M {
+	if doc == nil {
+		return bson.M{"ok": 1, "value": nil, "lastErrorObject": bson.M{"n": 0}}
+	}
+	return bson.M{"ok": 1, "value": doc, "lastErrorObject": bson.M{"n": 1, "updatedExisting": true}}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mongotest
+
+import (
+	"testing"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestServer(t *testing.T) {
+	var reqs []Request
+	s := NewServer(func(req *Request) []bson.M {
+		reqs = append(reqs, *req)
+		switch req.Command {
+		case "":
+			return []bson.M{{"_id": "a", "n": 1}}
+		case "update":
+			return []bson.M{Written(0)}
+		case "insert":
+			return []bson.M{Duplicate()}
+		case "findAndModify":
+			return []bson.M{Modified(bson.M{"_id": "a", "n": 2})}
+		}
+		return nil
+	})
+	defer s.Close()
+	s.SetUser("u1", "p1")
+
+	session, err := s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	db := session.DB("gostint")
+	if err = db.Login("u1", "wrong"); err == nil {
+		t.Error("Login() accepted a wrong password")
+	}
+	if err = db.Login("u1", "p1"); err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+
+	c := db.C("things")
+	var doc struct {
+		ID string `bson:"_id"`
+		N  int    `bson:"n"`
+	}
+	if err = c.Find(bson.M{"n": bson.M{"$gt": 0}}).Sort("n").One(&doc); err != nil || doc.N != 1 {
+		t.Errorf("One() = %+v, %v", doc, err)
+	}
+	if err = c.Update(bson.M{"_id": "b"}, bson.M{"$set": bson.M{"n": 1}}); err != mgo.ErrNotFound {
+		t.Errorf("Update() error = %v, want not found", err)
+	}
+	if err = c.Insert(bson.M{"_id": "a"}); !mgo.IsDup(err) {
+		t.Errorf("Insert() error = %v, want duplicate", err)
+	}
+	if _, err = c.FindId("a").Apply(mgo.Change{Update: bson.M{"$inc": bson.M{"n": 1}}, ReturnNew: true}, &doc); err != nil || doc.N != 2 {
+		t.Errorf("Apply() = %+v, %v", doc, err)
+	}
+
+	if len(reqs) != 4 {
+		t.Fatalf("handler got %d requests, want 4", len(reqs))
+	}
+	find := reqs[0]
+	if find.Collection != "things" || find.Command != "" || find.User != "u1" {
+		t.Errorf("find request = %+v", find)
+	}
+	if n, _ := find.Doc["n"].(bson.M); n["$gt"] != 0 {
+		t.Errorf("find filter = %v", find.Doc)
+	}
+	if reqs[1].Command != "update" || reqs[1].DB != "gostint" {
+		t.Errorf("update request = %+v", reqs[1])
+	}
+}
+
+func TestFailed(t *testing.T) {
+	s := NewServer(func(req *Request) []bson.M {
+		return []bson.M{Failed("not authorized")}
+	})
+	defer s.Close()
+	session, err := s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	var doc bson.M
+	err = session.DB("gostint").C("things").Find(nil).One(&doc)
+	if qerr, ok := err.(*mgo.QueryError); !ok || qerr.Message != "not authorized" {
+		t.Errorf("One() error = %v, want the query failure", err)
+	}
+}
@@ -20,10 +20,18 @@ along with gostint.  If not, see <https://www.gnu.org/licenses/>.
 package pingclean
 
 import (
+	"fmt"
 	"math/rand"
+	"os"
 	"time"
 
+	"github.com/gbevan/gostint/config"
+	"github.com/gbevan/gostint/content"
 	"github.com/gbevan/gostint/jobqueues"
+	"github.com/gbevan/gostint/leader"
+	"github.com/gbevan/gostint/logmsg"
+	"github.com/gbevan/gostint/retention"
+	"github.com/gbevan/gostint/state"
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	uuid "github.com/satori/go.uuid"
@@ -32,50 +40,105 @@ import (
 // PingClean holds module state
 type PingClean struct {
 	UUID string
-	Db   *mgo.Database
+	Db   func() *mgo.Database
+	Cfg  *config.Config
+	info Node
+	stop chan struct{}
 }
 
 var pingClean PingClean
 
 // Init ping and client operations for cluster
-func Init(db *mgo.Database) string {
+func Init(db func() *mgo.Database, cfg *config.Config, version string) string {
 	pingClean.Db = db
+	pingClean.Cfg = cfg
+	pingClean.stop = make(chan struct{})
 	// Assign this node a uuid
 	pingClean.UUID = uuid.NewV4().String()
-	wakeup()
+
+	// static node info registered with each ping
+	hostname, err := os.Hostname()
+	if err != nil {
+		logmsg.Error("Failed to get hostname: %s", err)
+	}
+	pingClean.info = Node{
+		Hostname:  hostname,
+		Version:   version,
+		StartedAt: time.Now(),
+	}
+	_, dockerInfo, err := jobqueues.GetDockerInfo()
+	if err != nil {
+		logmsg.Error("Failed to get docker info for node registration: %s", err)
+	} else {
+		pingClean.info.DockerVersion = dockerInfo.ServerVersion
+		pingClean.info.CPUs = dockerInfo.NCPU
+		pingClean.info.MemTotal = dockerInfo.MemTotal
+	}
+
+	// register now, stale node sweeps start from the first interval once the
+	// job queues are initialised
+	ping()
 
 	go interval()
+	go nodeStateHandler()
 
 	return pingClean.UUID
 }
 
 // Node holds gostint node/pod instance data
 type Node struct {
-	ID       string    `json:"_id"        bson:"_id"`
-	LastSeen time.Time `json:"last_seen"  bson:"last_seen"`
+	ID             string    `json:"_id"                   bson:"_id"`
+	LastSeen       time.Time `json:"last_seen"             bson:"last_seen"`
+	Hostname       string    `json:"hostname"              bson:"hostname"`
+	Version        string    `json:"version"               bson:"version"`
+	DockerVersion  string    `json:"docker_server_version" bson:"docker_server_version"`
+	CPUs           int       `json:"cpus"                  bson:"cpus"`
+	MemTotal       int64     `json:"mem_total"             bson:"mem_total"`
+	StartedAt      time.Time `json:"started_at"            bson:"started_at"`
+	RunningJobs    int       `json:"running_jobs"          bson:"running_jobs"`
+	State          string    `json:"state"                 bson:"state"`
+	RequestedState string    `json:"requested_state"       bson:"requested_state,omitempty" description:"State requested via the node api, applied by the node itself"`
+}
+
+// ping db 'nodes' collection using uuid as clean, with current time stamp
+func ping() {
+	nodes := pingClean.Db().C("nodes")
+
+	// $set so as not to overwrite any requested_state
+	_, err := nodes.UpsertId(pingClean.UUID, bson.M{"$set": bson.M{
+		"last_seen":             time.Now(),
+		"hostname":              pingClean.info.Hostname,
+		"version":               pingClean.info.Version,
+		"docker_server_version": pingClean.info.DockerVersion,
+		"cpus":                  pingClean.info.CPUs,
+		"mem_total":             pingClean.info.MemTotal,
+		"started_at":            pingClean.info.StartedAt,
+		"running_jobs":          jobqueues.RunningCount(),
+		"state":                 state.GetState(),
+	}})
+	if err != nil {
+		panic(err)
+	}
 }
 
 func wakeup() {
-	// ping db 'nodes' collection using uuid as clean, with current time stamp
-	db := pingClean.Db
+	db := pingClean.Db()
 	nodes := db.C("nodes")
 	queues := db.C("queues")
 
-	_, err := nodes.UpsertId(pingClean.UUID, Node{
-		ID:       pingClean.UUID,
-		LastSeen: time.Now(),
-	})
-	if err != nil {
-		panic(err)
+	ping()
+
+	// the sweep and purge are cluster wide, so only run on the leader
+	if !leader.IsLeader() {
+		return
 	}
 
-	// scan nodes for stale node (no longer pinging)
-	//   if stale, set all running jobs in queues for that node's uuid to have
-	//   status=unknown
+	// scan nodes for stale node (no longer pinging) and jobs whose lease has
+	// expired, recover those jobs per their queue's recovery policy
 	var ns []Node
 	now := time.Now()
-	threshold := now.Add(time.Duration(-5) * time.Minute)
-	err = nodes.Find(bson.M{
+	threshold := now.Add(-pingClean.Cfg.StaleNodeThreshold.D())
+	err := nodes.Find(bson.M{
 		"last_seen": bson.M{"$lt": threshold},
 	}).All(&ns)
 	if err != nil {
@@ -87,37 +150,102 @@ func wakeup() {
 		ids = append(ids, n.ID)
 	}
 
-	chg := mgo.Change{
-		Update:    bson.M{"$set": bson.M{"status": "unknown"}},
-		ReturnNew: true,
-	}
 	var jobs []jobqueues.Job
-	_, err = queues.Find(bson.M{
-		"node_uuid": bson.M{"$in": ids},
-		"status":    "running",
-	}).Apply(chg, &jobs)
+	err = queues.Find(bson.M{
+		"status": bson.M{"$in": []string{"running", "stopping"}},
+		"$or": []bson.M{
+			{"lease_expires": bson.M{"$lt": now}},
+			{"node_uuid": bson.M{"$in": ids}},
+		},
+	}).All(&jobs)
 	if err != nil {
-		if err.Error() != "not found" {
-			panic(err)
+		panic(err)
+	}
+	for _, job := range jobs {
+		reason := fmt.Sprintf("gostint node %s stopped renewing the job's lease", job.NodeUUID)
+		if err = job.Recover(reason); err != nil {
+			logmsg.Error("recover job %s failed: %s", job.ID.Hex(), err)
 		}
 	}
 
 	// clean up nodes
 	nodes.RemoveAll(bson.M{"_id": bson.M{"$in": ids}})
 
-	// clean up any queues with ended datetime > 6 hours ago
-	now = time.Now()
-	threshold = now.Add(time.Duration(-6) * time.Hour)
-	queues.RemoveAll(bson.M{
-		"ended": bson.M{"$lt": threshold},
-	})
+	// clean up any ended jobs past their retention period
+	err = retention.Purge(db)
+	if err != nil {
+		logmsg.Error("retention purge failed: %s", err)
+	}
+
+	// and uploaded content no longer referenced by any job
+	err = content.GC()
+	if err != nil {
+		logmsg.Error("content gc failed: %s", err)
+	}
 }
 
 func interval() {
 	for {
-		// wait 1 min + random upto another 1 min (splay)
-		r := rand.Intn(int(time.Minute))
-		time.Sleep(time.Duration(r)*time.Nanosecond + time.Minute)
+		// wait interval + random upto another interval (splay)
+		interval := pingClean.Cfg.PingInterval.D()
+		r := rand.Int63n(int64(interval))
+		select {
+		case <-pingClean.stop:
+			return
+		case <-time.After(time.Duration(r) + interval):
+		}
 		wakeup()
 	}
 }
+
+// nodeStateHandler publishes this node's state and running job count, and
+// applies any drain/resume requested for it through the node api. The db
+// session is replaced on credential rotation, so the collection is got afresh
+// each time.
+func nodeStateHandler() {
+	for {
+		var node Node
+		_, err := pingClean.Db().C("nodes").FindId(pingClean.UUID).Apply(mgo.Change{
+			Update: bson.M{"$set": bson.M{
+				"running_jobs": jobqueues.RunningCount(),
+				"state":        state.GetState(),
+			}},
+			ReturnNew: true,
+		}, &node)
+		if err != nil && err != mgo.ErrNotFound {
+			logmsg.Error("node state update failed: %s", err)
+		}
+
+		shuttingDown := false
+		select {
+		case <-state.Shutdown():
+			shuttingDown = true
+		default:
+		}
+
+		current := state.GetState()
+		switch {
+		case shuttingDown:
+			// requested states no longer apply
+		case node.RequestedState == "draining" && current == "active":
+			logmsg.Info("Drain requested via api, draining node...")
+			state.SetState("draining")
+		case node.RequestedState == "active" && current == "draining":
+			logmsg.Info("Resume requested via api, node active")
+			state.SetState("active")
+		}
+
+		select {
+		case <-pingClean.stop:
+			return
+		case <-time.After(pingClean.Cfg.NodePollInterval.D()):
+		}
+	}
+}
+
+// Deregister stops pinging and removes this node from the nodes collection,
+// for a clean shutdown.
+func Deregister() error {
+	close(pingClean.stop)
+	return pingClean.Db().C("nodes").RemoveId(pingClean.UUID)
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pingclean
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gbevan/gostint/config"
+	"github.com/gbevan/gostint/mongotest"
+	"github.com/gbevan/gostint/state"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// fakeNodes is a nodes collection holding this node's document, served by a
+// fake db server
+type fakeNodes struct {
+	sync.Mutex
+	node    bson.M
+	updates int
+}
+
+func (f *fakeNodes) handler(req *mongotest.Request) []bson.M {
+	if req.Command != "findAndModify" {
+		return nil
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.updates++
+	for k, v := range req.Doc["update"].(bson.M)["$set"].(bson.M) {
+		f.node[k] = v
+	}
+	// a copy, the reply is encoded after the lock is released
+	node := bson.M{}
+	for k, v := range f.node {
+		node[k] = v
+	}
+	return []bson.M{mongotest.Modified(node)}
+}
+
+func (f *fakeNodes) count() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.updates
+}
+
+func (f *fakeNodes) requestState(s string) {
+	f.Lock()
+	defer f.Unlock()
+	f.node["requested_state"] = s
+}
+
+// fakeSession returns a session to a fake db server passing requests to the
+// handler, both closed when the test ends (unless closed by the test).
+func fakeSession(t *testing.T, handler mongotest.Handler) *mgo.Session {
+	t.Helper()
+	srv := mongotest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	session, err := srv.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(session.Close)
+	return session
+}
+
+// runNodeStateHandler runs the handler on the session until the test ends,
+// returning a func swapping in another session, as on db credential rotation.
+func runNodeStateHandler(t *testing.T, session *mgo.Session) func(*mgo.Session) {
+	t.Helper()
+	var mutex sync.Mutex
+	old := pingClean
+	pingClean = PingClean{
+		UUID: "node-1",
+		Db: func() *mgo.Database {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return session.DB("gostint")
+		},
+		Cfg:  &config.Config{NodePollInterval: config.Duration(time.Millisecond)},
+		stop: make(chan struct{}),
+	}
+	done := make(chan struct{})
+	go func() {
+		nodeStateHandler()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		close(pingClean.stop)
+		<-done
+		pingClean = old
+	})
+	return func(s *mgo.Session) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		session = s
+	}
+}
+
+// waitFor polls until cond is true, failing the test after a second
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for end := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(end) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestNodeStateHandlerAfterDbSwap(t *testing.T) {
+	oldNodes := &fakeNodes{node: bson.M{"_id": "node-1"}}
+	newNodes := &fakeNodes{node: bson.M{"_id": "node-1"}}
+	oldSession := fakeSession(t, oldNodes.handler)
+	newSession := fakeSession(t, newNodes.handler)
+
+	swap := runNodeStateHandler(t, oldSession)
+	waitFor(t, "a node state update", func() bool { return oldNodes.count() > 0 })
+
+	// rotation swaps in the new session and, after a grace period for calls
+	// already using it, closes the old one; using it after that panics
+	swap(newSession)
+	waitFor(t, "a node state update on the new session", func() bool { return newNodes.count() > 0 })
+	oldSession.Close()
+	n := newNodes.count()
+	waitFor(t, "further node state updates", func() bool { return newNodes.count() > n+1 })
+}
+
+func TestNodeStateHandlerAppliesRequestedState(t *testing.T) {
+	state.SetState("active")
+	t.Cleanup(func() { state.SetState("active") })
+	nodes := &fakeNodes{node: bson.M{"_id": "node-1"}}
+	runNodeStateHandler(t, fakeSession(t, nodes.handler))
+
+	nodes.requestState("draining")
+	waitFor(t, "the node to drain", func() bool { return state.GetState() == "draining" })
+	waitFor(t, "the draining state to be published", func() bool {
+		nodes.Lock()
+		defer nodes.Unlock()
+		return nodes.node["state"] == "draining"
+	})
+
+	nodes.requestState("active")
+	waitFor(t, "the node to resume", func() bool { return state.GetState() == "active" })
+}
+
+func TestNodeStateHandlerKeepsStoppingState(t *testing.T) {
+	// a node being stopped for shutdown does not resume, nor re-drain
+	state.SetState("stopping")
+	t.Cleanup(func() { state.SetState("active") })
+	nodes := &fakeNodes{node: bson.M{"_id": "node-1", "requested_state": "active"}}
+	runNodeStateHandler(t, fakeSession(t, nodes.handler))
+
+	waitFor(t, "node state updates", func() bool { return nodes.count() > 2 })
+	if s := state.GetState(); s != "stopping" {
+		t.Errorf("state = %q, want stopping", s)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package redact
+
+import (
+	"encoding/base64"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Mask replaces redacted values
+const Mask = "********"
+
+// MinLength of values to redact, shorter values (e.g. "true", port numbers)
+// would mask too much unrelated output to be useful.
+const MinLength = 6
+
+// Redactor masks known secret values, and their common encodings, in text
+// captured from jobs before it is persisted or returned by the api.
+type Redactor struct {
+	replacer *strings.Replacer
+}
+
+// New returns a redactor for the secret values
+func New(values []string) *Redactor {
+	forms := map[string]bool{}
+	add := func(f string) {
+		if len(f) >= MinLength {
+			forms[f] = true
+		}
+	}
+	for _, v := range values {
+		if len(v) < MinLength {
+			continue
+		}
+		variants := []string{v}
+		if strings.Contains(v, "\n") {
+			// as output by a tty, and each line of e.g. a pem key
+			variants = append(variants, strings.Replace(v, "\n", "\r\n", -1))
+			for _, line := range strings.Split(v, "\n") {
+				variants = append(variants, strings.TrimSuffix(line, "\r"))
+			}
+		}
+		for _, f := range variants {
+			add(f)
+			add(base64.StdEncoding.EncodeToString([]byte(f)))
+			add(base64.RawStdEncoding.EncodeToString([]byte(f)))
+			add(base64.URLEncoding.EncodeToString([]byte(f)))
+			add(base64.RawURLEncoding.EncodeToString([]byte(f)))
+			add(url.QueryEscape(f))
+			add(url.PathEscape(f))
+		}
+	}
+
+	// longest first, so a value is masked whole rather than a shorter value
+	// it contains
+	patterns := []string{}
+	for f := range forms {
+		patterns = append(patterns, f)
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+
+	oldnew := []string{}
+	for _, p := range patterns {
+		oldnew = append(oldnew, p, Mask)
+	}
+	return &Redactor{replacer: strings.NewReplacer(oldnew...)}
+}
+
+// Redact returns the text with the secret values masked
+func (r *Redactor) Redact(s string) string {
+	if r == nil {
+		return s
+	}
+	return r.replacer.Replace(s)
+}
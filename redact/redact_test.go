@@ -0,0 +1,80 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package redact
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		in     string
+		want   string
+	}{
+		{"value", []string{"s3cret"}, "pw=s3cret;", "pw=" + Mask + ";"},
+		{"every occurrence", []string{"s3cret"}, "s3cret s3cret", Mask + " " + Mask},
+		{"no values", nil, "s3cret", "s3cret"},
+		{"empty value", []string{""}, "s3cret", "s3cret"},
+		{"short values", []string{"abc", "true", "8080", "12345"}, "abc is true on 8080, 12345", "abc is true on 8080, 12345"},
+		{"min length", []string{"s3cr3t"}, "s3cr3t", Mask},
+		{"longest first", []string{"secret", "secretvalue"}, "a secretvalue and a secret", "a " + Mask + " and a " + Mask},
+		{"contained value", []string{"token-123456", "123456"}, "token-123456/123456", Mask + "/" + Mask},
+		{"overlapping values", []string{"abcdef", "defghi"}, "xabcdefghix", "x" + Mask + "ghix"},
+		{"duplicates", []string{"s3cret", "s3cret"}, "s3cret", Mask},
+		{"base64", []string{"s3cret!"}, base64.StdEncoding.EncodeToString([]byte("s3cret!")), Mask},
+		{"base64 raw", []string{"s3cret!"}, base64.RawStdEncoding.EncodeToString([]byte("s3cret!")), Mask},
+		{"base64 url", []string{"\xfb\xff\xfe s3"}, base64.URLEncoding.EncodeToString([]byte("\xfb\xff\xfe s3")), Mask},
+		{"base64 raw url", []string{"\xfb\xff\xfe s3"}, base64.RawURLEncoding.EncodeToString([]byte("\xfb\xff\xfe s3")), Mask},
+		{"query escaped", []string{"p@ss word&"}, "u=" + url.QueryEscape("p@ss word&"), "u=" + Mask},
+		{"path escaped", []string{"p@ss word/"}, "/" + url.PathEscape("p@ss word/"), "/" + Mask},
+		{"multi-line", []string{"line one\nline two"}, "line one\nline two", Mask},
+		{"multi-line tty", []string{"line one\nline two"}, "line one\r\nline two", Mask},
+		{"each line", []string{"-----BEGIN-----\nMIIBkey\n-----END-----"}, "got MIIBkey", "got " + Mask},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := New(tt.values).Redact(tt.in); got != tt.want {
+				t.Errorf("Redact(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactOverlapping(t *testing.T) {
+	// neither value may be output whole, whichever masks first
+	got := New([]string{"abcdef", "defghi"}).Redact("abcdefghi defghi")
+	for _, v := range []string{"abcdef", "defghi"} {
+		if strings.Contains(got, v) {
+			t.Errorf("Redact() = %q, contains %q", got, v)
+		}
+	}
+}
+
+func TestNilRedactor(t *testing.T) {
+	var r *Redactor
+	if got := r.Redact("s3cret"); got != "s3cret" {
+		t.Errorf("nil Redact() = %q", got)
+	}
+}
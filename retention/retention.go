@@ -0,0 +1,261 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package retention
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gbevan/gostint/jobqueues"
+	"github.com/gbevan/gostint/logmsg"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// DefaultMaxAge is the retention period applied to ended jobs not matched by
+// any rule in the policy, unless overridden by the purge_age config.
+const DefaultMaxAge = 6 * time.Hour
+
+// Rule selects ended jobs by status, qname pattern and/or labels, and sets how
+// long they are kept. All given selectors must match. A MaxAge of "0" keeps
+// matching jobs forever.
+type Rule struct {
+	Status string            `yaml:"status"`
+	Qname  string            `yaml:"qname"`
+	Labels map[string]string `yaml:"labels"`
+	MaxAge string            `yaml:"max_age"`
+
+	maxAge  time.Duration
+	qnameRe *regexp.Regexp
+}
+
+// Policy defines the format of the job retention policy file.
+// Rules are evaluated in order, the first matching rule wins.
+type Policy struct {
+	DefaultMaxAge string `yaml:"default_max_age"`
+	ArchiveDir    string `yaml:"archive_dir"`
+	Rules         []Rule `yaml:"rules"`
+
+	defaultMaxAge time.Duration
+}
+
+var (
+	policy      = Policy{defaultMaxAge: DefaultMaxAge}
+	policyMutex sync.Mutex
+)
+
+// Init loads the retention policy from the given yaml file, if empty the
+// default policy of purging all ended jobs after defaultMaxAge is used.
+func Init(policyFile string, defaultMaxAge time.Duration) error {
+	if defaultMaxAge < 0 {
+		return fmt.Errorf("Invalid retention default max age: must not be negative, got %s", defaultMaxAge)
+	}
+	p := Policy{defaultMaxAge: defaultMaxAge}
+	if policyFile != "" {
+		data, err := ioutil.ReadFile(policyFile)
+		if err != nil {
+			return fmt.Errorf("Failed to read retention policy %s: %s", policyFile, err)
+		}
+		if err = yaml.UnmarshalStrict(data, &p); err != nil {
+			return fmt.Errorf("Failed parsing yaml in retention policy %s: %s", policyFile, err)
+		}
+	}
+	if err := p.compile(); err != nil {
+		return err
+	}
+
+	policyMutex.Lock()
+	policy = p
+	policyMutex.Unlock()
+	return nil
+}
+
+func (p *Policy) compile() error {
+	if p.defaultMaxAge == 0 {
+		p.defaultMaxAge = DefaultMaxAge
+	}
+	if p.DefaultMaxAge != "" {
+		d, err := time.ParseDuration(p.DefaultMaxAge)
+		if err != nil {
+			return fmt.Errorf("Invalid retention default_max_age: %s", err)
+		}
+		if d < 0 {
+			return fmt.Errorf("Invalid retention default_max_age: must not be negative, got %s", d)
+		}
+		p.defaultMaxAge = d
+	}
+
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		r.maxAge = p.defaultMaxAge
+		if r.MaxAge != "" {
+			d, err := time.ParseDuration(r.MaxAge)
+			if err != nil {
+				return fmt.Errorf("Invalid retention max_age in rule %d: %s", i, err)
+			}
+			if d < 0 {
+				return fmt.Errorf("Invalid retention max_age in rule %d: must not be negative, got %s", i, d)
+			}
+			r.maxAge = d
+		}
+		if r.Qname != "" {
+			re, err := regexp.Compile(r.Qname)
+			if err != nil {
+				return fmt.Errorf("Invalid retention qname pattern in rule %d: %s", i, err)
+			}
+			r.qnameRe = re
+		}
+	}
+	return nil
+}
+
+func (r *Rule) matches(job *jobqueues.Job) bool {
+	if r.Status != "" && r.Status != job.Status {
+		return false
+	}
+	if r.qnameRe != nil && !r.qnameRe.MatchString(job.Qname) {
+		return false
+	}
+	for k, v := range r.Labels {
+		if job.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// maxAge returns the retention period for the job, 0 means keep forever
+func (p *Policy) maxAge(job *jobqueues.Job) time.Duration {
+	for i := range p.Rules {
+		if p.Rules[i].matches(job) {
+			return p.Rules[i].maxAge
+		}
+	}
+	return p.defaultMaxAge
+}
+
+// minAge returns the shortest non-zero retention period in the policy, used to
+// limit the candidate jobs queried from the db.
+func (p *Policy) minAge() time.Duration {
+	min := p.defaultMaxAge
+	for _, r := range p.Rules {
+		if r.maxAge != 0 && (min == 0 || r.maxAge < min) {
+			min = r.maxAge
+		}
+	}
+	return min
+}
+
+// Purge removes ended jobs that have exceeded their retention period and are
+// not pinned, archiving them first if an archive_dir is configured.
+func Purge(db *mgo.Database) error {
+	policyMutex.Lock()
+	p := policy
+	policyMutex.Unlock()
+
+	min := p.minAge()
+	if min == 0 {
+		return nil // nothing is ever purged
+	}
+
+	queues := db.C("queues")
+	now := time.Now()
+
+	expired := []jobqueues.Job{}
+	var job jobqueues.Job
+	iter := queues.Find(bson.M{
+		"ended":  bson.M{"$lt": now.Add(-min)},
+		"pinned": bson.M{"$ne": true},
+	}).Iter()
+	for iter.Next(&job) {
+		age := p.maxAge(&job)
+		if age != 0 && job.Ended.Before(now.Add(-age)) {
+			expired = append(expired, job)
+		}
+		job = jobqueues.Job{}
+	}
+	if err := iter.Close(); err != nil {
+		return fmt.Errorf("Failed to query jobs for retention: %s", err)
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+
+	if p.ArchiveDir != "" {
+		if err := archive(p.ArchiveDir, expired); err != nil {
+			return err
+		}
+	}
+
+	ids := []bson.ObjectId{}
+	for _, j := range expired {
+		ids = append(ids, j.ID)
+	}
+	// re-check pinned in case a job was pinned since the query above
+	info, err := queues.RemoveAll(bson.M{
+		"_id":    bson.M{"$in": ids},
+		"pinned": bson.M{"$ne": true},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to purge expired jobs: %s", err)
+	}
+	logmsg.Info("Retention purged %d jobs", info.Removed)
+	return nil
+}
+
+// archive writes the jobs as gzip compressed json lines to a new file in dir
+func archive(dir string, jobs []jobqueues.Job) error {
+	name := filepath.Join(
+		dir,
+		fmt.Sprintf("gostint-jobs-%s.jsonl.gz", time.Now().UTC().Format("20060102T150405.000000000Z")),
+	)
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to create retention archive %s: %s", name, err)
+	}
+
+	zw := gzip.NewWriter(f)
+	enc := json.NewEncoder(zw)
+	for _, job := range jobs {
+		if err = enc.Encode(job.Sanitised()); err != nil {
+			break
+		}
+	}
+	if errZ := zw.Close(); err == nil {
+		err = errZ
+	}
+	if errF := f.Close(); err == nil {
+		err = errF
+	}
+	if err != nil {
+		os.Remove(name)
+		return fmt.Errorf("Failed writing retention archive %s: %s", name, err)
+	}
+	logmsg.Info("Archived %d jobs to %s", len(jobs), name)
+	return nil
+}
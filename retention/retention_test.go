@@ -0,0 +1,156 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package retention
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gbevan/gostint/jobqueues"
+)
+
+func writePolicy(t *testing.T, data string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "gostint-retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	f := filepath.Join(dir, "policy.yml")
+	if err = ioutil.WriteFile(f, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestInitRejectsInvalidPolicies(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		want   string
+	}{
+		{"negative default", "default_max_age: -1h\n", "default_max_age"},
+		{"negative rule", "rules:\n  - status: failed\n    max_age: -5m\n", "max_age in rule 0"},
+		{"bad duration", "rules:\n  - max_age: forever\n", "max_age in rule 0"},
+		{"bad qname", "rules:\n  - qname: \"[\"\n", "qname pattern in rule 0"},
+		{"unknown field", "default_age: 1h\n", "Failed parsing yaml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Init(writePolicy(t, tt.policy), DefaultMaxAge)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Init() error = %v, want containing %q", err, tt.want)
+			}
+		})
+	}
+
+	if err := Init("", -time.Hour); err == nil {
+		t.Error("Init() accepted a negative default max age")
+	}
+}
+
+func TestPolicyMaxAge(t *testing.T) {
+	f := writePolicy(t, `default_max_age: 168h
+rules:
+  - status: failed
+    max_age: 720h
+  - qname: ^prod-
+    labels:
+      change: emergency
+    max_age: "0"
+  - qname: ^dev-
+`)
+	if err := Init(f, DefaultMaxAge); err != nil {
+		t.Fatal(err)
+	}
+	p := policy
+
+	tests := []struct {
+		name string
+		job  jobqueues.Job
+		want time.Duration
+	}{
+		{"status rule", jobqueues.Job{Status: "failed", Qname: "prod-a"}, 720 * time.Hour},
+		{"qname and labels", jobqueues.Job{
+			Status: "success", Qname: "prod-a", Labels: map[string]string{"change": "emergency"},
+		}, 0},
+		{"missing label", jobqueues.Job{Status: "success", Qname: "prod-a"}, 168 * time.Hour},
+		{"rule without max_age", jobqueues.Job{Status: "success", Qname: "dev-a"}, 168 * time.Hour},
+		{"default", jobqueues.Job{Status: "success", Qname: "other"}, 168 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.maxAge(&tt.job); got != tt.want {
+				t.Errorf("maxAge() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if got := p.minAge(); got != 168*time.Hour {
+		t.Errorf("minAge() = %s, want %s", got, 168*time.Hour)
+	}
+}
+
+func TestPolicyKeepForever(t *testing.T) {
+	if err := Init(writePolicy(t, "default_max_age: \"0\"\n"), DefaultMaxAge); err != nil {
+		t.Fatal(err)
+	}
+	if got := policy.minAge(); got != 0 {
+		t.Errorf("minAge() = %s, want 0 (keep forever)", got)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gostint-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jobs := []jobqueues.Job{{Qname: "a", Status: "success", CubbyToken: "s.cubby1234"}}
+	if err = archive(dir, jobs); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "gostint-jobs-*.jsonl.gz"))
+	if len(files) != 1 {
+		t.Fatalf("archive wrote %d files, want 1", len(files))
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"qname":"a"`) || strings.Contains(string(data), "s.cubby1234") {
+		t.Errorf("archive is not the sanitised job: %s", data)
+	}
+}
@@ -60,6 +60,15 @@ curl -s \
   --data '{"policy": "path \"database/creds/gostint-dbauth-role\" {\n  capabilities = [\"read\"]\n}"}' \
   ${VAULT_ADDR}/v1/sys/policy/gostint-mongodb-auth
 
+# Create policy to renew and revoke its db credentials' lease, and revoke the
+# leases of jobs orphaned by failed nodes
+echo '=== Create policy to renew and revoke leases ============'
+curl -s \
+  --request POST \
+  --header 'X-Vault-Token: root' \
+  --data '{"policy": "path \"sys/leases/renew\" {\n  capabilities = [\"update\"]\n}\npath \"sys/leases/revoke/*\" {\n  capabilities = [\"update\"]\n}"}' \
+  ${VAULT_ADDR}/v1/sys/policy/gostint-run-leases
+
 echo '=== Enable transit plugin ==============================='
 vault secrets enable transit
 
@@ -93,6 +102,14 @@ curl -s \
   --data '{"policy": "path \"transit/decrypt/'$GOSTINT_ROLENAME'\" {\n  capabilities = [\"update\"]\n}"}' \
   ${VAULT_ADDR}/v1/sys/policy/gostint-approle-transit-decrypt-gostint
 
+# Create policy to mint and revoke the jobs' own tokens for approle
+echo '=== Create policy to create and revoke job tokens for gostint-role =========='
+curl -s \
+  --request POST \
+  --header 'X-Vault-Token: root' \
+  --data '{"policy": "path \"auth/token/create\" {\n  capabilities = [\"update\"]\n}\npath \"auth/token/revoke-accessor\" {\n  capabilities = [\"update\"]\n}"}' \
+  ${VAULT_ADDR}/v1/sys/policy/gostint-approle-job-token
+
 # Create named AppRole for gostint
 echo '=== Create approle role for gostint ======================'
 vault write auth/approle/role/$GOSTINT_ROLENAME \
@@ -101,7 +118,7 @@ vault write auth/approle/role/$GOSTINT_ROLENAME \
   token_num_uses=10 \
   token_ttl=20m \
   token_max_ttl=30m \
-  policies="gostint-approle-secret-v1,gostint-approle-kv-v2,gostint-approle-transit-decrypt-gostint"
+  policies="gostint-approle-secret-v1,gostint-approle-kv-v2,gostint-approle-transit-decrypt-gostint,gostint-approle-job-token"
 
 # Get RoleID for gostint
 export GOSTINT_ROLEID=`vault read -format=yaml -field=data auth/approle/role/$GOSTINT_ROLENAME/role-id | awk '{print $2;}'`
@@ -111,10 +128,10 @@ echo -e "export GOSTINT_ROLEID=$GOSTINT_ROLEID\nexport GOSTINT_ROLENAME=$GOSTINT
 echo '=== Create approle role for gostint-run =================='
 GOSTINT_RUN_SECRETID=$(uuidgen)
 vault write auth/approle/role/$GOSTINT_RUN_ROLENAME \
-  token_num_uses=2 \
+  token_num_uses=0 \
   token_ttl=20m \
   token_max_ttl=30m \
-  policies="gostint-mongodb-auth"
+  policies="gostint-mongodb-auth,gostint-run-leases"
 
 echo '=== Add secret-id to gostint-run ========================='
 vault write auth/approle/role/$GOSTINT_RUN_ROLENAME/custom-secret-id \
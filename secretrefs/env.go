@@ -0,0 +1,45 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package secretrefs
+
+import (
+	"fmt"
+	"os"
+)
+
+// EnvPrefix is prepended to the variable named in env secretrefs, so jobs can
+// only read variables provisioned as secrets for them, not gostint's own
+// environment.
+const EnvPrefix = "GOSTINT_SECRET_"
+
+// envBackend reads secrets from the node's environment
+type envBackend struct{}
+
+func (b *envBackend) Read(name string) (*Secret, error) {
+	val, ok := os.LookupEnv(EnvPrefix + name)
+	if !ok {
+		return nil, fmt.Errorf("Environment variable %s%s is not set", EnvPrefix, name)
+	}
+	return &Secret{
+		Data: map[string]interface{}{
+			"value": val,
+		},
+	}, nil
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package secretrefs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// fileBackend reads secrets from files under the node's secrets_dir, for
+// docker/kubernetes mounted secrets, testing and air-gapped labs. Relative
+// paths are taken from secrets_dir, absolute paths must lie within it. A file
+// holding a yaml (or json) map provides its fields, otherwise its content is
+// the "value" field.
+type fileBackend struct {
+	dir string
+}
+
+func (b *fileBackend) resolve(path string) (string, error) {
+	if b.dir == "" {
+		return "", fmt.Errorf("file secretrefs are not enabled on this node (secrets_dir)")
+	}
+	dir, err := filepath.Abs(b.dir)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	path = filepath.Clean(path)
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("file secretref %s is outside the secrets_dir", path)
+	}
+	return path, nil
+}
+
+// canonical returns the path relative to the secrets_dir
+func (b *fileBackend) canonical(path string) string {
+	p, err := b.resolve(path)
+	if err != nil {
+		return path
+	}
+	dir, _ := filepath.Abs(b.dir)
+	rel, _ := filepath.Rel(dir, p)
+	return rel
+}
+
+func (b *fileBackend) isWholePath(path string) bool {
+	p, err := b.resolve(path)
+	if err != nil {
+		return false
+	}
+	fi, err := os.Stat(p)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+func (b *fileBackend) Read(path string) (*Secret, error) {
+	p, err := b.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read secret file %s: %s", path, err)
+	}
+
+	data := map[string]interface{}{}
+	if err = yaml.Unmarshal(content, &data); err != nil || len(data) == 0 {
+		data = map[string]interface{}{
+			"value": strings.TrimSuffix(string(content), "\n"),
+		}
+	}
+	for k, v := range data {
+		data[k] = normalise(v)
+	}
+	return &Secret{Data: data}, nil
+}
+
+// normalise converts the map[interface{}]interface{} of nested yaml maps to
+// map[string]interface{}, as returned by the vault, so they can be marshaled
+// to json.
+func normalise(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, e := range val {
+			m[fmt.Sprint(k)] = normalise(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range val {
+			val[i] = normalise(e)
+		}
+		return val
+	default:
+		return v
+	}
+}
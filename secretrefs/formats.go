@@ -0,0 +1,192 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package secretrefs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// SecretFiles maps each supported secret_file_type to the name of the secrets
+// file injected into the job's container.
+var SecretFiles = map[string]string{
+	"yaml":   "secrets.yml",
+	"json":   "secrets.json",
+	"dotenv": "secrets.env",
+	"hcl":    "secrets.tfvars",
+	"ini":    "secrets.ini",
+}
+
+// Encode formats the secrets for the secret_file_type
+func Encode(fileType string, secrets map[string]interface{}) ([]byte, error) {
+	switch fileType {
+	case "yaml":
+		secretsYAML, err := yaml.Marshal(secrets)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to Marshal secrets to yaml for container injection: %s", err)
+		}
+		yamlHdr := []byte("---\n# gostint vault secrets injected:\n")
+		return append(yamlHdr, secretsYAML...), nil
+
+	case "json":
+		secretsJSON, err := json.Marshal(secrets)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to Marshal secrets to json for container injection: %s", err)
+		}
+		return secretsJSON, nil
+
+	case "dotenv":
+		return encodeDotenv(secrets)
+
+	case "hcl":
+		var buf bytes.Buffer
+		buf.WriteString("# gostint vault secrets injected:\n")
+		for _, k := range sortedKeys(secrets) {
+			fmt.Fprintf(&buf, "%s = ", k)
+			writeHCL(&buf, secrets[k], "")
+			buf.WriteString("\n")
+		}
+		return buf.Bytes(), nil
+
+	case "ini":
+		return encodeINI(secrets)
+	}
+	return nil, fmt.Errorf("Invalid SecretFileType: '%s'", fileType)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// flatString returns scalars as a string, and nested maps and lists as json
+func flatString(v interface{}) (string, error) {
+	s, err := scalarString(v)
+	if err == nil {
+		return s, nil
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// encodeDotenv writes KEY="value" lines, double quoted with \ escapes as
+// understood by the common dotenv parsers.
+func encodeDotenv(secrets map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("# gostint vault secrets injected:\n")
+	for _, k := range sortedKeys(secrets) {
+		s, err := flatString(secrets[k])
+		if err != nil {
+			return nil, fmt.Errorf("Failed to format secret %s for dotenv: %s", k, err)
+		}
+		fmt.Fprintf(&buf, "%s=%s\n", k, strconv.Quote(s))
+	}
+	return buf.Bytes(), nil
+}
+
+var hclEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`"`, `\"`,
+	"\n", `\n`,
+	"\r", `\r`,
+	"\t", `\t`,
+	"${", "$${",
+	"%{", "%%{",
+)
+
+// writeHCL writes the value as a terraform (hcl2) tfvars expression
+func writeHCL(buf *bytes.Buffer, v interface{}, indent string) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		buf.WriteString("{\n")
+		for _, k := range sortedKeys(val) {
+			fmt.Fprintf(buf, "%s  \"%s\" = ", indent, hclEscaper.Replace(k))
+			writeHCL(buf, val[k], indent+"  ")
+			buf.WriteString("\n")
+		}
+		buf.WriteString(indent + "}")
+	case []interface{}:
+		buf.WriteString("[")
+		for i, e := range val {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			writeHCL(buf, e, indent)
+		}
+		buf.WriteString("]")
+	case json.Number, bool, int, int64, float64:
+		fmt.Fprint(buf, val)
+	case nil:
+		buf.WriteString("null")
+	default:
+		fmt.Fprintf(buf, "\"%s\"", hclEscaper.Replace(fmt.Sprint(val)))
+	}
+}
+
+// encodeINI writes scalar secrets as keys before any section, and secrets that
+// are maps as sections of their own. Values more deeply nested are json.
+// Values with newlines or surrounding spaces are double quoted.
+func encodeINI(secrets map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("; gostint vault secrets injected:\n")
+
+	writeKey := func(k string, v interface{}) error {
+		s, err := flatString(v)
+		if err != nil {
+			return fmt.Errorf("Failed to format secret %s for ini: %s", k, err)
+		}
+		if strings.ContainsAny(s, "\r\n") || strings.TrimSpace(s) != s {
+			s = strconv.Quote(s)
+		}
+		fmt.Fprintf(&buf, "%s = %s\n", k, s)
+		return nil
+	}
+
+	for _, k := range sortedKeys(secrets) {
+		if _, ok := secrets[k].(map[string]interface{}); !ok {
+			if err := writeKey(k, secrets[k]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, k := range sortedKeys(secrets) {
+		section, ok := secrets[k].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&buf, "\n[%s]\n", k)
+		for _, sk := range sortedKeys(section) {
+			if err := writeKey(sk, section[sk]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package secretrefs
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	secrets := map[string]interface{}{
+		"password": "p\"a ${x}\n",
+		"port":     5432,
+		"enabled":  true,
+		"db": map[string]interface{}{
+			"user":  "admin",
+			"hosts": []interface{}{"a", "b"},
+		},
+	}
+
+	tests := []struct {
+		fileType string
+		want     string
+	}{
+		{"yaml", `---
+# gostint vault secrets injected:
+db:
+  hosts:
+  - a
+  - b
+  user: admin
+enabled: true
+password: |
+  p"a ${x}
+port: 5432
+`},
+		{"json", `{"db":{"hosts":["a","b"],"user":"admin"},"enabled":true,"password":"p\"a ${x}\n","port":5432}`},
+		{"dotenv", `# gostint vault secrets injected:
+db="{\"hosts\":[\"a\",\"b\"],\"user\":\"admin\"}"
+enabled="true"
+password="p\"a ${x}\n"
+port="5432"
+`},
+		{"hcl", `# gostint vault secrets injected:
+db = {
+  "hosts" = ["a", "b"]
+  "user" = "admin"
+}
+enabled = true
+password = "p\"a $${x}\n"
+port = 5432
+`},
+		{"ini", `; gostint vault secrets injected:
+enabled = true
+password = "p\"a ${x}\n"
+port = 5432
+
+[db]
+hosts = ["a","b"]
+user = admin
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fileType, func(t *testing.T) {
+			if _, ok := SecretFiles[tt.fileType]; !ok {
+				t.Errorf("%s has no secrets file name", tt.fileType)
+			}
+			got, err := Encode(tt.fileType, secrets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Encode(%s) =\n%s\nwant:\n%s", tt.fileType, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := Encode("toml", secrets); err == nil {
+		t.Error("Encode() accepted an unknown secret_file_type")
+	}
+}
+
+func TestEncodeEmpty(t *testing.T) {
+	for fileType := range SecretFiles {
+		if _, err := Encode(fileType, map[string]interface{}{}); err != nil {
+			t.Errorf("Encode(%s) of no secrets: %s", fileType, err)
+		}
+	}
+}
+
+func TestEncodeHCLScalars(t *testing.T) {
+	got, err := Encode("hcl", map[string]interface{}{
+		"n":   json.Number("1.5"),
+		"nil": nil,
+		"tpl": "%{if x}\t",
+		"esc": `back\slash`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# gostint vault secrets injected:
+esc = "back\\slash"
+n = 1.5
+nil = null
+tpl = "%%{if x}\t"
+`
+	if string(got) != want {
+		t.Errorf("Encode(hcl) =\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestEncodeINIQuoting(t *testing.T) {
+	got, err := Encode("ini", map[string]interface{}{
+		"padded": " x ",
+		"plain":  "x y",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `; gostint vault secrets injected:
+padded = " x "
+plain = x y
+`
+	if string(got) != want {
+		t.Errorf("Encode(ini) =\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package secretrefs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// minRenewal stops renewing a lease whose granted duration has fallen below
+// it, i.e. the lease has reached its max ttl and will expire regardless.
+const minRenewal = 5 * time.Second
+
+// KeepLeases renews the renewable leases read so far in the background, at two
+// thirds of their duration, until Release is called. Renewal failures are
+// passed to report.
+func (r *Resolver) KeepLeases(report func(msg string)) {
+	for _, l := range r.Leases {
+		if !l.Renewable || l.Duration <= 0 {
+			continue
+		}
+		r.renewals.Add(1)
+		go func(l Lease) {
+			defer r.renewals.Done()
+			d := l.Duration
+			for {
+				select {
+				case <-r.stop:
+					return
+				case <-time.After(d * 2 / 3):
+				}
+				s, err := r.vclient.Sys().Renew(l.ID, int(l.Duration/time.Second))
+				if err != nil {
+					report(fmt.Sprintf("Failed to renew lease %s: %s", l.ID, err))
+					return
+				}
+				if s == nil || s.LeaseDuration <= 0 {
+					return
+				}
+				d = time.Duration(s.LeaseDuration) * time.Second
+				if d < minRenewal {
+					report(fmt.Sprintf("Lease %s reached its max ttl, expires in %s", l.ID, d))
+					return
+				}
+			}
+		}(l)
+	}
+}
+
+// Release stops renewing and revokes all the leases read, passing revocation
+// failures to report.
+func (r *Resolver) Release(report func(msg string)) {
+	close(r.stop)
+	r.renewals.Wait()
+	for _, l := range r.Leases {
+		if err := r.vclient.Sys().Revoke(l.ID); err != nil {
+			report(fmt.Sprintf("Failed to revoke lease %s: %s", l.ID, err))
+		}
+	}
+}
+
+// RevokeLeases revokes leases by id with vclient, for leases recorded for a
+// job whose resolver was lost with the node that ran it, passing revocation
+// failures to report.
+func RevokeLeases(vclient *api.Client, ids []string, report func(msg string)) {
+	for _, id := range ids {
+		if err := vclient.Sys().Revoke(id); err != nil {
+			report(fmt.Sprintf("Failed to revoke lease %s: %s", id, err))
+		}
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package secretrefs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gbevan/gostint/config"
+	"github.com/hashicorp/vault/api"
+)
+
+// fakeVault returns a client of a fake vault server recording the paths
+// requested, failing those ending in "bad", and a func returning them.
+func fakeVault(t *testing.T) (*api.Client, func() []string) {
+	t.Helper()
+	var mutex sync.Mutex
+	paths := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		mutex.Unlock()
+		if strings.HasSuffix(r.URL.Path, "bad") {
+			http.Error(w, `{"errors":["lease not found"]}`, http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+	vclient, err := api.NewClient(&api.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vclient.SetToken("gostint-token")
+	return vclient, func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string{}, paths...)
+	}
+}
+
+func TestRevokeLeases(t *testing.T) {
+	vclient, paths := fakeVault(t)
+	reports := []string{}
+	RevokeLeases(vclient, []string{"database/creds/app/l1", "database/creds/app/bad"}, func(msg string) {
+		reports = append(reports, msg)
+	})
+
+	want := []string{
+		"PUT /v1/sys/leases/revoke/database/creds/app/l1",
+		"PUT /v1/sys/leases/revoke/database/creds/app/bad",
+	}
+	if got := paths(); !reflect.DeepEqual(got, want) {
+		t.Errorf("requests = %q, want %q", got, want)
+	}
+	if len(reports) != 1 || !strings.HasPrefix(reports[0], "Failed to revoke lease database/creds/app/bad:") {
+		t.Errorf("reports = %q, want the failed revocation", reports)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	Init(&config.Config{})
+	vclient, paths := fakeVault(t)
+	r := NewResolver(vclient, false, nil)
+	r.Leases = []Lease{
+		{ID: "database/creds/app/l1"},
+		{ID: "aws/creds/app/l2", Duration: time.Hour, Renewable: true},
+	}
+	r.KeepLeases(func(msg string) { t.Errorf("report: %s", msg) })
+	r.Release(func(msg string) { t.Errorf("report: %s", msg) })
+
+	want := []string{
+		"PUT /v1/sys/leases/revoke/database/creds/app/l1",
+		"PUT /v1/sys/leases/revoke/aws/creds/app/l2",
+	}
+	if got := paths(); !reflect.DeepEqual(got, want) {
+		t.Errorf("requests = %q, want %q (revoked without waiting to renew)", got, want)
+	}
+}
@@ -0,0 +1,386 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package secretrefs
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gbevan/gostint/config"
+	"github.com/hashicorp/vault/api"
+)
+
+// Secret refs take the form var@[scheme:]path[.key][?options], e.g.
+//   pw@kv/data/x.password               (vault kv, the default scheme)
+//   pw@vault:kv/data/x.password
+//   db@vault-dynamic:database/creds/role
+//   kubeconfig@file:/run/secrets/kubeconfig
+//   api_key@env:API_KEY
+// The key is the text after the last "." in the final path element. Without a
+// key the secret's only "value" field is used, or every field is injected as
+// var_field.
+//
+// Options, url query encoded, select how the secret is injected:
+//   as=value    into the secrets file (the default)
+//   as=map      the whole secret, as a nested map, into the secrets file
+//   as=env      as environment variable var
+//   as=file     as its own file, with:
+//     path=/abs/path   (required)
+//     mode=0400        (octal, the default)
+//     owner=uid:gid    (defaults to the gostint user)
+//     encoding=base64  to decode the value, e.g. for binary files
+
+// DefaultScheme is used for secret refs without a scheme
+const DefaultScheme = "vault"
+
+var refRe = regexp.MustCompile(`^(\w+)@(?:([a-z][a-z\-]*):)?(.+)$`)
+
+// Ways a secret can be injected, see the as option
+const (
+	AsValue = "value"
+	AsMap   = "map"
+	AsEnv   = "env"
+	AsFile  = "file"
+)
+
+// DefaultFileMode of secrets injected as files
+const DefaultFileMode = 0400
+
+// Ref is a parsed secret ref
+type Ref struct {
+	Var    string
+	Scheme string
+	Path   string
+	Key    string
+
+	As       string
+	FilePath string
+	Mode     int64
+	Owner    *Owner
+	Encoding string
+}
+
+// Owner of a secret injected as a file
+type Owner struct {
+	UID int
+	GID int
+}
+
+// Injection is a resolved secret to be placed in the job's container
+type Injection struct {
+	Var   string
+	As    string
+	Value interface{} // string, or for values nested maps and lists
+
+	// As files
+	FilePath string
+	Content  []byte
+	Mode     int64
+	Owner    *Owner
+}
+
+// Secret is the data read from a backend
+type Secret struct {
+	Data     map[string]interface{}
+	Warnings []string
+	Lease    *Lease
+}
+
+// Lease identifies a dynamic secret's lease in the vault
+type Lease struct {
+	ID        string
+	Duration  time.Duration
+	Renewable bool
+}
+
+// Backend reads secrets for a scheme
+type Backend interface {
+	Read(path string) (*Secret, error)
+}
+
+// wholePather is implemented by backends whose paths may contain "." (e.g.
+// file names), reporting if the whole ref path exists so it is not split into
+// path and key.
+type wholePather interface {
+	isWholePath(path string) bool
+}
+
+// canonicaliser is implemented by backends whose paths have more than one
+// form, returning the form queue secret_backends paths are matched against.
+type canonicaliser interface {
+	canonical(path string) string
+}
+
+// SecretRefs holds module state
+type SecretRefs struct {
+	Cfg *config.Config
+}
+
+var secretRefs SecretRefs
+
+// Init sets the config used by the local backends
+func Init(cfg *config.Config) {
+	secretRefs.Cfg = cfg
+}
+
+// Resolver resolves a job's secret refs, caching each secret read so multiple
+// keys can be taken from one read (and so one set of dynamic credentials).
+type Resolver struct {
+	vclient  *api.Client
+	backends map[string]Backend
+	allowed  []config.SecretBackend
+	cache    map[string]*Secret
+
+	// Fail reads returning warnings unless set
+	ContOnWarnings bool
+
+	// Leases of dynamic secrets read for the job
+	Leases []Lease
+
+	stop     chan struct{}
+	renewals sync.WaitGroup
+}
+
+// NewResolver returns a resolver for a job, vault backends reading with the
+// job's authenticated vault client, limited to the backends allowed to the
+// job's queue.
+func NewResolver(vclient *api.Client, contOnWarnings bool, allowed []config.SecretBackend) *Resolver {
+	return &Resolver{
+		vclient: vclient,
+		allowed: allowed,
+		backends: map[string]Backend{
+			"vault":         &vaultBackend{client: vclient},
+			"vault-dynamic": &vaultBackend{client: vclient, dynamic: true},
+			"file":          &fileBackend{dir: secretRefs.Cfg.SecretsDir},
+			"env":           &envBackend{},
+		},
+		ContOnWarnings: contOnWarnings,
+		cache:          map[string]*Secret{},
+		stop:           make(chan struct{}),
+	}
+}
+
+// Parse splits a secret ref into its parts
+func (r *Resolver) Parse(ref string) (*Ref, error) {
+	parts := refRe.FindStringSubmatch(ref)
+	if parts == nil {
+		return nil, fmt.Errorf("Secretref is unparseable: %s", ref)
+	}
+	sr := Ref{
+		Var:    parts[1],
+		Scheme: parts[2],
+		Path:   parts[3],
+		As:     AsValue,
+	}
+	if q := strings.Index(sr.Path, "?"); q >= 0 {
+		if err := sr.parseOptions(sr.Path[q+1:]); err != nil {
+			return nil, fmt.Errorf("Invalid options in secretref %s: %s", ref, err)
+		}
+		sr.Path = sr.Path[:q]
+	}
+	if sr.Scheme == "" {
+		sr.Scheme = DefaultScheme
+	}
+	backend, ok := r.backends[sr.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("Unknown scheme '%s' in secretref: %s", sr.Scheme, ref)
+	}
+
+	wp, ok := backend.(wholePather)
+	if !ok || !wp.isWholePath(sr.Path) {
+		dot := strings.LastIndex(sr.Path, ".")
+		if dot > strings.LastIndex(sr.Path, "/") {
+			sr.Key = sr.Path[dot+1:]
+			sr.Path = sr.Path[:dot]
+		}
+	}
+	if sr.Path == "" {
+		return nil, fmt.Errorf("Secretref must have a path: %s", ref)
+	}
+
+	p := sr.Path
+	if c, ok := backend.(canonicaliser); ok {
+		p = c.canonical(p)
+	}
+	if !config.AllowsSecret(r.allowed, sr.Scheme, p) {
+		return nil, fmt.Errorf("Secretref %s is not allowed by the queue's secret_backends", ref)
+	}
+	return &sr, nil
+}
+
+func (sr *Ref) parseOptions(query string) error {
+	opts, err := url.ParseQuery(query)
+	if err != nil {
+		return err
+	}
+	for k, vs := range opts {
+		v := vs[len(vs)-1]
+		switch k {
+		case "as":
+			switch v {
+			case AsValue, AsMap, AsEnv, AsFile:
+				sr.As = v
+			default:
+				return fmt.Errorf("unknown as '%s'", v)
+			}
+		case "path":
+			sr.FilePath = v
+		case "mode":
+			mode, err := strconv.ParseInt(v, 8, 32)
+			if err != nil || mode < 0 || mode > 07777 {
+				return fmt.Errorf("mode '%s' is not an octal file mode", v)
+			}
+			sr.Mode = mode
+		case "owner":
+			ids := strings.Split(v, ":")
+			uid, errU := strconv.Atoi(ids[0])
+			gid, errG := strconv.Atoi(ids[len(ids)-1])
+			if len(ids) > 2 || errU != nil || errG != nil || uid < 0 || gid < 0 {
+				return fmt.Errorf("owner '%s' is not numeric uid:gid", v)
+			}
+			sr.Owner = &Owner{UID: uid, GID: gid}
+		case "encoding":
+			if v != "base64" {
+				return fmt.Errorf("unknown encoding '%s'", v)
+			}
+			sr.Encoding = v
+		default:
+			return fmt.Errorf("unknown option '%s'", k)
+		}
+	}
+
+	if sr.As == AsFile {
+		if sr.FilePath == "" || !path.IsAbs(sr.FilePath) {
+			return fmt.Errorf("as=file requires an absolute path")
+		}
+		sr.FilePath = path.Clean(sr.FilePath)
+		if sr.Mode == 0 {
+			sr.Mode = DefaultFileMode
+		}
+	} else if sr.FilePath != "" || sr.Mode != 0 || sr.Owner != nil || sr.Encoding != "" {
+		return fmt.Errorf("path, mode, owner and encoding only apply to as=file")
+	}
+	return nil
+}
+
+// Resolve reads the secret ref, returning the secrets to inject
+func (r *Resolver) Resolve(ref string) ([]Injection, error) {
+	sr, err := r.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheKey := sr.Scheme + ":" + sr.Path
+	secret := r.cache[cacheKey]
+	if secret == nil {
+		secret, err = r.backends[sr.Scheme].Read(sr.Path)
+		if err != nil {
+			return nil, err
+		}
+		if !r.ContOnWarnings && len(secret.Warnings) > 0 {
+			return nil, fmt.Errorf("FailOnWarnings from %s path %s lookups: %v", sr.Scheme, sr.Path, secret.Warnings)
+		}
+		if secret.Lease != nil {
+			r.Leases = append(r.Leases, *secret.Lease)
+		}
+		r.cache[cacheKey] = secret
+	}
+
+	// select the value(s) from the secret
+	values := map[string]interface{}{}
+	if sr.Key != "" {
+		v, ok := secret.Data[sr.Key]
+		if !ok || v == nil {
+			return nil, fmt.Errorf("Failed retrieving from %s path %s.%s: key not found", sr.Scheme, sr.Path, sr.Key)
+		}
+		values[sr.Var] = v
+	} else if sr.As == AsMap {
+		values[sr.Var] = secret.Data
+	} else if v, ok := secret.Data["value"]; ok && len(secret.Data) == 1 {
+		values[sr.Var] = v
+	} else {
+		for k, v := range secret.Data {
+			values[sr.Var+"_"+k] = v
+		}
+	}
+
+	names := []string{}
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	injs := []Injection{}
+	for _, name := range names {
+		inj := Injection{
+			Var:   name,
+			As:    sr.As,
+			Value: values[name],
+		}
+		switch sr.As {
+		case AsEnv:
+			s, err := scalarString(inj.Value)
+			if err != nil {
+				return nil, fmt.Errorf("Failed injecting %s from %s path %s as env: %s", name, sr.Scheme, sr.Path, err)
+			}
+			inj.Value = s
+		case AsFile:
+			if len(values) > 1 {
+				return nil, fmt.Errorf("Secretref %s as=file must select a single value", ref)
+			}
+			s, err := scalarString(inj.Value)
+			if err != nil {
+				return nil, fmt.Errorf("Failed injecting %s from %s path %s as file: %s", name, sr.Scheme, sr.Path, err)
+			}
+			inj.Content = []byte(s)
+			if sr.Encoding == "base64" {
+				if inj.Content, err = base64.StdEncoding.DecodeString(s); err != nil {
+					return nil, fmt.Errorf("Failed decoding base64 of %s from %s path %s: %s", name, sr.Scheme, sr.Path, err)
+				}
+			}
+			inj.Value = nil
+			inj.FilePath = sr.FilePath
+			inj.Mode = sr.Mode
+			inj.Owner = sr.Owner
+		}
+		injs = append(injs, inj)
+	}
+	return injs, nil
+}
+
+// scalarString returns string, number and boolean values as a string
+func scalarString(v interface{}) (string, error) {
+	switch val := v.(type) {
+	case string:
+		return val, nil
+	case map[string]interface{}, []interface{}, nil:
+		return "", fmt.Errorf("value is not a string")
+	default:
+		return fmt.Sprint(val), nil
+	}
+}
@@ -0,0 +1,245 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package secretrefs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gbevan/gostint/config"
+)
+
+// testSecretsDir inits the package with a secrets_dir holding lab/db.yml
+func testSecretsDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "gostint-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err = os.MkdirAll(filepath.Join(dir, "lab"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"lab/db.yml": "user: admin\npassword: s3cret\n",
+		"other.txt":  "other\n",
+	}
+	for name, data := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	Init(&config.Config{SecretsDir: dir})
+	return dir
+}
+
+func TestParseAllowedBackends(t *testing.T) {
+	dir := testSecretsDir(t)
+	lab := []config.SecretBackend{
+		{Scheme: "vault", Paths: []string{"secret/data/lab"}},
+		{Scheme: "file", Paths: []string{"lab/"}},
+		{Scheme: "env", Paths: []string{"LAB_API_KEY"}},
+	}
+
+	tests := []struct {
+		name    string
+		allowed []config.SecretBackend
+		ref     string
+		ok      bool
+	}{
+		{"default vault", config.DefaultSecretBackends, "pw@secret/data/x.password", true},
+		{"default vault-dynamic", config.DefaultSecretBackends, "db@vault-dynamic:database/creds/ro", true},
+		{"default file", config.DefaultSecretBackends, "pw@file:lab/db.yml.password", false},
+		{"default env", config.DefaultSecretBackends, "key@env:LAB_API_KEY", false},
+		{"vault path", lab, "pw@secret/data/lab/x.password", true},
+		{"vault path prefix is not a directory", lab, "pw@secret/data/labs/x.password", false},
+		{"vault other path", lab, "pw@secret/data/prod/x.password", false},
+		{"vault-dynamic not listed", lab, "db@vault-dynamic:database/creds/ro", false},
+		{"file relative", lab, "pw@file:lab/db.yml.password", true},
+		{"file absolute", lab, "pw@file:" + filepath.Join(dir, "lab/db.yml") + ".password", true},
+		{"file outside paths", lab, "o@file:other.txt", false},
+		{"file escaping paths", lab, "o@file:lab/../other.txt", false},
+		{"env listed", lab, "key@env:LAB_API_KEY", true},
+		{"env not listed", lab, "key@env:PROD_API_KEY", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewResolver(nil, false, tt.allowed).Parse(tt.ref)
+			if tt.ok && err != nil {
+				t.Errorf("Parse(%s) = %v, want allowed", tt.ref, err)
+			}
+			if !tt.ok && (err == nil || !strings.Contains(err.Error(), "secret_backends")) {
+				t.Errorf("Parse(%s) = %v, want not allowed by secret_backends", tt.ref, err)
+			}
+		})
+	}
+}
+
+func TestResolveLocalBackends(t *testing.T) {
+	testSecretsDir(t)
+	t.Setenv(EnvPrefix+"LAB_API_KEY", "k3y")
+	r := NewResolver(nil, false, []config.SecretBackend{{Scheme: "file"}, {Scheme: "env"}})
+
+	injs, err := r.Resolve("pw@file:lab/db.yml.password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(injs) != 1 || injs[0].Var != "pw" || injs[0].Value != "s3cret" {
+		t.Errorf("file Resolve() = %+v", injs)
+	}
+
+	injs, err = r.Resolve("db@file:lab/db.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(injs) != 2 || injs[0].Var != "db_password" || injs[1].Var != "db_user" {
+		t.Errorf("file Resolve() of all fields = %+v", injs)
+	}
+
+	injs, err = r.Resolve("key@env:LAB_API_KEY?as=env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(injs) != 1 || injs[0].As != AsEnv || injs[0].Value != "k3y" {
+		t.Errorf("env Resolve() = %+v", injs)
+	}
+
+	if _, err = r.Resolve("key@env:MISSING"); err == nil {
+		t.Error("env Resolve() of an unset variable succeeded")
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		ref  string
+		want Ref
+		err  string
+	}{
+		{"default", "pw@secret/data/x.password", Ref{
+			Var: "pw", Scheme: "vault", Path: "secret/data/x", Key: "password", As: AsValue,
+		}, ""},
+		{"no key", "db@vault-dynamic:database/creds/ro", Ref{
+			Var: "db", Scheme: "vault-dynamic", Path: "database/creds/ro", As: AsValue,
+		}, ""},
+		{"as map", "cfg@secret/data/x?as=map", Ref{
+			Var: "cfg", Scheme: "vault", Path: "secret/data/x", As: AsMap,
+		}, ""},
+		{"as env", "pw@secret/data/x.password?as=env", Ref{
+			Var: "pw", Scheme: "vault", Path: "secret/data/x", Key: "password", As: AsEnv,
+		}, ""},
+		{"as file defaults", "kc@secret/data/k.config?as=file&path=/home/u/.kube/../.kube/config", Ref{
+			Var: "kc", Scheme: "vault", Path: "secret/data/k", Key: "config", As: AsFile,
+			FilePath: "/home/u/.kube/config", Mode: DefaultFileMode,
+		}, ""},
+		{"as file options", "ca@secret/data/k.ca?as=file&path=/etc/ca.der&mode=0644&owner=1000:100&encoding=base64", Ref{
+			Var: "ca", Scheme: "vault", Path: "secret/data/k", Key: "ca", As: AsFile,
+			FilePath: "/etc/ca.der", Mode: 0644, Owner: &Owner{UID: 1000, GID: 100}, Encoding: "base64",
+		}, ""},
+		{"owner uid only", "ca@secret/data/k.ca?as=file&path=/ca&owner=1000", Ref{
+			Var: "ca", Scheme: "vault", Path: "secret/data/k", Key: "ca", As: AsFile,
+			FilePath: "/ca", Mode: DefaultFileMode, Owner: &Owner{UID: 1000, GID: 1000},
+		}, ""},
+		{"unparseable", "no-var", Ref{}, "unparseable"},
+		{"unknown scheme", "pw@aws:bucket/x", Ref{}, "Unknown scheme"},
+		{"no path", "pw@vault:.password", Ref{}, "must have a path"},
+		{"unknown as", "pw@secret/data/x?as=tmpfs", Ref{}, "unknown as"},
+		{"unknown option", "pw@secret/data/x?ttl=1h", Ref{}, "unknown option"},
+		{"file needs path", "pw@secret/data/x?as=file", Ref{}, "absolute path"},
+		{"file relative path", "pw@secret/data/x?as=file&path=etc/x", Ref{}, "absolute path"},
+		{"bad mode", "pw@secret/data/x?as=file&path=/x&mode=999", Ref{}, "octal file mode"},
+		{"mode too large", "pw@secret/data/x?as=file&path=/x&mode=17777", Ref{}, "octal file mode"},
+		{"bad owner", "pw@secret/data/x?as=file&path=/x&owner=root", Ref{}, "numeric uid:gid"},
+		{"negative owner", "pw@secret/data/x?as=file&path=/x&owner=1:-1", Ref{}, "numeric uid:gid"},
+		{"too many ids", "pw@secret/data/x?as=file&path=/x&owner=1:2:3", Ref{}, "numeric uid:gid"},
+		{"bad encoding", "pw@secret/data/x?as=file&path=/x&encoding=hex", Ref{}, "unknown encoding"},
+		{"file options without file", "pw@secret/data/x?mode=0400", Ref{}, "only apply to as=file"},
+		{"bad query", "pw@secret/data/x?as=%zz", Ref{}, "Invalid options"},
+	}
+	r := NewResolver(nil, false, config.DefaultSecretBackends)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.Parse(tt.ref)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("Parse(%s) error = %v, want containing %q", tt.ref, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse(%s) error = %v", tt.ref, err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("Parse(%s) =\n%+v\nwant\n%+v", tt.ref, *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveInjections(t *testing.T) {
+	r := NewResolver(nil, false, config.DefaultSecretBackends)
+	r.cache["vault:secret/data/x"] = &Secret{Data: map[string]interface{}{
+		"user":     "admin",
+		"password": "s3cret",
+		"der":      "AAEC",
+		"nested":   map[string]interface{}{"a": "b"},
+	}}
+	r.cache["vault:secret/data/v"] = &Secret{Data: map[string]interface{}{"value": "only"}}
+
+	tests := []struct {
+		name string
+		ref  string
+		want []Injection
+		err  string
+	}{
+		{"key", "pw@secret/data/x.password", []Injection{{Var: "pw", As: AsValue, Value: "s3cret"}}, ""},
+		{"only value", "v@secret/data/v", []Injection{{Var: "v", As: AsValue, Value: "only"}}, ""},
+		{"map", "m@secret/data/v?as=map", []Injection{{Var: "m", As: AsMap, Value: map[string]interface{}{"value": "only"}}}, ""},
+		{"env", "PW@secret/data/x.password?as=env", []Injection{{Var: "PW", As: AsEnv, Value: "s3cret"}}, ""},
+		{"file base64", "d@secret/data/x.der?as=file&path=/d&encoding=base64", []Injection{{
+			Var: "d", As: AsFile, FilePath: "/d", Content: []byte{0, 1, 2}, Mode: DefaultFileMode,
+		}}, ""},
+		{"missing key", "pw@secret/data/x.nope", nil, "key not found"},
+		{"env of a map", "n@secret/data/x.nested?as=env", nil, "value is not a string"},
+		{"file of several values", "all@secret/data/x?as=file&path=/all", nil, "must select a single value"},
+		{"bad base64", "pw@secret/data/x.password?as=file&path=/p&encoding=base64", nil, "Failed decoding base64"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.Resolve(tt.ref)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("Resolve(%s) error = %v, want containing %q", tt.ref, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve(%s) error = %v", tt.ref, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Resolve(%s) =\n%+v\nwant\n%+v", tt.ref, got, tt.want)
+			}
+		})
+	}
+}
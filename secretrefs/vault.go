@@ -0,0 +1,65 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package secretrefs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// vaultBackend reads secrets from the vault with the job's token. kv v2
+// responses are unwrapped from their "data" field unless dynamic, whose
+// engines (database, aws, ...) return their fields at the top level.
+type vaultBackend struct {
+	client  *api.Client
+	dynamic bool
+}
+
+func (b *vaultBackend) Read(path string) (*Secret, error) {
+	s, err := b.client.Logical().Read(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to retrieve secret %s from vault err: %v", path, err)
+	}
+	if s == nil {
+		return nil, fmt.Errorf("Failed to retrieve secret %s from vault: response is nil", path)
+	}
+
+	secret := Secret{
+		Warnings: s.Warnings,
+	}
+	if s.LeaseID != "" {
+		secret.Lease = &Lease{
+			ID:        s.LeaseID,
+			Duration:  time.Duration(s.LeaseDuration) * time.Second,
+			Renewable: s.Renewable,
+		}
+	}
+
+	if data, ok := s.Data["data"].(map[string]interface{}); ok && !b.dynamic { // kv v2
+		secret.Data = data
+	} else if s.Data != nil { // kv v1 or dynamic
+		secret.Data = s.Data
+	} else {
+		return nil, fmt.Errorf("No data returned from vault path %s", path)
+	}
+	return &secret, nil
+}
@@ -12,4 +12,12 @@ export GOSTINT_SSL_CERT="${GOSTINT_SSL_CERT:-/var/lib/gostint/cert.pem}"
 export GOSTINT_SSL_KEY="${GOSTINT_SSL_KEY:-/var/lib/gostint/key.pem}"
 export GOSTINT_DBURL="${GOSTINT_DBURL:-172.17.0.1:27017}"
 
+# keep job secrets on a tmpfs, /dev/shm is shared with the dockerd above,
+# unless GOSTINT_SECRETS_TMPFS_DIR is set empty
+export GOSTINT_SECRETS_TMPFS_DIR="${GOSTINT_SECRETS_TMPFS_DIR-/dev/shm/gostint}"
+if [ -n "$GOSTINT_SECRETS_TMPFS_DIR" ]
+then
+  mkdir -p -m 0700 "$GOSTINT_SECRETS_TMPFS_DIR"
+fi
+
 /usr/bin/gostint
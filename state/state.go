@@ -23,6 +23,7 @@ import (
 	"os"
 	"os/signal"
 	"sync"
+	"syscall"
 
 	"github.com/gbevan/gostint/logmsg"
 	. "github.com/visionmedia/go-debug" // nolint
@@ -40,6 +41,8 @@ type State struct {
 var (
 	state      State
 	stateMutex sync.Mutex
+
+	shutdown = make(chan struct{})
 )
 
 // Init initialises
@@ -52,21 +55,28 @@ func Init(nodeUUID string) {
 	}
 	stateMutex.Unlock()
 
-	// SIGINT Handler to drain the node for shutdown
+	// SIGINT/SIGTERM Handler to drain the node for shutdown, a second signal
+	// exits immediately
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, os.Interrupt)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		for {
-			sig := <-sigs
-			switch sig {
-			case os.Interrupt:
-				logmsg.Info("SIGINT received, draining node...")
-				SetState("draining")
-			}
-		}
+		sig := <-sigs
+		logmsg.Info("%s received, draining node for shutdown...", sig)
+		SetState("draining")
+		close(shutdown)
+
+		sig = <-sigs
+		logmsg.Warn("%s received while draining, exiting now", sig)
+		os.Exit(1)
 	}()
 }
 
+// Shutdown returns a channel that is closed when the node has been signalled
+// to shut down
+func Shutdown() <-chan struct{} {
+	return shutdown
+}
+
 // SetState sets the node's State
 func SetState(s string) {
 	stateMutex.Lock()
@@ -97,7 +97,9 @@
   output="$(echo $R | jq .output -r)"
 
   # [ "$output" != "" ]
-  echo "$output" | grep "mysecret : s3cr3t"
+  # injected secrets are masked in the captured output
+  echo "$output" | grep -F "mysecret : ********"
+  [[ "$output" != *s3cr3t* ]]
 }
 
 @test "Should delete the job id" {
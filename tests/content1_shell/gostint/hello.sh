@@ -7,8 +7,8 @@ ps -efl
 
 ls -l /
 
-ls -laR /gostint /secrets*
-cat /secrets.yml
+ls -laR /gostint "$GOSTINT_SECRETS_FILE"
+cat "$GOSTINT_SECRETS_FILE"
 
 #ping -c 3 www.google.com  needs root/sudo/u+s
 
@@ -0,0 +1,55 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package configApi
+
+import (
+	"net/http"
+
+	"github.com/gbevan/gostint/authenticate"
+	"github.com/gbevan/gostint/config"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+// ConfigRouter holds config state
+type ConfigRouter struct { // nolint
+	Cfg *config.Config
+}
+
+var configRouter ConfigRouter
+
+// Routes Route handler for config
+func Routes(cfg *config.Config) *chi.Mux {
+	configRouter = ConfigRouter{
+		Cfg: cfg,
+	}
+	router := chi.NewRouter()
+	router.Use(
+		authenticate.Authenticate,
+		authenticate.RequirePolicy(authenticate.AdminPolicy),
+	)
+	router.Get("/", getConfig)
+	return router
+}
+
+// Retrieve this Gostint instance's configuration, with secrets redacted
+func getConfig(w http.ResponseWriter, req *http.Request) {
+	render.JSON(w, req, configRouter.Cfg.Redacted())
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package contentApi
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gbevan/gostint/apierrors"
+	"github.com/gbevan/gostint/authenticate"
+	"github.com/gbevan/gostint/config"
+	"github.com/gbevan/gostint/content"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+// ContentRouter holds config state
+type ContentRouter struct { // nolint
+	Cfg *config.Config
+}
+
+var contentRouter ContentRouter
+
+// Routes Route handlers for uploaded job content
+func Routes(cfg *config.Config) *chi.Mux {
+	contentRouter = ContentRouter{
+		Cfg: cfg,
+	}
+	router := chi.NewRouter()
+	router.Use(
+		authenticate.Authenticate,
+	)
+	router.Post("/", postContent)
+	router.Get("/{sha256}", getContent)
+	return router
+}
+
+type postResponse struct {
+	Ref       string `json:"ref"`
+	Sha256    string `json:"sha256"`
+	Format    string `json:"format"`
+	Encrypted bool   `json:"encrypted"`
+	Size      int    `json:"size"`
+	Existed   bool   `json:"existed"`
+}
+
+// postContent stores an uploaded content archive, the request body, returning
+// the ref for jobs to use as their content.
+// curl http://127.0.0.1:3232/v1/api/content?format=targz -X POST --data-binary @content.tar.gz
+// With encrypted=true the body is the vault transit ciphertext (for the
+// gostint AppRole's key) of the base64 encoded archive.
+func postContent(w http.ResponseWriter, req *http.Request) {
+	format := req.URL.Query().Get("format")
+	if format == "" {
+		format = "targz"
+	}
+	encrypted := req.URL.Query().Get("encrypted") == "true"
+
+	body := http.MaxBytesReader(w, req.Body, int64(contentRouter.Cfg.ContentMaxUploadSize))
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		render.Render(w, req, apierrors.ErrInvalidRequest(fmt.Errorf("Failed reading content (content_max_upload_size is %d): %s", contentRouter.Cfg.ContentMaxUploadSize, err)))
+		return
+	}
+	if len(data) == 0 {
+		render.Render(w, req, apierrors.ErrInvalidRequest(errors.New("Content missing from POST body")))
+		return
+	}
+	if encrypted && !strings.HasPrefix(string(data), "vault:") {
+		render.Render(w, req, apierrors.ErrInvalidRequest(errors.New("Encrypted content must be vault transit ciphertext")))
+		return
+	}
+	if !content.Formats[format] {
+		render.Render(w, req, apierrors.ErrInvalidRequest(fmt.Errorf("Unsupported content archive format: %s", format)))
+		return
+	}
+
+	blob, existed, err := content.Store(format, encrypted, authenticate.Identity(req), data)
+	if err != nil {
+		render.Render(w, req, apierrors.ErrInternalError(err))
+		return
+	}
+	render.JSON(w, req, postResponse{
+		Ref:       "ref," + content.RefPrefix + blob.ID,
+		Sha256:    blob.ID,
+		Format:    blob.Format,
+		Encrypted: blob.Encrypted,
+		Size:      blob.Size,
+		Existed:   existed,
+	})
+}
+
+// getContent returns the description of uploaded content, including the
+// jobs referencing it and its uploaders for admins only
+func getContent(w http.ResponseWriter, req *http.Request) {
+	sum := strings.TrimPrefix(chi.URLParam(req, "sha256"), content.RefPrefix)
+	blob, err := content.GetBlob(sum)
+	if err != nil {
+		render.Render(w, req, apierrors.ErrNotFound(err))
+		return
+	}
+	if !authenticate.IsAdmin(req) {
+		blob.Refs = nil
+		blob.Uploaders = nil
+	}
+	render.JSON(w, req, blob)
+}
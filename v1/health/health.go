@@ -32,7 +32,7 @@ import (
 
 // HealthRouter holds config state, e.g. the handle for the database
 type HealthRouter struct { // nolint
-	Db *mgo.Database
+	Db func() *mgo.Database
 }
 
 var (
@@ -48,7 +48,7 @@ var (
 )
 
 // Routes Route handler for health
-func Routes(db *mgo.Database) *chi.Mux {
+func Routes(db func() *mgo.Database) *chi.Mux {
 	healthRouter = HealthRouter{
 		Db: db,
 	}
@@ -20,16 +20,20 @@ along with gostint.  If not, see <https://www.gnu.org/licenses/>.
 package job
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gbevan/gostint/apierrors"
 	"github.com/gbevan/gostint/authenticate"
+	"github.com/gbevan/gostint/config"
+	"github.com/gbevan/gostint/content"
 	"github.com/gbevan/gostint/jobqueues"
 	"github.com/gbevan/gostint/logmsg"
 	"github.com/globalsign/mgo"
@@ -41,9 +45,13 @@ import (
 
 const notfound = "not found"
 
+// dryRunTimeout bounds a dry run, which runs within the request
+const dryRunTimeout = 5 * time.Minute
+
 // JobRouter holds config state, e.g. the handle for the database
 type JobRouter struct { // nolint
-	Db *mgo.Database
+	Db  func() *mgo.Database
+	Cfg *config.Config
 }
 
 var (
@@ -73,9 +81,10 @@ func (j *JobRequest) Bind(req *http.Request) error {
 }
 
 // Routes Route handlers for jobs
-func Routes(db *mgo.Database) *chi.Mux {
+func Routes(db func() *mgo.Database, cfg *config.Config) *chi.Mux {
 	jobRouter = JobRouter{
-		Db: db,
+		Db:  db,
+		Cfg: cfg,
 	}
 	router := chi.NewRouter()
 
@@ -84,7 +93,12 @@ func Routes(db *mgo.Database) *chi.Mux {
 	)
 
 	router.Post("/", postJob)
+	router.Post("/validate", validateJob)
 	router.Post("/kill/{jobID}", killJob)
+	router.Post("/pin/{jobID}", pinJob)
+	router.Post("/unpin/{jobID}", unpinJob)
+	router.With(authenticate.RequirePolicy(authenticate.AdminPolicy)).Get("/export", exportJobs)
+	router.With(authenticate.RequirePolicy(authenticate.AdminPolicy)).Post("/import", importJobs)
 	router.Get("/{jobID}", getJob)
 	router.Get("/", listJobs)
 	router.Delete("/{jobID}", deleteJob)
@@ -93,18 +107,21 @@ func Routes(db *mgo.Database) *chi.Mux {
 }
 
 type getResponse struct {
-	ID             string    `json:"_id"`
-	Status         string    `json:"status"`
-	NodeUUID       string    `json:"node_uuid"`
-	Qname          string    `json:"qname"`
-	ContainerImage string    `json:"container_image"`
-	Submitted      time.Time `json:"submitted"`
-	Started        time.Time `json:"started"`
-	Ended          time.Time `json:"ended"`
-	Output         string    `json:"output"`
-	Stderr         string    `json:"stderr"`
-	ReturnCode     int       `json:"return_code"`
-	Tty            bool      `json:"tty"`
+	ID             string            `json:"_id"`
+	Status         string            `json:"status"`
+	NodeUUID       string            `json:"node_uuid"`
+	Qname          string            `json:"qname"`
+	ContainerImage string            `json:"container_image"`
+	Submitted      time.Time         `json:"submitted"`
+	Started        time.Time         `json:"started"`
+	Ended          time.Time         `json:"ended"`
+	Output         string            `json:"output"`
+	Stderr         string            `json:"stderr"`
+	ReturnCode     int               `json:"return_code"`
+	Tty            bool              `json:"tty"`
+	Labels         map[string]string `json:"labels"`
+	Pinned         bool              `json:"pinned"`
+	Audit          []string          `json:"audit"`
 }
 
 // // AuthCtxKey context key for authentication state & policy map
@@ -135,7 +152,7 @@ func listJobs(w http.ResponseWriter, req *http.Request) {
 	}
 
 	limit := 10
-	coll := jobRouter.Db.C("queues")
+	coll := jobRouter.Db().C("queues")
 	count, err := coll.Find(bson.M{}).Count()
 	if err != nil {
 		render.Render(w, req, apierrors.ErrInternalError(err))
@@ -167,6 +184,9 @@ func listJobs(w http.ResponseWriter, req *http.Request) {
 			Stderr:         job.Stderr,
 			ReturnCode:     job.ReturnCode,
 			Tty:            job.Tty,
+			Labels:         job.Labels,
+			Pinned:         job.Pinned,
+			Audit:          job.Audit,
 		})
 	}
 	paginateResp := listResponse{
@@ -192,7 +212,7 @@ func getJob(w http.ResponseWriter, req *http.Request) {
 		render.Render(w, req, apierrors.ErrInvalidJobRequest(errors.New("Invalid job ID (not ObjectIdHex)")))
 		return
 	}
-	coll := jobRouter.Db.C("queues")
+	coll := jobRouter.Db().C("queues")
 	var job JobRequest
 	err := coll.FindId(bson.ObjectIdHex(jobID)).One(&job)
 	if err != nil {
@@ -217,6 +237,9 @@ func getJob(w http.ResponseWriter, req *http.Request) {
 		Stderr:         job.Stderr,
 		ReturnCode:     job.ReturnCode,
 		Tty:            job.Tty,
+		Labels:         job.Labels,
+		Pinned:         job.Pinned,
+		Audit:          job.Audit,
 	})
 }
 
@@ -238,7 +261,7 @@ func deleteJob(w http.ResponseWriter, req *http.Request) {
 		render.Render(w, req, apierrors.ErrInvalidJobRequest(errors.New("Invalid job ID (not ObjectIdHex)")))
 		return
 	}
-	coll := jobRouter.Db.C("queues")
+	coll := jobRouter.Db().C("queues")
 
 	// Get status and ensure job is not running/stopping
 	// TODO: Look at making the find-and-remove atomic
@@ -258,6 +281,11 @@ func deleteJob(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if job.Pinned {
+		render.Render(w, req, apierrors.ErrInvalidJobRequest(errors.New("Cannot delete a pinned job, unpin it first")))
+		return
+	}
+
 	err = coll.RemoveId(bson.ObjectIdHex(jobID))
 	if err != nil {
 		if err.Error() == notfound {
@@ -281,6 +309,8 @@ type postResponse struct {
 // postJob post a job to the fifo queue
 // curl http://127.0.0.1:3232/v1/api/job -X POST -d '{"qname":"play", "jobtype": "ansible", "content": "base64 here", "run": "hello.yml"}'
 // -> {"qname":"play","jobtype":"ansible","content":"base64 here","run":"hello.yml"}
+// With ?dry_run=true the job is prepared, up to starting its container, and
+// the resolved job reported instead of being queued.
 func postJob(w http.ResponseWriter, req *http.Request) {
 	// timer := prometheus.NewTimer(jobDuration.WithLabelValues("postJob"))
 	// defer timer.ObserveDuration()
@@ -292,21 +322,29 @@ func postJob(w http.ResponseWriter, req *http.Request) {
 	}
 	job := data
 
-	coll := jobRouter.Db.C("queues")
+	coll := jobRouter.Db().C("queues")
 	newID := bson.NewObjectId()
 	jobRequest := job
 	jobRequest.ID = newID
+	jobRequest.SubmittedBy = authenticate.Identity(req)
 
 	if jobRequest.WrapSecretID == "" {
 		render.Render(w, req, apierrors.ErrInvalidJobRequest(errors.New("AppRole SecretID's Wrapping Token must be present in the job request")))
 		return
 	}
 
+	// limits in the encrypted payload are checked when the job runs
+	checkJob := jobqueues.Job(*jobRequest)
+	if err := checkJob.CheckLimits(); err != nil {
+		render.Render(w, req, apierrors.ErrInvalidJobRequest(err))
+		return
+	}
+
 	// Allow bypassing of cubbyhole, assuming unbroken TLS used for the request
 	if job.CubbyToken != "" && job.CubbyPath != "" {
 		// get encrypted payload from cubbyhole
 		client, err := api.NewClient(&api.Config{
-			Address: os.Getenv("VAULT_ADDR"),
+			Address: jobRouter.Cfg.VaultAddr,
 		})
 		if err != nil {
 			render.Render(w, req, apierrors.ErrInternalError(fmt.Errorf("Failed create vault client api: %s", err)))
@@ -321,6 +359,34 @@ func postJob(w http.ResponseWriter, req *http.Request) {
 		job.Payload = resp.Data["payload"].(string)
 	}
 
+	// prepare the job on this node without queuing it, its wrapped SecretID
+	// is consumed
+	if req.URL.Query().Get("dry_run") == "true" {
+		dryJob := jobqueues.Job(*jobRequest)
+		ctx, cancel := context.WithTimeout(req.Context(), dryRunTimeout)
+		defer cancel()
+		render.JSON(w, req, dryJob.DryRun(ctx))
+		return
+	}
+
+	// keep uploaded content referenced by the job while it exists
+	if strings.HasPrefix(job.Content, "ref,") {
+		sum := strings.TrimPrefix(strings.TrimPrefix(job.Content, "ref,"), content.RefPrefix)
+		blob, err := content.GetBlob(sum)
+		if err != nil {
+			render.Render(w, req, apierrors.ErrInvalidJobRequest(err))
+			return
+		}
+		if !blob.UsableBy(jobRequest.SubmittedBy) {
+			render.Render(w, req, apierrors.ErrPermissionDenied(fmt.Errorf("Content ref %s%s was not uploaded by you, only encrypted content may be shared", content.RefPrefix, sum)))
+			return
+		}
+		if err := content.Ref(sum, newID); err != nil {
+			render.Render(w, req, apierrors.ErrInvalidJobRequest(err))
+			return
+		}
+	}
+
 	err := coll.Insert(jobRequest)
 	if err != nil {
 		panic(err)
@@ -333,6 +399,19 @@ func postJob(w http.ResponseWriter, req *http.Request) {
 	})
 }
 
+// validateJob resolves a job request's meta data without queuing it
+// curl http://127.0.0.1:3232/v1/api/job/validate -X POST -d @job.json
+func validateJob(w http.ResponseWriter, req *http.Request) {
+	data := &JobRequest{}
+	if err := render.Bind(req, data); err != nil {
+		render.Render(w, req, apierrors.ErrInvalidJobRequest(err))
+		return
+	}
+	job := jobqueues.Job(*data)
+	job.SubmittedBy = authenticate.Identity(req)
+	render.JSON(w, req, job.Validate())
+}
+
 type killResponse struct {
 	ID            string `json:"_id"`
 	ContainerID   string `json:"container_id"`
@@ -355,7 +434,7 @@ func killJob(w http.ResponseWriter, req *http.Request) {
 		render.Render(w, req, apierrors.ErrInvalidJobRequest(errors.New("Invalid job ID (not ObjectIdHex)")))
 		return
 	}
-	coll := jobRouter.Db.C("queues")
+	coll := jobRouter.Db().C("queues")
 	var job jobqueues.Job
 	err := coll.FindId(bson.ObjectIdHex(jobID)).One(&job)
 	if err != nil {
@@ -380,3 +459,163 @@ func killJob(w http.ResponseWriter, req *http.Request) {
 		KillRequested: true,
 	})
 }
+
+type pinResponse struct {
+	ID     string `json:"_id"`
+	Pinned bool   `json:"pinned"`
+}
+
+// Pin a Gostint job by Job ID to exempt it from retention purging
+func pinJob(w http.ResponseWriter, req *http.Request) {
+	setJobPinned(w, req, true)
+}
+
+// Unpin a Gostint job by Job ID, returning it to the retention policy
+func unpinJob(w http.ResponseWriter, req *http.Request) {
+	setJobPinned(w, req, false)
+}
+
+func setJobPinned(w http.ResponseWriter, req *http.Request, pinned bool) {
+	jobID := strings.TrimSpace(chi.URLParam(req, "jobID"))
+	if jobID == "" {
+		render.Render(w, req, apierrors.ErrInvalidJobRequest(errors.New("job ID missing from POST path")))
+		return
+	}
+	if !bson.IsObjectIdHex(jobID) {
+		render.Render(w, req, apierrors.ErrInvalidJobRequest(errors.New("Invalid job ID (not ObjectIdHex)")))
+		return
+	}
+	coll := jobRouter.Db().C("queues")
+	var job jobqueues.Job
+	err := coll.FindId(bson.ObjectIdHex(jobID)).One(&job)
+	if err != nil {
+		if err.Error() == notfound {
+			render.Render(w, req, apierrors.ErrNotFound(err))
+			return
+		}
+		render.Render(w, req, apierrors.ErrInternalError(err))
+		return
+	}
+
+	// only the job's submitter, or an admin, may change its retention
+	if !authenticate.IsAdmin(req) && (job.SubmittedBy == "" || job.SubmittedBy != authenticate.Identity(req)) {
+		render.Render(w, req, apierrors.ErrPermissionDenied(fmt.Errorf("Job %s was not submitted by you", jobID)))
+		return
+	}
+
+	// not conditional on the job's fence, pinning does not change its ownership
+	err = coll.UpdateId(job.ID, bson.M{"$set": bson.M{"pinned": pinned}})
+	if err != nil {
+		if err.Error() == notfound {
+			render.Render(w, req, apierrors.ErrNotFound(err))
+			return
+		}
+		render.Render(w, req, apierrors.ErrInternalError(err))
+		return
+	}
+
+	render.JSON(w, req, pinResponse{
+		ID:     jobID,
+		Pinned: pinned,
+	})
+}
+
+// exportJobs streams jobs matching the optional from/to (RFC3339, on submitted)
+// and qname query parameters as newline delimited json, without the secret
+// bearing request fields.
+// curl https://127.0.0.1:3232/v1/api/job/export?from=2018-11-01T00:00:00Z&qname=play
+func exportJobs(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		render.Render(w, req, apierrors.ErrInvalidRequest(err))
+		return
+	}
+
+	query := bson.M{}
+	submitted := bson.M{}
+	for param, op := range map[string]string{"from": "$gte", "to": "$lt"} {
+		v := req.FormValue(param)
+		if v == "" {
+			continue
+		}
+		t, err2 := time.Parse(time.RFC3339, v)
+		if err2 != nil {
+			render.Render(w, req, apierrors.ErrInvalidRequest(fmt.Errorf("Invalid %s date: %s", param, err2)))
+			return
+		}
+		submitted[op] = t
+	}
+	if len(submitted) > 0 {
+		query["submitted"] = submitted
+	}
+	if qname := req.FormValue("qname"); qname != "" {
+		query["qname"] = strings.ToLower(qname)
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+
+	coll := jobRouter.Db().C("queues")
+	iter := coll.Find(query).Sort("submitted").Iter()
+	var job jobqueues.Job
+	for iter.Next(&job) {
+		if err = enc.Encode(job.Sanitised()); err != nil {
+			logmsg.Error("export jobs write failed: %s", err)
+			break
+		}
+		job = jobqueues.Job{}
+	}
+	if err = iter.Close(); err != nil {
+		// headers already sent, can only log and truncate the stream
+		logmsg.Error("export jobs query failed: %s", err)
+	}
+}
+
+type importResponse struct {
+	Imported int      `json:"imported"`
+	Skipped  int      `json:"skipped"`
+	Errors   []string `json:"errors"`
+}
+
+// importJobs restores ended jobs from a newline delimited json stream, as
+// produced by exportJobs. Jobs that already exist or have not ended are
+// skipped.
+func importJobs(w http.ResponseWriter, req *http.Request) {
+	coll := jobRouter.Db().C("queues")
+	resp := importResponse{
+		Errors: []string{},
+	}
+
+	dec := json.NewDecoder(req.Body)
+	for line := 1; ; line++ {
+		var job jobqueues.Job
+		err := dec.Decode(&job)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// stream is no longer in sync, stop here
+			resp.Errors = append(resp.Errors, fmt.Sprintf("record %d: %s", line, err))
+			break
+		}
+
+		if !job.ID.Valid() || job.Ended.IsZero() {
+			resp.Skipped++
+			continue
+		}
+		j := job.Sanitised()
+		j.KillRequested = false
+		err = coll.Insert(&j)
+		if err != nil {
+			if mgo.IsDup(err) {
+				resp.Skipped++
+				continue
+			}
+			resp.Errors = append(resp.Errors, fmt.Sprintf("record %d (%s): %s", line, job.ID.Hex(), err))
+			continue
+		}
+		resp.Imported++
+	}
+
+	render.JSON(w, req, resp)
+}
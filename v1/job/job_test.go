@@ -0,0 +1,211 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package job
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gbevan/gostint/authenticate"
+	"github.com/gbevan/gostint/config"
+	"github.com/gbevan/gostint/jobqueues"
+	"github.com/gbevan/gostint/mongotest"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/go-chi/chi"
+)
+
+// useDb routes the package to a fake db server passing requests to the
+// handler for the test.
+func useDb(t *testing.T, handler mongotest.Handler) {
+	t.Helper()
+	srv := mongotest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	session, err := srv.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(session.Close)
+	old := jobRouter
+	jobRouter = JobRouter{
+		Db:  func() *mgo.Database { return session.DB("gostint") },
+		Cfg: &config.Config{},
+	}
+	t.Cleanup(func() { jobRouter = old })
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	id := bson.NewObjectId()
+	ended := time.Date(2018, 11, 2, 10, 0, 0, 0, time.UTC)
+	stored := bson.M{
+		"_id":            id,
+		"qname":          "play",
+		"status":         "success",
+		"submitted":      ended.Add(-time.Minute),
+		"ended":          ended,
+		"output":         "done",
+		"kill_requested": true,
+		"labels":         bson.M{"team": "ops"},
+		"cubby_token":    "s.cubby",
+		"cubby_path":     "cubbyhole/job",
+		"wrap_secret_id": "s.wrapped",
+		"payload":        "vault:v1:payload",
+		"lease_ids":      []string{"database/creds/app/l1"},
+		"audit":          []string{"2018-11-02T10:00:00Z Failed to revoke lease database/creds/app/l1: denied"},
+	}
+	inserted := []bson.M{}
+	useDb(t, func(req *mongotest.Request) []bson.M {
+		switch req.Command {
+		case "":
+			return []bson.M{stored}
+		case "insert":
+			docs, _ := req.Doc["documents"].([]interface{})
+			for _, d := range docs {
+				inserted = append(inserted, d.(bson.M))
+			}
+			return []bson.M{mongotest.Written(len(docs))}
+		}
+		return nil
+	})
+
+	w := httptest.NewRecorder()
+	exportJobs(w, httptest.NewRequest("GET", "/export?qname=play", nil))
+	exported := w.Body.String()
+	for _, secret := range []string{"s.cubby", "cubbyhole/job", "s.wrapped", "vault:v1:payload", "database/creds/app/l1"} {
+		if strings.Contains(exported, secret) {
+			t.Errorf("export contains %q: %s", secret, exported)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	importJobs(w, httptest.NewRequest("POST", "/import", bytes.NewBufferString(exported)))
+	var resp importResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Imported != 1 || resp.Skipped != 0 || len(resp.Errors) != 0 {
+		t.Fatalf("import = %+v, want 1 imported", resp)
+	}
+	if len(inserted) != 1 {
+		t.Fatalf("inserted %d jobs, want 1", len(inserted))
+	}
+
+	var job jobqueues.Job
+	raw, _ := bson.Marshal(inserted[0])
+	if err := bson.Unmarshal(raw, &job); err != nil {
+		t.Fatal(err)
+	}
+	if job.ID != id || job.Status != "success" || job.Output != "done" || !job.Ended.Equal(ended) ||
+		!reflect.DeepEqual(job.Labels, map[string]string{"team": "ops"}) {
+		t.Errorf("imported job = %+v, want the exported job's results", job)
+	}
+	if job.KillRequested {
+		t.Error("imported job has kill_requested set")
+	}
+	for _, field := range []string{"lease_ids", "audit"} {
+		if _, ok := inserted[0][field]; ok {
+			t.Errorf("imported job has %s: %v", field, inserted[0][field])
+		}
+	}
+	if job.CubbyToken != "" || job.CubbyPath != "" || job.WrapSecretID != "" || job.Payload != "" {
+		t.Errorf("imported job has secret bearing fields: %+v", job)
+	}
+}
+
+// authedRequest returns a request as authenticated by authenticate.Authenticate
+// with the identity and policies, routed with the jobID path param.
+func authedRequest(method, target, jobID, identity string, policies ...string) *http.Request {
+	auth := authenticate.AuthStruct{
+		Authenticated: true,
+		PolicyMap:     map[string]bool{},
+		Identity:      identity,
+	}
+	for _, p := range policies {
+		auth.PolicyMap[p] = true
+	}
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("jobID", jobID)
+	ctx := context.WithValue(context.Background(), authenticate.AuthCtxKey("auth"), auth)
+	ctx = context.WithValue(ctx, chi.RouteCtxKey, rctx)
+	return httptest.NewRequest(method, target, nil).WithContext(ctx)
+}
+
+func TestSetJobPinned(t *testing.T) {
+	owned, legacy := bson.NewObjectId(), bson.NewObjectId()
+	tests := []struct {
+		name     string
+		jobID    bson.ObjectId
+		identity string
+		policies []string
+		code     int
+	}{
+		{"submitter", owned, "entity:alice", nil, http.StatusOK},
+		{"other user", owned, "entity:bob", nil, http.StatusForbidden},
+		{"admin", owned, "entity:bob", []string{authenticate.AdminPolicy}, http.StatusOK},
+		{"root", owned, "accessor:a1", []string{"root"}, http.StatusOK},
+		{"no submitter recorded", legacy, "", nil, http.StatusForbidden},
+		{"no submitter recorded, admin", legacy, "entity:bob", []string{authenticate.AdminPolicy}, http.StatusOK},
+		{"not found", bson.NewObjectId(), "entity:alice", nil, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updated := []interface{}{}
+			useDb(t, func(req *mongotest.Request) []bson.M {
+				switch req.Command {
+				case "":
+					switch req.Doc["_id"] {
+					case owned:
+						return []bson.M{{"_id": owned, "status": "success", "submitted_by": "entity:alice"}}
+					case legacy:
+						return []bson.M{{"_id": legacy, "status": "success"}}
+					}
+					return nil
+				case "update":
+					stmts, _ := req.Doc["updates"].([]interface{})
+					for _, stmt := range stmts {
+						updated = append(updated, stmt.(bson.M)["q"].(bson.M)["_id"])
+					}
+					return []bson.M{mongotest.Written(len(stmts))}
+				}
+				return nil
+			})
+
+			w := httptest.NewRecorder()
+			pinJob(w, authedRequest("POST", "/pin/"+tt.jobID.Hex(), tt.jobID.Hex(), tt.identity, tt.policies...))
+			if w.Code != tt.code {
+				t.Fatalf("pin = %d %s, want %d", w.Code, w.Body.String(), tt.code)
+			}
+			want := []interface{}{}
+			if tt.code == http.StatusOK {
+				want = append(want, tt.jobID)
+			}
+			if !reflect.DeepEqual(updated, want) {
+				t.Errorf("updated jobs %v, want %v", updated, want)
+			}
+		})
+	}
+}
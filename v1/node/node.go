@@ -0,0 +1,127 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package nodeApi
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gbevan/gostint/apierrors"
+	"github.com/gbevan/gostint/authenticate"
+	"github.com/gbevan/gostint/pingclean"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+const notfound = "not found"
+
+// NodeRouter holds config state, e.g. the handle for the database
+type NodeRouter struct { // nolint
+	Db func() *mgo.Database
+}
+
+var nodeRouter NodeRouter
+
+// Routes Route handlers for gostint nodes
+func Routes(db func() *mgo.Database) *chi.Mux {
+	nodeRouter = NodeRouter{
+		Db: db,
+	}
+	router := chi.NewRouter()
+
+	router.Use(
+		authenticate.Authenticate,
+	)
+
+	router.Get("/", listNodes)
+	router.Group(func(r chi.Router) {
+		r.Use(authenticate.RequirePolicy(authenticate.AdminPolicy))
+		r.Post("/{nodeUUID}/drain", drainNode)
+		r.Post("/{nodeUUID}/resume", resumeNode)
+	})
+
+	return router
+}
+
+type listResponse struct {
+	Data []pingclean.Node `json:"data"`
+}
+
+// Retrieve the list of registered gostint nodes
+func listNodes(w http.ResponseWriter, req *http.Request) {
+	nodes := []pingclean.Node{}
+	err := nodeRouter.Db().C("nodes").Find(bson.M{}).Sort("hostname", "_id").All(&nodes)
+	if err != nil {
+		render.Render(w, req, apierrors.ErrInternalError(err))
+		return
+	}
+	render.JSON(w, req, listResponse{
+		Data: nodes,
+	})
+}
+
+type stateResponse struct {
+	ID             string `json:"_id"`
+	State          string `json:"state"`
+	RequestedState string `json:"requested_state"`
+}
+
+// Request a node stops taking new jobs, e.g. prior to patching
+func drainNode(w http.ResponseWriter, req *http.Request) {
+	requestNodeState(w, req, "draining")
+}
+
+// Request a drained node resumes taking new jobs
+func resumeNode(w http.ResponseWriter, req *http.Request) {
+	requestNodeState(w, req, "active")
+}
+
+// requestNodeState records the requested state on the node's record, the node
+// itself applies it when next polling its record.
+func requestNodeState(w http.ResponseWriter, req *http.Request, requested string) {
+	nodeUUID := strings.TrimSpace(chi.URLParam(req, "nodeUUID"))
+	if nodeUUID == "" {
+		render.Render(w, req, apierrors.ErrInvalidRequest(errors.New("node UUID missing from POST path")))
+		return
+	}
+
+	var node pingclean.Node
+	_, err := nodeRouter.Db().C("nodes").FindId(nodeUUID).Apply(mgo.Change{
+		Update:    bson.M{"$set": bson.M{"requested_state": requested}},
+		ReturnNew: true,
+	}, &node)
+	if err != nil {
+		if err.Error() == notfound {
+			render.Render(w, req, apierrors.ErrNotFound(err))
+			return
+		}
+		render.Render(w, req, apierrors.ErrInternalError(err))
+		return
+	}
+
+	render.JSON(w, req, stateResponse{
+		ID:             node.ID,
+		State:          node.State,
+		RequestedState: node.RequestedState,
+	})
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package nodeApi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gbevan/gostint/mongotest"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/go-chi/chi"
+)
+
+// useDb routes the package to a fake db server holding node-1, which is
+// active, returning a func listing the requested_state of each update.
+func useDb(t *testing.T) func() []interface{} {
+	t.Helper()
+	var mutex sync.Mutex
+	requested := []interface{}{}
+	srv := mongotest.NewServer(func(req *mongotest.Request) []bson.M {
+		if req.Command != "findAndModify" {
+			return nil
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if q, _ := req.Doc["query"].(bson.M); q["_id"] != "node-1" {
+			return []bson.M{mongotest.Modified(nil)}
+		}
+		set := req.Doc["update"].(bson.M)["$set"].(bson.M)
+		requested = append(requested, set["requested_state"])
+		return []bson.M{mongotest.Modified(bson.M{"_id": "node-1", "state": "active", "requested_state": set["requested_state"]})}
+	})
+	t.Cleanup(srv.Close)
+	session, err := srv.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(session.Close)
+	old := nodeRouter
+	nodeRouter = NodeRouter{Db: func() *mgo.Database { return session.DB("gostint") }}
+	t.Cleanup(func() { nodeRouter = old })
+	return func() []interface{} {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]interface{}{}, requested...)
+	}
+}
+
+// nodeRequest returns a POST request routed with the nodeUUID path param
+func nodeRequest(nodeUUID string) *http.Request {
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("nodeUUID", nodeUUID)
+	req := httptest.NewRequest("POST", "/node/drain", nil)
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+}
+
+func TestRequestNodeState(t *testing.T) {
+	tests := []struct {
+		name      string
+		handler   http.HandlerFunc
+		nodeUUID  string
+		code      int
+		requested string
+	}{
+		{"drain", drainNode, "node-1", http.StatusOK, "draining"},
+		{"resume", resumeNode, "node-1", http.StatusOK, "active"},
+		{"unknown node", drainNode, "node-2", http.StatusNotFound, ""},
+		{"no node", drainNode, " ", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requested := useDb(t)
+			w := httptest.NewRecorder()
+			tt.handler(w, nodeRequest(tt.nodeUUID))
+			if w.Code != tt.code {
+				t.Fatalf("response = %d %s, want %d", w.Code, w.Body.String(), tt.code)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+
+			if got := requested(); len(got) != 1 || got[0] != tt.requested {
+				t.Errorf("requested states recorded = %v, want [%s]", got, tt.requested)
+			}
+			var resp stateResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			want := stateResponse{ID: "node-1", State: "active", RequestedState: tt.requested}
+			if resp != want {
+				t.Errorf("response = %+v, want %+v", resp, want)
+			}
+		})
+	}
+}
@@ -21,8 +21,8 @@ package vault
 
 import (
 	"net/http"
-	"os"
 
+	"github.com/gbevan/gostint/config"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 	. "github.com/visionmedia/go-debug" // nolint
@@ -34,13 +34,9 @@ var vaultAddr string
 var vaultExtAddr string
 
 // Routes Route handler for vault
-func Routes() *chi.Mux {
-	vaultAddr = os.Getenv("VAULT_ADDR")
-	vaultExtAddr = os.Getenv("VAULT_EXTERNAL_ADDR")
-
-	if vaultExtAddr == "" {
-		vaultExtAddr = vaultAddr
-	}
+func Routes(cfg *config.Config) *chi.Mux {
+	vaultAddr = cfg.VaultAddr
+	vaultExtAddr = cfg.VaultExternalAddr
 
 	router := chi.NewRouter()
 	router.Get("/info", getVault)
@@ -0,0 +1,340 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package vaultsession
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gbevan/gostint/approle"
+	"github.com/gbevan/gostint/config"
+	"github.com/gbevan/gostint/logmsg"
+	"github.com/globalsign/mgo"
+	"github.com/hashicorp/vault/api"
+)
+
+// Manages gostint's own vault session, the gostint-run AppRole token and the
+// ephemeral MongoDB credentials read with it. Both are renewed at two thirds
+// of their ttl; once the token reaches its max ttl gostint logs in again, and
+// once the credentials can no longer be renewed (or the token they belong to
+// is replaced) new ones are read and a new db session logged in with them is
+// swapped in; the old session is closed, and its lease revoked, once calls
+// already using it have had time to finish.
+
+const dbCredsPath = "database/creds/gostint-dbauth-role"
+
+// minRenewal is the least remaining ttl worth renewing for, below it the
+// token or credentials are replaced instead.
+const minRenewal = time.Minute
+
+// retryInterval after a failed renewal or replacement
+const retryInterval = 10 * time.Second
+
+// retireGrace is how long a replaced db session is kept open for calls that
+// were already using it
+var retireGrace = time.Minute
+
+// VaultSession holds module state
+type VaultSession struct {
+	Cfg *config.Config
+
+	mutex        sync.Mutex
+	client       *api.Client
+	tokenExpires time.Time
+	tokenRenewAt time.Time
+	tokenRenew   bool
+	leaseID      string
+	leaseExpires time.Time
+	leaseRenewAt time.Time
+	leaseRenew   bool
+	lastError    string
+	lastErrorAt  time.Time
+
+	session *mgo.Session
+	db      *mgo.Database
+	stop    chan struct{}
+	done    chan struct{} // closed when manage has returned
+}
+
+var vs VaultSession
+
+// Init logs in to the vault, reads the db credentials, dials and logs in to
+// MongoDB, and starts managing their renewal.
+func Init(cfg *config.Config) error {
+	vs.Cfg = cfg
+	vs.stop = make(chan struct{})
+	vs.done = make(chan struct{})
+
+	if err := login(); err != nil {
+		return err
+	}
+	username, password, err := readDbCreds()
+	if err != nil {
+		return err
+	}
+
+	logmsg.Debug("Dialing Mongodb")
+	vs.session, err = mgo.Dial(cfg.DbURL)
+	if err != nil {
+		return fmt.Errorf("Failed to dial MongoDB: %s", err)
+	}
+	logmsg.Debug("Logging in to gostint db")
+	vs.db = vs.session.DB("gostint")
+	if err = vs.db.Login(username, password); err != nil {
+		vs.session.Close()
+		return fmt.Errorf("Failed to login to gostint db: %s", err)
+	}
+
+	go manage()
+	return nil
+}
+
+// DB returns the gostint db on the current session. The session is replaced
+// along with the db credentials, so get it for each use rather than keeping it.
+func DB() *mgo.Database {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	return vs.db
+}
+
+// Client returns gostint's own vault client, logged in with its gostint-run
+// AppRole, for reading secrets of gostint's configuration rather than a job's.
+func Client() *api.Client {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	return vs.client
+}
+
+// Stop ends renewals and closes the db session, for shutdown, leaving the
+// token and lease to expire. It waits for any renewal in progress, which could
+// otherwise swap in a new session after the old one is closed.
+func Stop() {
+	close(vs.stop)
+	<-vs.done
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	vs.session.Close()
+}
+
+// Health returns the state of gostint's vault token and db credentials lease
+func Health() map[string]string {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+
+	m := map[string]string{
+		"vault_token_expires": vs.tokenExpires.UTC().Format(time.RFC3339),
+		"db_lease_expires":    vs.leaseExpires.UTC().Format(time.RFC3339),
+		"vault_session":       "ok",
+	}
+	now := time.Now()
+	if vs.tokenExpires.Before(now) || vs.leaseExpires.Before(now) {
+		m["vault_session"] = "expired"
+	} else if vs.lastError != "" {
+		m["vault_session"] = "degraded"
+	}
+	if vs.lastError != "" {
+		m["vault_session_error"] = fmt.Sprintf("%s %s", vs.lastErrorAt.UTC().Format(time.RFC3339), vs.lastError)
+	}
+	return m
+}
+
+func setError(err error) {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	if err == nil {
+		vs.lastError = ""
+		return
+	}
+	logmsg.Error("Vault session: %s", err)
+	vs.lastError = err.Error()
+	vs.lastErrorAt = time.Now()
+}
+
+// login authenticates with the gostint-run AppRole. The token's ttl is taken
+// from the login itself, rather than spending one of its uses on a lookup.
+func login() error {
+	secretAuth, client, err := approle.LoginPushMode(vs.Cfg.RunRoleID, vs.Cfg.RunSecretID)
+	if err != nil {
+		return err
+	}
+	client.SetToken(secretAuth.ClientToken)
+
+	vs.mutex.Lock()
+	vs.client = client
+	vs.tokenExpires, vs.tokenRenewAt = expiry(time.Duration(secretAuth.LeaseDuration) * time.Second)
+	vs.tokenRenew = secretAuth.Renewable
+	vs.mutex.Unlock()
+	return nil
+}
+
+// expiry returns when a ttl expires and when to renew it, two thirds of the
+// way through. A ttl of 0 never expires.
+func expiry(ttl time.Duration) (expires time.Time, renewAt time.Time) {
+	now := time.Now()
+	if ttl == 0 {
+		never := now.AddDate(100, 0, 0)
+		return never, never
+	}
+	return now.Add(ttl), now.Add(ttl * 2 / 3)
+}
+
+// readDbCreds reads new MongoDB credentials, recording their lease
+func readDbCreds() (string, string, error) {
+	secret, err := vs.client.Logical().Read(dbCredsPath)
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to read db credentials: %s", err)
+	}
+	if secret == nil {
+		return "", "", fmt.Errorf("Failed to read db credentials: response is nil")
+	}
+	username, _ := secret.Data["username"].(string)
+	password, _ := secret.Data["password"].(string)
+
+	vs.mutex.Lock()
+	vs.leaseID = secret.LeaseID
+	vs.leaseExpires, vs.leaseRenewAt = expiry(time.Duration(secret.LeaseDuration) * time.Second)
+	vs.leaseRenew = secret.Renewable && secret.LeaseID != ""
+	vs.mutex.Unlock()
+	return username, password, nil
+}
+
+// manage renews or replaces the token and db credentials before they expire
+func manage() {
+	defer close(vs.done)
+	for {
+		vs.mutex.Lock()
+		next := vs.tokenRenewAt
+		if vs.leaseRenewAt.Before(next) {
+			next = vs.leaseRenewAt
+		}
+		if vs.lastError != "" {
+			next = time.Now().Add(retryInterval)
+		}
+		vs.mutex.Unlock()
+
+		select {
+		case <-vs.stop:
+			return
+		case <-time.After(time.Until(next)):
+		}
+
+		var err error
+		now := time.Now()
+		if !vs.tokenRenewAt.After(now) {
+			err = renewToken()
+		}
+		if err == nil && !vs.leaseRenewAt.After(now) {
+			err = renewLease()
+		}
+		setError(err)
+	}
+}
+
+func renewToken() error {
+	if vs.tokenRenew {
+		secret, err := vs.client.Auth().Token().RenewSelf(0)
+		if err == nil && secret != nil && secret.Auth != nil {
+			ttl := time.Duration(secret.Auth.LeaseDuration) * time.Second
+			if ttl >= minRenewal {
+				vs.mutex.Lock()
+				vs.tokenExpires, vs.tokenRenewAt = expiry(ttl)
+				vs.mutex.Unlock()
+				return nil
+			}
+		} else if err != nil {
+			logmsg.Warn("Vault session: renew token failed, logging in again: %s", err)
+		}
+	}
+
+	// at its max ttl, log in again; the db credentials' lease belongs to the
+	// old token so is replaced too
+	old := vs.client
+	if err := login(); err != nil {
+		return err
+	}
+	if err := rotateDbCreds(); err != nil {
+		return err
+	}
+	// revoking the old token revokes its db credentials, so wait until the
+	// old session is retired
+	time.AfterFunc(retireGrace, func() {
+		if err := old.Auth().Token().RevokeSelf(""); err != nil {
+			logmsg.Warn("Vault session: revoke old token failed: %s", err)
+		}
+	})
+	return nil
+}
+
+func renewLease() error {
+	if vs.leaseRenew {
+		secret, err := vs.client.Sys().Renew(vs.leaseID, 0)
+		if err == nil && secret != nil {
+			ttl := time.Duration(secret.LeaseDuration) * time.Second
+			if ttl >= minRenewal {
+				vs.mutex.Lock()
+				vs.leaseExpires, vs.leaseRenewAt = expiry(ttl)
+				vs.mutex.Unlock()
+				return nil
+			}
+		} else if err != nil {
+			logmsg.Warn("Vault session: renew db credentials failed, replacing them: %s", err)
+		}
+	}
+	return rotateDbCreds()
+}
+
+// rotateDbCreds reads new db credentials and swaps in a new session logged in
+// with them. The shared session is never logged out while in use, the old one
+// is closed and its credentials revoked after retireGrace.
+func rotateDbCreds() error {
+	oldLease := vs.leaseID
+	username, password, err := readDbCreds()
+	if err != nil {
+		return err
+	}
+
+	session := vs.session.Copy()
+	session.LogoutAll()
+	db := session.DB("gostint")
+	if err = db.Login(username, password); err != nil {
+		session.Close()
+		return fmt.Errorf("Failed to login to gostint db with new credentials: %s", err)
+	}
+
+	vs.mutex.Lock()
+	old := vs.session
+	vs.session = session
+	vs.db = db
+	vs.mutex.Unlock()
+	logmsg.Info("Vault session: swapped in a db session with new credentials")
+
+	client := vs.client
+	time.AfterFunc(retireGrace, func() {
+		old.Close()
+		if oldLease == "" {
+			return
+		}
+		if err := client.Sys().Revoke(oldLease); err != nil {
+			logmsg.Warn("Vault session: revoke old db credentials failed: %s", err)
+		}
+	})
+	return nil
+}
@@ -0,0 +1,277 @@
+/*
+Copyright 2018 Graham Lee Bevan <graham.bevan@ntlworld.com>
+
+This file is part of gostint.
+
+gostint is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+gostint is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with gostint.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package vaultsession
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gbevan/gostint/approle"
+	"github.com/gbevan/gostint/config"
+	"github.com/gbevan/gostint/mongotest"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// fakeVault is a vault server issuing gostint-run tokens and db credentials,
+// which it adds as users of the fake db server
+type fakeVault struct {
+	sync.Mutex
+	db *mongotest.Server
+
+	tokenRenewTTL int // seconds, granted by token renewals
+	leaseRenewTTL int // seconds, granted by lease renewals
+	logins        int
+	creds         int
+	revokedTokens []string
+	revokedLeases []string
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	var reply interface{}
+	switch path := strings.TrimPrefix(r.URL.Path, "/v1/"); {
+	case path == "auth/approle/login":
+		f.logins++
+		reply = map[string]interface{}{"auth": map[string]interface{}{
+			"client_token": fmt.Sprintf("token-%d", f.logins), "lease_duration": 3600, "renewable": true,
+		}}
+	case path == "auth/token/renew-self":
+		reply = map[string]interface{}{"auth": map[string]interface{}{
+			"client_token": r.Header.Get("X-Vault-Token"), "lease_duration": f.tokenRenewTTL, "renewable": true,
+		}}
+	case path == "auth/token/revoke-self":
+		f.revokedTokens = append(f.revokedTokens, r.Header.Get("X-Vault-Token"))
+	case path == dbCredsPath:
+		f.creds++
+		user, password := fmt.Sprintf("user-%d", f.creds), fmt.Sprintf("pass-%d", f.creds)
+		f.db.SetUser(user, password)
+		reply = map[string]interface{}{
+			"lease_id":       fmt.Sprintf("%s/%d", dbCredsPath, f.creds),
+			"lease_duration": 3600,
+			"renewable":      true,
+			"data":           map[string]interface{}{"username": user, "password": password},
+		}
+	case path == "sys/leases/renew":
+		reply = map[string]interface{}{"lease_duration": f.leaseRenewTTL, "renewable": true}
+	case strings.HasPrefix(path, "sys/leases/revoke/"):
+		f.revokedLeases = append(f.revokedLeases, strings.TrimPrefix(path, "sys/leases/revoke/"))
+	default:
+		http.Error(w, `{"errors": ["unexpected request"]}`, http.StatusNotFound)
+		return
+	}
+	if reply == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
+
+// grant sets the ttls, in seconds, granted by renewals
+func (f *fakeVault) grant(tokenTTL, leaseTTL int) {
+	f.Lock()
+	defer f.Unlock()
+	f.tokenRenewTTL, f.leaseRenewTTL = tokenTTL, leaseTTL
+}
+
+func (f *fakeVault) revoked() ([]string, []string) {
+	f.Lock()
+	defer f.Unlock()
+	return append([]string{}, f.revokedTokens...), append([]string{}, f.revokedLeases...)
+}
+
+// startSession inits the package against a fake vault and db server, with a
+// short retireGrace, returning the vault and a func giving the user each db
+// request is made as.
+func startSession(t *testing.T) (*fakeVault, func() string) {
+	t.Helper()
+	var mutex sync.Mutex
+	lastUser := ""
+	db := mongotest.NewServer(func(req *mongotest.Request) []bson.M {
+		mutex.Lock()
+		lastUser = req.User
+		mutex.Unlock()
+		return []bson.M{{"_id": "node-1"}}
+	})
+	t.Cleanup(db.Close)
+	fv := &fakeVault{db: db, tokenRenewTTL: 3600, leaseRenewTTL: 3600}
+	srv := httptest.NewServer(fv)
+	t.Cleanup(srv.Close)
+
+	oldGrace := retireGrace
+	retireGrace = 50 * time.Millisecond
+	cfg := &config.Config{VaultAddr: srv.URL, DbURL: db.Addr + "?connect=direct", RunRoleID: "run-role", RunSecretID: "run-secret"}
+	approle.Init(cfg)
+	if err := Init(cfg); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+	t.Cleanup(func() {
+		Stop()
+		time.Sleep(2 * retireGrace) // let retirements finish
+		retireGrace = oldGrace
+	})
+	return fv, func() string {
+		var doc bson.M
+		if err := DB().C("nodes").FindId("node-1").One(&doc); err != nil {
+			t.Fatalf("db request failed: %s", err)
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		return lastUser
+	}
+}
+
+// closed reports whether the db's session has been closed
+func closed(db *mgo.Database) (closed bool) {
+	defer func() {
+		closed = recover() != nil
+	}()
+	db.Session.Ping()
+	return false
+}
+
+// waitFor polls until cond is true, failing the test after a second
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for end := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(end) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestInit(t *testing.T) {
+	_, dbUser := startSession(t)
+	if u := dbUser(); u != "user-1" {
+		t.Errorf("db request made as %q, want user-1", u)
+	}
+	if c := Client(); c == nil || c.Token() != "token-1" {
+		t.Errorf("Client() token = %v, want token-1", c)
+	}
+	if h := Health(); h["vault_session"] != "ok" {
+		t.Errorf("Health() = %v, want ok", h)
+	}
+}
+
+func TestRenewLease(t *testing.T) {
+	fv, dbUser := startSession(t)
+	db := DB()
+	before := Health()["db_lease_expires"]
+	fv.grant(3600, 7200)
+
+	if err := renewLease(); err != nil {
+		t.Fatalf("renewLease() error = %v", err)
+	}
+	if DB() != db || dbUser() != "user-1" {
+		t.Error("renewLease() replaced the db session of renewable credentials")
+	}
+	if after := Health()["db_lease_expires"]; after <= before {
+		t.Errorf("db_lease_expires %s not extended from %s", after, before)
+	}
+}
+
+func TestRenewLeaseAtMaxTTL(t *testing.T) {
+	fv, dbUser := startSession(t)
+	old := DB()
+	fv.grant(3600, 30) // below minRenewal, the lease is at its max ttl
+
+	if err := renewLease(); err != nil {
+		t.Fatalf("renewLease() error = %v", err)
+	}
+	if closed(old) {
+		t.Fatal("old db session closed before retireGrace")
+	}
+	if u := dbUser(); u != "user-2" {
+		t.Errorf("db request made as %q after rotation, want user-2", u)
+	}
+	waitFor(t, "the old lease to be revoked", func() bool {
+		_, leases := fv.revoked()
+		return len(leases) == 1
+	})
+	if _, leases := fv.revoked(); leases[0] != dbCredsPath+"/1" {
+		t.Errorf("revoked leases %v, want the old credentials'", leases)
+	}
+	if !closed(old) {
+		t.Error("old db session not closed after retireGrace")
+	}
+}
+
+func TestRenewTokenAtMaxTTL(t *testing.T) {
+	fv, dbUser := startSession(t)
+	fv.grant(30, 3600) // below minRenewal, the token is at its max ttl
+
+	if err := renewToken(); err != nil {
+		t.Fatalf("renewToken() error = %v", err)
+	}
+	if c := Client(); c.Token() != "token-2" {
+		t.Errorf("Client() token = %s after logging in again, want token-2", c.Token())
+	}
+	// the credentials belonged to the old token, so are replaced too
+	if u := dbUser(); u != "user-2" {
+		t.Errorf("db request made as %q after rotation, want user-2", u)
+	}
+	waitFor(t, "the old token to be revoked", func() bool {
+		tokens, _ := fv.revoked()
+		return len(tokens) == 1
+	})
+	if tokens, _ := fv.revoked(); tokens[0] != "token-1" {
+		t.Errorf("revoked tokens %v, want token-1", tokens)
+	}
+}
+
+func TestRenewToken(t *testing.T) {
+	fv, dbUser := startSession(t)
+	before := Health()["vault_token_expires"]
+	fv.grant(7200, 3600)
+
+	if err := renewToken(); err != nil {
+		t.Fatalf("renewToken() error = %v", err)
+	}
+	if c := Client(); c.Token() != "token-1" {
+		t.Errorf("Client() token = %s, want the renewed token-1", c.Token())
+	}
+	if u := dbUser(); u != "user-1" {
+		t.Errorf("db request made as %q, want user-1", u)
+	}
+	if after := Health()["vault_token_expires"]; after <= before {
+		t.Errorf("vault_token_expires %s not extended from %s", after, before)
+	}
+}
+
+func TestHealthDegraded(t *testing.T) {
+	startSession(t)
+	setError(fmt.Errorf("Failed to read db credentials: denied"))
+	h := Health()
+	if h["vault_session"] != "degraded" || !strings.HasSuffix(h["vault_session_error"], "Failed to read db credentials: denied") {
+		t.Errorf("Health() = %v, want degraded with the error", h)
+	}
+	setError(nil)
+	if h = Health(); h["vault_session"] != "ok" {
+		t.Errorf("Health() = %v after recovering, want ok", h)
+	}
+}